@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Retry queue of backfills, kept apart from the daemon's in the block's log dir
+const _BACKFILL_POST_QUEUE_FILE = "postqueue-backfill.json"
+
+// Prefix of the temp files of backfill downloads, apart from the daemon's "@"
+const _BACKFILL_TEMP_PREFIX = "@backfill@"
+
+// backfill_window is what a backfill mirrors, files with a remote mtime in
+// [from, to) or, with dated_dirs, files under YYYYMMDD dirs in that range
+type backfill_window struct {
+	from       time.Time
+	to         time.Time
+	dated_dirs bool
+}
+
+func parse_backfill_window(from, to string, dated_dirs bool, loc *time.Location) (*backfill_window, error) {
+	if from == "" {
+		return nil, errors.New("--Backfill needs --From")
+	}
+	bw := &backfill_window{dated_dirs: dated_dirs}
+	t, err := time.ParseInLocation("20060102", from, loc)
+	if err != nil {
+		return nil, errors.New("Bad --From date " + from + ", expected YYYYMMDD")
+	}
+	bw.from = t
+	bw.to = time.Now().In(loc).AddDate(0, 0, 1)
+	if to != "" {
+		t, err := time.ParseInLocation("20060102", to, loc)
+		if err != nil {
+			return nil, errors.New("Bad --To date " + to + ", expected YYYYMMDD")
+		}
+		bw.to = t.AddDate(0, 0, 1)
+	}
+	if bw.to.After(bw.from) == false {
+		return nil, errors.New("--To is before --From")
+	}
+	return bw, nil
+}
+
+func (bw *backfill_window) in_window(t time.Time) bool {
+	return t.Before(bw.from) == false && t.Before(bw.to)
+}
+
+func (bw *backfill_window) skips_file(mtime time.Time, remote_dir string) bool {
+	/*
+	 With dated_dirs, files are taken from under a YYYYMMDD dir in the
+	 window whatever their mtime, else by their mtime
+	 */
+	if bw.dated_dirs == false {
+		return bw.in_window(mtime) == false
+	}
+	for _, part := range strings.Split(remote_dir, "/") {
+		if t, err := time.ParseInLocation("20060102", part, bw.from.Location()); err == nil && bw.in_window(t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (bw *backfill_window) skips_dir(name string) bool {
+	/*
+	 With dated_dirs, dirs named YYYYMMDD outside the window are skipped,
+	 other dirs are walked
+	 */
+	if bw.dated_dirs == false {
+		return false
+	}
+	t, err := time.ParseInLocation("20060102", name, bw.from.Location())
+	if err != nil {
+		return false
+	}
+	return bw.in_window(t) == false
+}
+
+func throttle_transfer(watch_data map[string]interface{}, bts int64, started time.Time) {
+	/*
+	 Sleeps as long as needed to keep a transfer that started at started
+	 and has read bts bytes under throttle_kbps
+	 */
+	kbps := block_rt(watch_data).throttle_kbps
+	if kbps <= 0 {
+		return
+	}
+	due := time.Duration(float64(bts) / 1024 / float64(kbps) * float64(time.Second))
+	if ahead := due - time.Since(started); ahead > 0 {
+		time.Sleep(ahead)
+	}
+}
+
+func (fw *FTPWatcher) _setup_backfill_signal_handling() {
+	/*
+	 ctrl+c or SIGTERM drain the backfill and remove its temp files like
+	 the daemon's shutdown, then exit 1. A second signal exits at once.
+	 */
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		fmt.Printf("Captured %v, stopping the backfill..\n", sig)
+		go func() {
+			sig := <-c
+			fmt.Printf("Captured %v again, exiting now\n", sig)
+			os.Exit(1)
+		}()
+		fw.shutdown(sig)
+		fmt.Println("Backfill interrupted")
+		os.Exit(1)
+	}()
+}
+
+func Backfill(configFile, blockname string) int {
+	/*
+	 Entry point of --Backfill, a single pass over a block for the window
+	 given by --From, --To and --Dateddirs, ignoring the skip_*_staler_than_days
+	 settings. It keeps its own log file and retry queue, so that a daemon
+	 running the block is not disturbed. Returns the exit status : 0 on
+	 success, 1 if a login, listing, download or post-processing failed or
+	 the run was interrupted, 2 on bad arguments
+	 */
+	all, err := load_watchlist(configFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	watchlist := make([]map[string]interface{}, 0)
+	for _, watch_data := range all {
+		if block_config(watch_data).Name == blockname {
+			watchlist = append(watchlist, watch_data)
+		}
+	}
+	if len(watchlist) == 0 {
+		fmt.Println("No block called", blockname, "in", configFile)
+		return 2
+	}
+	bw, err := parse_backfill_window(opt.From, opt.To, opt.Dateddirs, block_config(watchlist[0]).location())
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	// Its own log, retry queue and temp names, see newFTPWatcher
+	fw := newFTPWatcher(watchlist, false)
+	fw.config_file = configFile
+	fw._setup_backfill_signal_handling()
+	watch_data := fw.watchers[0]
+	// Nothing runs on the block yet
+	rt := block_rt(watch_data)
+	rt.backfill = bw
+	rt.throttle_kbps = block_config(watch_data).BackfillKbps
+	if opt.Kbps > 0 {
+		rt.throttle_kbps = opt.Kbps
+	}
+	logger := rt.logger
+	logger.Printf("Backfilling %s from %s to %s, dated dirs %v, throttled to %v KB/s\n", blockname,
+		bw.from.Format("20060102"), bw.to.AddDate(0, 0, -1).Format("20060102"), bw.dated_dirs, rt.throttle_kbps)
+	fmt.Println("Backfilling", blockname, "- see", path.Join(block_config(watch_data).LogDir, fw.__log_filename))
+	if opt.Dryrun {
+		plan := &dry_run_plan{block: blockname}
+		rt.dry_run = plan
+		fw.run_pass(fw.ctx, watch_data)
+		bs := fw._block_state(watch_data).status(blockname)
+		for _, what := range bs.LastFailures {
+			plan.note("failed : %s", what)
+		}
+		plan.note("%d downloads, %d bytes, %d skipped, %d failures, %d bad commands",
+			plan.downloads, plan.bytes, plan.skipped, bs.Failures, plan.errors)
+		if bs.Failures > 0 || plan.errors > 0 {
+			return 1
+		}
+		return 0
+	}
+	// Files left over by an earlier backfill are all retried
+	fw.retry_post_jobs(watch_data, []string{"all"})
+	fw.active_passes.Add(1)
+	fw.run_pass(fw.ctx, watch_data)
+	fw.active_passes.Done()
+	fw.post_process_pending.Wait()
+	pq := fw._post_queue(watch_data)
+	pq.mu.Lock()
+	failed := len(pq.jobs)
+	pq.mu.Unlock()
+	bs := fw._block_state(watch_data).status(blockname)
+	fmt.Printf("Backfill of %s done, %d bytes downloaded, %d failures, post-processing failed for %d files\n",
+		blockname, bs.TotalBytes, bs.Failures, failed)
+	for _, what := range bs.LastFailures {
+		fmt.Println("    failed :", what)
+	}
+	if failed > 0 {
+		fmt.Println("They are listed in", pq.file, "and retried by the next backfill")
+	}
+	if bs.Failures > 0 || failed > 0 || fw.is_shutting_down() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/LDCS/qcfg"
+)
+
+// DayTime is a time of day, given as HHMMSS in the scheduler row
+type DayTime struct {
+	Hour   int
+	Minute int
+	Second int
+	Set    bool
+}
+
+func parse_day_time(s string) (DayTime, error) {
+	if len(s) != 6 {
+		return DayTime{}, errors.New(s + " is not a time of day as HHMMSS")
+	}
+	hour, err1 := strconv.Atoi(s[0:2])
+	minute, err2 := strconv.Atoi(s[2:4])
+	second, err3 := strconv.Atoi(s[4:6])
+	if err1 != nil || err2 != nil || err3 != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 || second < 0 || second > 59 {
+		return DayTime{}, errors.New(s + " is not a time of day as HHMMSS")
+	}
+	return DayTime{hour, minute, second, true}, nil
+}
+
+// On returns the time of day on the day of t, in the location of t
+func (dt DayTime) On(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), dt.Hour, dt.Minute, dt.Second, 0, t.Location())
+}
+
+func (dt DayTime) String() string {
+	if dt.Set == false {
+		return ""
+	}
+	return fmt.Sprintf("%02d%02d%02d", dt.Hour, dt.Minute, dt.Second)
+}
+
+// BlockConfig is the configuration of a block, filled from the cfg file by
+// load_block_config only. It is not changed once the block is started; the
+// runtime state of the block, its connection, current dir, thread, caches and
+// queues, stays in its watch_data.
+type BlockConfig struct {
+	Name   string
+	LogDir string
+	// ftp-watcher row
+	Hostname                   string
+	User                       string
+	Passwd                     string `json:"-"`
+	PasswdSource               string // passwd or the passwd_file=, passwd_env=, passwd_cmd= or passwd_store= it came from
+	Dest                       string
+	StartDir                   string
+	Mode                       string
+	Debug                      bool
+	Tz                         string
+	ServerTz                   string
+	DestFileCheck              bool
+	SkipDirRFileStalerThanDays int
+	SkipFileStalerThanDays     int
+	SkipDirNameStalerThanDays  int
+	ThreadNo                   int
+	PollTime                   int // Seconds
+	ListInternalReadTimeout    time.Duration
+	StallDuration              time.Duration
+	NetTimeout                 time.Duration
+	CmdTimeout                 time.Duration
+	PostRetries                int
+	PostRetryBackoff           time.Duration
+	SlowTransferKbps           int
+	BackfillKbps               int
+	SkipPatterns               []string
+	// Other rows
+	Distribution   string
+	DownloadCheck  string
+	PostDownload   string
+	UseProxy       bool
+	ProxyHost      string
+	StartTime      DayTime
+	EndTime        DayTime
+	WarnTime       DayTime
+	WarnCmd        string
+	AlertRecipient string
+	AlertSubject   string
+	AlertBody      string
+	// lmirror row, checked by check_lmirror_cfg_parms at startup
+	Stages []*lmirror_stage
+	// Of the settings above, to find the blocks changed on reload
+	Fingerprint string `json:"-"`
+}
+
+// config_error is a setting of a block that load_block_config could not use
+type config_error struct {
+	Row   string
+	Key   string
+	Fatal bool // The block cannot run with it, otherwise a default is used
+	Msg   string
+}
+
+func (e config_error) Error() string {
+	return fmt.Sprintf("%s :: %s= : %s", e.Row, e.Key, e.Msg)
+}
+
+// block_reader reads the settings of a block, collecting what is wrong with them
+type block_reader struct {
+	ccfg  *qcfg.CfgBlock
+	block string
+	errs  []config_error
+}
+
+func (r *block_reader) fail(row, key string, fatal bool, format string, args ...interface{}) {
+	r.errs = append(r.errs, config_error{Row: row, Key: key, Fatal: fatal, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (r *block_reader) str(row, key, def string) string {
+	return r.ccfg.Str(r.block, row, key, def)
+}
+
+func (r *block_reader) int(row, key string, def int) int {
+	s := r.str(row, key, "")
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		r.fail(row, key, false, "%s is not a whole number, using %d", s, def)
+		return def
+	}
+	return n
+}
+
+func (r *block_reader) duration(row, key, def string) time.Duration {
+	s := r.str(row, key, def)
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		r.fail(row, key, false, "%s is not a duration such as 90s or 5m, using %s", s, def)
+		d, _ = time.ParseDuration(def)
+	}
+	return d
+}
+
+func (r *block_reader) day_time(key string, required bool) DayTime {
+	s := r.str(_CONFIG_SCHEDULER_ROW, key, "")
+	if s == "" {
+		if required {
+			r.fail(_CONFIG_SCHEDULER_ROW, key, true, "missing")
+		}
+		return DayTime{}
+	}
+	dt, err := parse_day_time(s)
+	if err != nil {
+		r.fail(_CONFIG_SCHEDULER_ROW, key, true, "%v", err)
+	}
+	return dt
+}
+
+func (r *block_reader) choice(row, key, def string, choices []string) string {
+	s := r.str(row, key, "")
+	if s == "" {
+		return def
+	}
+	for _, choice := range choices {
+		if s == choice {
+			return s
+		}
+	}
+	if def == "" {
+		r.fail(row, key, false, "%s is not one of %s, ignoring it", s, strings.Join(choices, ", "))
+	} else {
+		r.fail(row, key, false, "%s is not one of %s, using %s", s, strings.Join(choices, ", "), def)
+	}
+	return def
+}
+
+func load_block_config(ccfg *qcfg.CfgBlock, block_name string) (*BlockConfig, []config_error) {
+	/*
+	 Reads the settings of block_name, applying the defaults, and checks
+	 them. Returns the config and what is wrong with it; the block must not
+	 be started if any of the errors is fatal.
+	 */
+	r := &block_reader{ccfg: ccfg, block: block_name}
+	cfg := &BlockConfig{Name: block_name}
+	cfg.LogDir = path.Join(opt.Logbasedir, block_name)
+	cfg.Hostname = r.str(_CONFIG_PARAM_ROW, "hostname", "")
+	cfg.User = r.str(_CONFIG_PARAM_ROW, "user", "")
+	cfg.Dest = r.str(_CONFIG_PARAM_ROW, "destination", "")
+	cfg.StartDir = r.str(_CONFIG_PARAM_ROW, "start_dir", "")
+	cfg.Mode = r.choice(_CONFIG_PARAM_ROW, "mode", _DEFAULT_MODE, _MODE_CHOICES)
+	debug := r.str(_CONFIG_PARAM_ROW, "debug", "")
+	cfg.Debug = debug == "1" || debug == "true"
+	cfg.Tz = r.str(_CONFIG_PARAM_ROW, "tz", "")
+	cfg.ServerTz = r.str(_CONFIG_PARAM_ROW, "server_tz", "")
+	for _, tz := range [][2]string{{"tz", cfg.Tz}, {"server_tz", cfg.ServerTz}} {
+		if _, err := time.LoadLocation(tz[1]); err != nil {
+			r.fail(_CONFIG_PARAM_ROW, tz[0], true, "%s is not a known timezone", tz[1])
+		}
+	}
+	cfg.DestFileCheck = r.str(_CONFIG_PARAM_ROW, "dest_file_check", "false") == "true"
+	cfg.SkipDirRFileStalerThanDays = r.int(_CONFIG_PARAM_ROW, "skip_dirRfile_time_staler_than_days", 30)
+	cfg.SkipFileStalerThanDays = r.int(_CONFIG_PARAM_ROW, "skip_file_time_staler_than_days", 30)
+	cfg.SkipDirNameStalerThanDays = r.int(_CONFIG_PARAM_ROW, "skip_dir_name_staler_than_days", 30)
+	cfg.ThreadNo = r.int(_CONFIG_PARAM_ROW, "thread_no", 0)
+	cfg.PollTime = r.int(_CONFIG_PARAM_ROW, "poll_time", 300)
+	cfg.ListInternalReadTimeout = r.duration(_CONFIG_PARAM_ROW, "list_internal_read_timeout", "60s")
+	if r.str(_CONFIG_PARAM_ROW, "stall_duration", "") != "" {
+		cfg.StallDuration = r.duration(_CONFIG_PARAM_ROW, "stall_duration", "25m")
+	} else {
+		cfg.StallDuration = r.duration(_CONFIG_PARAM_ROW, "log_file_stale_duration", "25m")
+	}
+	cfg.NetTimeout = r.duration(_CONFIG_PARAM_ROW, "net_timeout", "5m")
+	cfg.CmdTimeout = r.duration(_CONFIG_PARAM_ROW, "cmd_timeout", "30m")
+	cfg.Passwd, cfg.PasswdSource = r.passwd()
+	cfg.PostRetries = r.int(_CONFIG_PARAM_ROW, "post_retries", 3)
+	cfg.PostRetryBackoff = r.duration(_CONFIG_PARAM_ROW, "post_retry_backoff", "5m")
+	cfg.SlowTransferKbps = r.int(_CONFIG_PARAM_ROW, "slow_transfer_kbps", 0)
+	cfg.BackfillKbps = r.int(_CONFIG_PARAM_ROW, "backfill_kbps", 0)
+	cfg.SkipPatterns = make([]string, 0)
+	for _, pat := range strings.Split(r.str(_CONFIG_PARAM_ROW, "skip_patterns", ""), _SKIP_PATTERNS_SEP) {
+		pat = strings.Replace(pat, _SKIP_PATTERNS_LITERAL_SEP, _SKIP_PATTERNS_SEP, -1)
+		if pat == "" {
+			continue
+		}
+		if _, err := path.Match(pat, ""); err != nil {
+			r.fail(_CONFIG_PARAM_ROW, "skip_patterns", false, "%q never matches : %v", pat, err)
+		}
+		cfg.SkipPatterns = append(cfg.SkipPatterns, pat)
+	}
+	cfg.SkipPatterns = append(cfg.SkipPatterns, _DEFAULT_SKIP_PATTERNS...)
+
+	if method := r.str(_CONFIG_DISTRIBUTION_ROW, "method", ""); method != "" {
+		cfg.Distribution = r.choice(_CONFIG_DISTRIBUTION_ROW, "method", "", _DISTRIBUTION_CHOICES)
+	}
+	cfg.DownloadCheck = r.str(_CONFIG_DOWNLOAD_CHECK_ROW, "app", "")
+	cfg.PostDownload = r.str(_CONFIG_POST_DOWNLOAD_ROW, "app", "")
+	cfg.UseProxy = r.int(_CONFIG_PROXY_ROW, "useProxy", 0) != 0
+	cfg.ProxyHost = r.str(_CONFIG_PROXY_ROW, "hostname", "")
+	if cfg.ProxyHost == "" {
+		cfg.ProxyHost = _DEFAULT_PROXY_HOST
+	}
+	cfg.StartTime = r.day_time("start_time", true)
+	cfg.EndTime = r.day_time("end_time", true)
+	cfg.WarnTime = r.day_time("warn_time", false)
+	cfg.WarnCmd = r.str(_CONFIG_SCHEDULER_ROW, "warn_cmd", "")
+	cfg.AlertRecipient = r.str(_CONFIG_ALERT_ROW, "recipient", "")
+	cfg.AlertSubject = r.str(_CONFIG_ALERT_ROW, "subject", "")
+	cfg.AlertBody = r.str(_CONFIG_ALERT_ROW, "body", "")
+	cfg.Stages = parse_lmirror_stages(ccfg, block_name, r.str(_CONFIG_LMIRROR_ROW, "plugins", ""))
+
+	// Required settings and the ones that go together
+	for _, req := range [][2]string{{"hostname", cfg.Hostname}, {"user", cfg.User}, {"destination", cfg.Dest}} {
+		if req[1] == "" {
+			r.fail(_CONFIG_PARAM_ROW, req[0], true, "missing")
+		}
+	}
+	if cfg.WarnTime.Set {
+		if cfg.WarnCmd == "" {
+			r.fail(_CONFIG_SCHEDULER_ROW, "warn_time", true, "needs warn_cmd=")
+		}
+		if cfg.AlertRecipient == "" || cfg.AlertSubject == "" || cfg.AlertBody == "" {
+			r.fail(_CONFIG_SCHEDULER_ROW, "warn_time", true, "needs recipient=, subject= and body= in the %s row", _CONFIG_ALERT_ROW)
+		}
+	}
+	fw := &FTPWatcher{_command_separator: "^"}
+	for _, c := range [][3]string{{_CONFIG_DOWNLOAD_CHECK_ROW, "app", cfg.DownloadCheck},
+		{_CONFIG_POST_DOWNLOAD_ROW, "app", cfg.PostDownload}, {_CONFIG_SCHEDULER_ROW, "warn_cmd", cfg.WarnCmd}} {
+		if err := fw.check_command(c[2]); err != nil {
+			r.fail(c[0], c[1], true, "%v", err)
+		}
+	}
+	cfg.Fingerprint = config_fingerprint(cfg)
+	return cfg, r.errs
+}
+
+func block_config(watch_data map[string]interface{}) *BlockConfig {
+	return watch_data["config"].(*BlockConfig)
+}
+
+func load_location(tz string) *time.Location {
+	if tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// location is the timezone of the block, tz= or else local time
+func (cfg *BlockConfig) location() *time.Location {
+	return load_location(cfg.Tz)
+}
+
+// server_location is the timezone of the server, server_tz= or else that of the block
+func (cfg *BlockConfig) server_location() *time.Location {
+	if cfg.ServerTz == "" {
+		return cfg.location()
+	}
+	return load_location(cfg.ServerTz)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// A block with every required setting, the cases add their rows to it
+const _TEST_BLOCK = `%block a
+{
+  ftp-watcher :: hostname=h; user=u; passwd=p; destination=/d;
+  scheduler :: start_time=000000; end_time=235959;
+`
+
+func TestLoadBlockConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		rows   string
+		errors []string // row::key and whether it is fatal
+	}{
+		{"complete", "", nil},
+		{"missing keys", "ftp-watcher :: hostname=; destination=;\nscheduler :: end_time=;\n",
+			[]string{"ftp-watcher::destination fatal", "ftp-watcher::hostname fatal", "scheduler::end_time fatal"}},
+		{"no password", "ftp-watcher :: passwd=;\n", []string{"ftp-watcher::passwd warning"}},
+		{"two passwords", "ftp-watcher :: passwd_env=FTP_PASS;\n", []string{"ftp-watcher::passwd_env fatal"}},
+		{"bad time of day", "scheduler :: start_time=250000;\n", []string{"scheduler::start_time fatal"}},
+		{"bad timezones", "ftp-watcher :: tz=Mars/Olympus; server_tz=Nowhere;\n",
+			[]string{"ftp-watcher::server_tz fatal", "ftp-watcher::tz fatal"}},
+		{"warn_time alone", "scheduler :: warn_time=080000;\n",
+			[]string{"scheduler::warn_time fatal", "scheduler::warn_time fatal"}},
+		{"warn_time with its command and alert", "scheduler :: warn_time=080000; warn_cmd=check __FILE__;\n" +
+			"warn-alert :: recipient=ops; subject=late; body=late;\n", nil},
+		{"bad numbers and durations", "ftp-watcher :: thread_no=many; net_timeout=soon; post_retry_backoff=5;\n",
+			[]string{"ftp-watcher::net_timeout warning", "ftp-watcher::post_retry_backoff warning", "ftp-watcher::thread_no warning"}},
+		{"unknown choices", "ftp-watcher :: mode=copy;\ndistribution :: method=carrier-pigeon;\n",
+			[]string{"distribution::method warning", "ftp-watcher::mode warning"}},
+		{"bad skip pattern", "ftp-watcher :: skip_patterns=[;\n", []string{"ftp-watcher::skip_patterns warning"}},
+		{"bad commands", "download-check :: app=gzip -t 'x;\npost-download :: app=mv __NOPE__ /x;\n",
+			[]string{"download-check::app fatal", "post-download::app fatal"}},
+		{"environment only command", "post-download :: app=TZ=UTC;\n", []string{"post-download::app fatal"}},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "main.cfg")
+		if err := ioutil.WriteFile(file, []byte(_TEST_BLOCK+tt.rows+"}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cf := read_cfg(file)
+		if len(cf.errors) > 0 || len(cf.problems) > 0 {
+			t.Fatalf("%s : cfg %v %v", tt.name, cf.errors, cf.problems)
+		}
+		_, errs := load_block_config(cf.qcfg(), "a")
+		got := make([]string, 0)
+		for _, cerr := range errs {
+			kind := "warning"
+			if cerr.Fatal {
+				kind = "fatal"
+			}
+			got = append(got, cerr.Row+"::"+cerr.Key+" "+kind)
+		}
+		sort.Strings(got)
+		want := tt.errors
+		if want == nil {
+			want = []string{}
+		}
+		if reflect.DeepEqual(got, want) == false {
+			t.Errorf("%s : errors %v (%v), want %v", tt.name, got, errs, want)
+		}
+	}
+}
+
+func TestLoadBlockConfigDefaults(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "main.cfg")
+	if err := ioutil.WriteFile(file, []byte(_TEST_BLOCK+"ftp-watcher :: log_file_stale_duration=40m;\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := load_block_config(read_cfg(file).qcfg(), "a")
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"mode", cfg.Mode, _DEFAULT_MODE},
+		{"poll_time", cfg.PollTime, 300},
+		{"net_timeout", cfg.NetTimeout, 5 * time.Minute},
+		{"cmd_timeout", cfg.CmdTimeout, 30 * time.Minute},
+		{"post_retries", cfg.PostRetries, 3},
+		{"post_retry_backoff", cfg.PostRetryBackoff, 5 * time.Minute},
+		{"stall_duration from log_file_stale_duration", cfg.StallDuration, 40 * time.Minute},
+		{"proxy host", cfg.ProxyHost, _DEFAULT_PROXY_HOST},
+		{"start_time", cfg.StartTime, DayTime{0, 0, 0, true}},
+		{"end_time", cfg.EndTime, DayTime{23, 59, 59, true}},
+		{"passwd source", cfg.PasswdSource, "passwd"},
+	}
+	for _, tt := range tests {
+		if reflect.DeepEqual(tt.got, tt.want) == false {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadBlockConfigBadChoices(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "main.cfg")
+	rows := "ftp-watcher :: mode=copy;\ndistribution :: method=carrier-pigeon;\n"
+	if err := ioutil.WriteFile(file, []byte(_TEST_BLOCK+rows+"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := load_block_config(read_cfg(file).qcfg(), "a")
+	if cfg.Mode != _DEFAULT_MODE {
+		t.Errorf("mode = %q, want %q", cfg.Mode, _DEFAULT_MODE)
+	}
+	if cfg.Distribution != "" {
+		t.Errorf("distribution = %q, want none", cfg.Distribution)
+	}
+}
+
+func TestLoginPasswd(t *testing.T) {
+	dir := t.TempDir()
+	passwd_file := filepath.Join(dir, "passwd")
+	if err := ioutil.WriteFile(passwd_file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FTPWATCHER_TEST_PASSWD", "from-env")
+	tests := []struct {
+		row  string
+		want string // blank if reading it fails
+	}{
+		{"passwd=p&", GenPasswd("p&")},
+		{"passwd_file=" + passwd_file, "from-file"},
+		{"passwd_file=" + filepath.Join(dir, "nosuch"), ""},
+		{"passwd_env=FTPWATCHER_TEST_PASSWD", "from-env"},
+		{"passwd_env=FTPWATCHER_TEST_UNSET", ""},
+		{"passwd_cmd=echo from-cmd", "from-cmd"},
+		{"passwd_cmd=false", ""},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "main.cfg")
+		rows := "ftp-watcher :: passwd=; " + tt.row + ";\n"
+		if err := ioutil.WriteFile(file, []byte(_TEST_BLOCK+rows+"}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Only the source is checked when the cfg is loaded
+		cfg, errs := load_block_config(read_cfg(file).qcfg(), "a")
+		if len(errs) > 0 {
+			t.Errorf("%s : load errors %v", tt.row, errs)
+		}
+		got, err := cfg.login_passwd()
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("%s : login_passwd() = %q, %v, want %q", tt.row, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path"
+	"sync"
+	"time"
+	"github.com/LDCS/goftp"
+)
+
+// block_runtime holds the objects a block shares between its watcher, its post
+// process threads, the CIM commands and reload. _check_watch_data makes it once,
+// before any of them runs, and stores it in watch_data["runtime"]. watch_data is
+// not written after that, what changes while the block runs lives here behind mu.
+type block_runtime struct {
+	logger  *log.Logger
+	state   *block_state
+	posts   *post_queue
+	ctx     context.Context // Cancelled when the block is stopped
+	cancel  context.CancelFunc
+	passes  *sync.WaitGroup
+	warns   *sync.WaitGroup // The warn scheduler, while it runs
+	post_in *work_queue // nil when the block has no post processing
+	warn_in chan work
+	today   time.Time // When the block was set up
+
+	// Set by --Backfill and --Dryrun before the pass, read only afterwards
+	backfill      *backfill_window
+	throttle_kbps int
+	dry_run       *dry_run_plan
+
+	mu            sync.Mutex
+	watcher       *watcher_handle
+	conn          *ftp.ServerConn
+	curdir        string
+	defaultdir    string
+	lastconnectat time.Time
+	stale         stale_limits
+	tstamps       map[string]time.Time // Destination file times for dest_file_check=true
+}
+
+// watcher_handle is the running watcher goroutine of a block
+type watcher_handle struct {
+	tid    int
+	cancel context.CancelFunc
+	done   chan bool
+}
+
+// stale_limits are the skip_*_staler_than_days= settings as times, set before each pass
+type stale_limits struct {
+	dir_rfile time.Time
+	file      time.Time
+	dir_name  time.Time
+}
+
+func (fw *FTPWatcher) new_block_runtime(cfg *BlockConfig, prev *block_runtime) *block_runtime {
+	/*
+	 Makes the runtime of a block. prev is the runtime of the block being
+	 replaced on reload, nil otherwise. While it drains, the new block
+	 shares its log and post processing queue if they are in the same dir.
+	 */
+	rt := new(block_runtime)
+	queue_file := path.Join(cfg.LogDir, fw.__post_queue_file)
+	if prev != nil && prev.posts.file == queue_file {
+		rt.logger = prev.logger
+		rt.posts = prev.posts
+	} else {
+		rt.logger = fw._setup_logger(cfg.Debug, cfg.LogDir, cfg.Name)
+		rt.posts = load_post_queue(queue_file)
+	}
+	rt.state = new_block_state()
+	rt.ctx, rt.cancel = context.WithCancel(fw.ctx)
+	rt.passes = new(sync.WaitGroup)
+	rt.warns = new(sync.WaitGroup)
+	rt.warn_in = make(chan work, 10)
+	rt.today = time.Now().In(cfg.location())
+	rt.tstamps = make(map[string]time.Time)
+	return rt
+}
+
+func block_rt(watch_data map[string]interface{}) *block_runtime {
+	return watch_data["runtime"].(*block_runtime)
+}
+
+func (rt *block_runtime) get_watcher() *watcher_handle {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.watcher
+}
+
+func (rt *block_runtime) set_watcher(wh *watcher_handle) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.watcher = wh
+}
+
+// server returns the ftp connection of the block, nil when not connected
+func (rt *block_runtime) server() *ftp.ServerConn {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.conn
+}
+
+func (rt *block_runtime) set_server(conn *ftp.ServerConn) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.conn = conn
+}
+
+// quit_server logs out of the ftp server, if connected
+func (rt *block_runtime) quit_server() {
+	rt.mu.Lock()
+	conn := rt.conn
+	rt.conn = nil
+	rt.mu.Unlock()
+	if conn != nil {
+		conn.Quit()
+	}
+}
+
+// dir returns the remote dir the watcher is mirroring
+func (rt *block_runtime) dir() string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.curdir
+}
+
+func (rt *block_runtime) set_dir(dir string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.curdir = dir
+}
+
+// default_dir returns the login dir, when the block has no start_dir=
+func (rt *block_runtime) default_dir() string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.defaultdir
+}
+
+func (rt *block_runtime) set_default_dir(dir string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.defaultdir = dir
+}
+
+func (rt *block_runtime) connected_at() time.Time {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.lastconnectat
+}
+
+func (rt *block_runtime) set_connected_at(t time.Time) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.lastconnectat = t
+}
+
+func (rt *block_runtime) stale_limits() stale_limits {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.stale
+}
+
+func (rt *block_runtime) set_stale_limits(stale stale_limits) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.stale = stale
+}
+
+// tstamp returns the cached time of a destination file, zero if there is none
+func (rt *block_runtime) tstamp(file string) time.Time {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.tstamps[file]
+}
+
+func (rt *block_runtime) set_tstamp(file string, t time.Time) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.tstamps[file] = t
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"github.com/LDCS/qcfg"
+)
+
+// cfg_pos is where something is written in the cfg files
+type cfg_pos struct {
+	File string
+	Line int
+}
+
+func (pos cfg_pos) String() string {
+	return fmt.Sprintf("%s:%d", pos.File, pos.Line)
+}
+
+// cfg_entry is one key=value of a cfg file, with where it is written
+type cfg_entry struct {
+	Row   string
+	Key   string
+	Value string
+	Pos   cfg_pos
+	From  string // In a merged block, "%defaults" or the template it comes from, blank if set by the block
+}
+
+// cfg_block is a %block, %template or %defaults section of a cfg file,
+// as written or, once merged, with what its block inherits
+type cfg_block struct {
+	Kind    string // block, template or defaults
+	Name    string
+	Parents []string // Templates given after the colon, in order
+	Pos     cfg_pos
+	Entries []cfg_entry
+}
+
+// find returns the last entry setting row :: key=, nil if there is none
+func (blk *cfg_block) find(row, key string) *cfg_entry {
+	var found *cfg_entry
+	for idx := range blk.Entries {
+		if blk.Entries[idx].Row == row && blk.Entries[idx].Key == key {
+			found = &blk.Entries[idx]
+		}
+	}
+	return found
+}
+
+// line returns where row :: key= is set, or where the block starts if nowhere
+func (blk *cfg_block) line(row, key string) cfg_pos {
+	if e := blk.find(row, key); e != nil {
+		return e.Pos
+	}
+	return blk.Pos
+}
+
+// label names the section in diagnostics
+func (blk *cfg_block) label() string {
+	switch blk.Kind {
+	case "template":
+		return "%template " + blk.Name
+	case "defaults":
+		return "%defaults"
+	}
+	return blk.Name
+}
+
+// cfg_file is a cfg file with the files it includes. Sections are as
+// written, blocks have their %defaults and templates merged in.
+type cfg_file struct {
+	file     string
+	sections []*cfg_block
+	blocks   []*cfg_block
+	errors   []config_problem // The cfg cannot be used
+	problems []config_problem // Lines qcfg would skip
+}
+
+func (cf *cfg_file) fail(list *[]config_problem, blk *cfg_block, pos cfg_pos, format string, args ...interface{}) {
+	p := config_problem{File: pos.File, Line: pos.Line, Fatal: true, Msg: fmt.Sprintf(format, args...)}
+	if blk != nil {
+		p.Block = blk.label()
+	}
+	*list = append(*list, p)
+}
+
+func (cf *cfg_file) error() error {
+	/*
+	 The errors that keep the cfg from being used, nil if there are none
+	 */
+	if len(cf.errors) == 0 {
+		return nil
+	}
+	lines := make([]string, 0)
+	for _, p := range cf.errors {
+		lines = append(lines, p.String())
+	}
+	return errors.New(strings.Join(lines, "\n"))
+}
+
+func read_cfg(configFile string) *cfg_file {
+	/*
+	 Reads configFile and the files it includes, and merges into each block
+	 the %defaults sections and the templates it names
+	 */
+	cf := &cfg_file{file: configFile}
+	cf.read(configFile, cfg_pos{File: configFile}, nil)
+	cf.merge()
+	return cf
+}
+
+func (cf *cfg_file) read(file string, from cfg_pos, stack []string) {
+	/*
+	 Splits the cfg text into sections of key=value entries, the way qcfg
+	 reads them : "row :: k=v; k=v;" lines continued by "+= k=v;" lines,
+	 with # starting a comment. The { opening a section may end its
+	 header line. Lines outside the { } of a section are ignored, but for
+	 "%include file-or-glob", which reads the files it names, relative to
+	 the dir of file, at that point.
+	 */
+	for _, f := range stack {
+		if f == path.Clean(file) {
+			cf.fail(&cf.errors, nil, from, "%s includes itself through %s", file, strings.Join(stack, ", "))
+			return
+		}
+	}
+	stack = append(stack, path.Clean(file))
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		cf.fail(&cf.errors, nil, from, "cannot read the cfg file : %v", err)
+		return
+	}
+	var blk *cfg_block
+	in_body := false
+	row := ""
+	for idx, line := range strings.Split(string(buf), "\n") {
+		pos := cfg_pos{File: file, Line: idx + 1}
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "%include") && in_body == false {
+			pattern := strings.TrimSpace(strings.TrimPrefix(line, "%include"))
+			if pattern == "" {
+				cf.fail(&cf.errors, nil, pos, "%%include without a file")
+				continue
+			}
+			if path.IsAbs(pattern) == false {
+				pattern = path.Join(path.Dir(file), pattern)
+			}
+			files, err := filepath.Glob(pattern)
+			if err != nil {
+				cf.fail(&cf.errors, nil, pos, "%%include %s : %v", pattern, err)
+				continue
+			}
+			if len(files) == 0 && strings.ContainsAny(pattern, "*?[") == false {
+				files = []string{pattern} // Reported as not readable
+			}
+			sort.Strings(files)
+			for _, f := range files {
+				cf.read(f, pos, stack)
+			}
+			continue
+		}
+		if kind := cfg_section_kind(line); kind != "" {
+			blk = &cfg_block{Kind: kind, Pos: pos}
+			header := strings.TrimSpace(strings.TrimPrefix(line, "%"+kind))
+			opened := strings.HasSuffix(header, "{")
+			header = strings.TrimSuffix(header, "{")
+			if parts := strings.SplitN(header, ":", 2); len(parts) == 2 && kind != "defaults" {
+				header = parts[0]
+				for _, parent := range strings.Split(parts[1], ",") {
+					if parent = strings.TrimSpace(parent); parent != "" {
+						blk.Parents = append(blk.Parents, parent)
+					}
+				}
+			}
+			blk.Name = strings.TrimSpace(header)
+			if blk.Name == "" && kind != "defaults" {
+				cf.fail(&cf.errors, nil, pos, "%%%s without a name", kind)
+			}
+			cf.sections = append(cf.sections, blk)
+			in_body, row = opened, ""
+			continue
+		}
+		if line == "{" && blk != nil {
+			in_body = true
+			continue
+		}
+		if line == "}" {
+			in_body = false
+			continue
+		}
+		if in_body == false {
+			continue
+		}
+		rest := ""
+		if idx := strings.Index(line, "::"); idx != -1 {
+			row = strings.TrimSpace(line[:idx])
+			rest = line[idx+2:]
+		} else if strings.HasPrefix(line, "+=") {
+			if row == "" {
+				cf.fail(&cf.problems, blk, pos, "+= continues no row")
+				continue
+			}
+			rest = line[2:]
+		} else {
+			cf.fail(&cf.problems, blk, pos, "expected \"row :: key=value;\" or \"+= key=value;\", got %q", line)
+			continue
+		}
+		for _, item := range strings.Split(rest, ";") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			idx := strings.Index(item, "=")
+			if idx == -1 {
+				cf.fail(&cf.problems, blk, pos, "expected key=value in %s, got %q", row, item)
+				continue
+			}
+			blk.Entries = append(blk.Entries, cfg_entry{Row: row, Key: strings.TrimSpace(item[:idx]),
+				Value: strings.TrimSpace(item[idx+1:]), Pos: pos})
+		}
+	}
+}
+
+func cfg_section_kind(line string) string {
+	for _, kind := range []string{"block", "template", "defaults"} {
+		if line == "%"+kind || strings.HasPrefix(line, "%"+kind+" ") || strings.HasPrefix(line, "%"+kind+"\t") ||
+			strings.HasPrefix(line, "%"+kind+":") || strings.HasPrefix(line, "%"+kind+"{") {
+			return kind
+		}
+	}
+	return ""
+}
+
+func (cf *cfg_file) merge() {
+	/*
+	 Makes the blocks of the cfg : the entries of every %defaults section,
+	 then those of the templates a block names, each after its own
+	 templates, then those of the block. The last entry of a key wins.
+	 */
+	templates := make(map[string]*cfg_block)
+	defaults := make([]cfg_entry, 0)
+	for _, sec := range cf.sections {
+		if sec.Kind == "template" {
+			if prev, ok := templates[sec.Name]; ok {
+				cf.fail(&cf.errors, sec, sec.Pos, "template %s already defined at %s", sec.Name, prev.Pos)
+				continue
+			}
+			templates[sec.Name] = sec
+		} else if sec.Kind == "defaults" {
+			for _, e := range sec.Entries {
+				e.From = "%defaults"
+				defaults = append(defaults, e)
+			}
+		}
+	}
+	var inherit func(blk *cfg_block, names []string, seen []string) []cfg_entry
+	inherit = func(blk *cfg_block, names []string, seen []string) []cfg_entry {
+		out := make([]cfg_entry, 0)
+		for _, name := range names {
+			tmpl, ok := templates[name]
+			if !ok {
+				cf.fail(&cf.errors, blk, blk.Pos, "no template called %s", name)
+				continue
+			}
+			loop := false
+			for _, s := range seen {
+				loop = loop || s == name
+			}
+			if loop {
+				cf.fail(&cf.errors, blk, blk.Pos, "template %s inherits itself through %s", name, strings.Join(seen, ", "))
+				continue
+			}
+			out = append(out, inherit(tmpl, tmpl.Parents, append(seen, name))...)
+			for _, e := range tmpl.Entries {
+				e.From = name
+				out = append(out, e)
+			}
+		}
+		return out
+	}
+	seen := make(map[string]*cfg_block)
+	for _, sec := range cf.sections {
+		if sec.Kind != "block" {
+			continue
+		}
+		if prev, ok := seen[sec.Name]; ok {
+			cf.fail(&cf.errors, sec, sec.Pos, "block %s already defined at %s", sec.Name, prev.Pos)
+			continue
+		}
+		seen[sec.Name] = sec
+		blk := &cfg_block{Kind: "block", Name: sec.Name, Parents: sec.Parents, Pos: sec.Pos}
+		blk.Entries = append(blk.Entries, defaults...)
+		blk.Entries = append(blk.Entries, inherit(sec, sec.Parents, nil)...)
+		blk.Entries = append(blk.Entries, sec.Entries...)
+		cf.blocks = append(cf.blocks, blk)
+	}
+}
+
+func (cf *cfg_file) qcfg() *qcfg.CfgBlock {
+	/*
+	 The merged blocks as qcfg settings, for load_block_config
+	 */
+	ccfg := qcfg.NewCfgMem(cf.file)
+	for _, blk := range cf.blocks {
+		for _, e := range blk.Entries {
+			ccfg.EditEntry(blk.Name, e.Row, e.Key, e.Value)
+		}
+	}
+	return ccfg
+}
+
+func (cf *cfg_file) watchlist() []map[string]interface{} {
+	/*
+	 The watch data of each merged block, holding its config and what is
+	 wrong with it until _check_watch_data
+	 */
+	ccfg := cf.qcfg()
+	watchlist := make([]map[string]interface{}, 0)
+	for _, blk := range cf.blocks {
+		cfg, errs := load_block_config(ccfg, blk.Name)
+		watch_data := make(map[string]interface{})
+		watch_data["config"] = cfg
+		watch_data["config_errors"] = errs
+		watchlist = append(watchlist, watch_data)
+	}
+	return watchlist
+}
+
+func (blk *cfg_block) effective() []cfg_entry {
+	/*
+	 The entry that wins for each row and key of a merged block, rows and
+	 keys in the order they first appear
+	 */
+	last := make(map[string]cfg_entry)
+	order := make([]string, 0)
+	rows := make(map[string][]string)
+	for _, e := range blk.Entries {
+		id := e.Row + "::" + e.Key
+		if _, ok := last[id]; !ok {
+			if _, ok := rows[e.Row]; !ok {
+				order = append(order, e.Row)
+			}
+			rows[e.Row] = append(rows[e.Row], id)
+		}
+		last[id] = e
+	}
+	out := make([]cfg_entry, 0)
+	for _, row := range order {
+		for _, id := range rows[row] {
+			out = append(out, last[id])
+		}
+	}
+	return out
+}
+
+func DumpConfig(configFile string) int {
+	/*
+	 Entry point of --Dumpconfig. Prints every block, or those given by
+	 --Blocks, as it is once %include, %defaults and its templates are
+	 merged, each key with where it is set. Passwords are hidden. Returns
+	 the exit status : 0 on success, 1 if the cfg cannot be read, 2 on bad
+	 arguments
+	 */
+	cf := read_cfg(configFile)
+	if err := cf.error(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	blocks := cf.blocks
+	if opt.Blocks != "" {
+		blocks = make([]*cfg_block, 0)
+		for _, name := range strings.Split(opt.Blocks, ",") {
+			found := false
+			for _, blk := range cf.blocks {
+				if blk.Name == strings.TrimSpace(name) {
+					blocks = append(blocks, blk)
+					found = true
+				}
+			}
+			if found == false {
+				fmt.Println("No block called", strings.TrimSpace(name), "in", configFile)
+				return 2
+			}
+		}
+	}
+	for _, blk := range blocks {
+		header := "%block " + blk.Name
+		if len(blk.Parents) > 0 {
+			header += " : " + strings.Join(blk.Parents, ", ")
+		}
+		fmt.Printf("%-60s # %s\n{\n", header, blk.Pos)
+		for _, e := range blk.effective() {
+			value := e.Value
+			if e.Row == _CONFIG_PARAM_ROW && (e.Key == "passwd" || e.Key == "passwd_cmd" || e.Key == "passwd_env") {
+				value = "<hidden>"
+			}
+			from := e.Pos.String()
+			if e.From != "" {
+				from += " " + e.From
+			}
+			fmt.Printf("%-60s # %s\n", fmt.Sprintf("%s :: %s=%s;", e.Row, e.Key, value), from)
+		}
+		fmt.Println("}")
+	}
+	return 0
+}
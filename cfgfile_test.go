@@ -0,0 +1,231 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"github.com/LDCS/qcfg"
+)
+
+func TestReadCfg(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string // main.cfg is read, the others are there to be included
+		blocks   map[string]map[string]string
+		errors   int
+		problems int
+	}{
+		{
+			name: "plain block",
+			files: map[string]string{"main.cfg": `
+%block a    # a comment
+{
+  ftp-watcher :: hostname=h; user=u;
+  += destination=/d;   # continues ftp-watcher
+  scheduler :: start_time=000000;
+}`},
+			blocks: map[string]map[string]string{"a": {"ftp-watcher::hostname": "h", "ftp-watcher::user": "u",
+				"ftp-watcher::destination": "/d", "scheduler::start_time": "000000"}},
+		},
+		{
+			name: "brace on the header line",
+			files: map[string]string{"main.cfg": `
+%template t : u {
+  ftp-watcher :: mode=archive;
+}
+%template u {
+  ftp-watcher :: user=tu;
+}
+%defaults{
+  ftp-watcher :: thread_no=2;
+}
+%block a : t {
+  ftp-watcher :: hostname=h;
+}`},
+			blocks: map[string]map[string]string{"a": {"ftp-watcher::hostname": "h", "ftp-watcher::mode": "archive",
+				"ftp-watcher::user": "tu", "ftp-watcher::thread_no": "2"}},
+		},
+		{
+			name: "defaults, then templates in order, then the block",
+			files: map[string]string{"main.cfg": `
+%defaults
+{
+  ftp-watcher :: user=d; mode=mirror; thread_no=1;
+}
+%template t1
+{
+  ftp-watcher :: user=t1; thread_no=3;
+}
+%template t2 : t1
+{
+  ftp-watcher :: user=t2;
+}
+%block a : t2
+{
+  ftp-watcher :: thread_no=4;
+}
+%block b
+{
+  ftp-watcher :: user=b;
+}`},
+			blocks: map[string]map[string]string{
+				"a": {"ftp-watcher::user": "t2", "ftp-watcher::mode": "mirror", "ftp-watcher::thread_no": "4"},
+				"b": {"ftp-watcher::user": "b", "ftp-watcher::mode": "mirror", "ftp-watcher::thread_no": "1"},
+			},
+		},
+		{
+			name: "includes and globs",
+			files: map[string]string{
+				"main.cfg": `
+%include common.cfg
+%include vendors/*.cfg
+%block a : common
+{
+  ftp-watcher :: hostname=a;
+}`,
+				"common.cfg":    "%template common\n{\n  ftp-watcher :: user=c;\n}\n",
+				"vendors/b.cfg": "%block b : common\n{\n  ftp-watcher :: hostname=b;\n}\n",
+				"vendors/c.cfg": "%block c\n{\n  ftp-watcher :: hostname=c;\n}\n",
+			},
+			blocks: map[string]map[string]string{
+				"a": {"ftp-watcher::user": "c", "ftp-watcher::hostname": "a"},
+				"b": {"ftp-watcher::user": "c", "ftp-watcher::hostname": "b"},
+				"c": {"ftp-watcher::hostname": "c"},
+			},
+		},
+		{
+			name:   "missing include",
+			files:  map[string]string{"main.cfg": "%include nowhere.cfg\n%block a\n{\n  ftp-watcher :: hostname=a;\n}\n"},
+			blocks: map[string]map[string]string{"a": {"ftp-watcher::hostname": "a"}},
+			errors: 1,
+		},
+		{
+			name:   "include loop",
+			files:  map[string]string{"main.cfg": "%include other.cfg\n", "other.cfg": "%include main.cfg\n"},
+			blocks: map[string]map[string]string{},
+			errors: 1,
+		},
+		{
+			name: "unknown and looping templates, block defined twice",
+			files: map[string]string{"main.cfg": `
+%template t1 : t2
+{
+}
+%template t2 : t1
+{
+}
+%block a : nosuch
+{
+}
+%block b : t1
+{
+}
+%block b
+{
+}`},
+			blocks: map[string]map[string]string{"a": {}, "b": {}},
+			errors: 3,
+		},
+		{
+			name:     "lines qcfg would skip",
+			files:    map[string]string{"main.cfg": "%block a\n{\n  += user=u;\n  just words\n  ftp-watcher :: novalue;\n}\n"},
+			blocks:   map[string]map[string]string{"a": {}},
+			problems: 3,
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		for name, text := range tt.files {
+			os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cf := read_cfg(filepath.Join(dir, "main.cfg"))
+		blocks := make(map[string]map[string]string)
+		for _, blk := range cf.blocks {
+			blocks[blk.Name] = make(map[string]string)
+			for _, e := range blk.effective() {
+				blocks[blk.Name][e.Row+"::"+e.Key] = e.Value
+			}
+		}
+		if reflect.DeepEqual(blocks, tt.blocks) == false {
+			t.Errorf("%s : blocks %v, want %v", tt.name, blocks, tt.blocks)
+		}
+		if len(cf.errors) != tt.errors {
+			t.Errorf("%s : errors %v, want %d", tt.name, cf.errors, tt.errors)
+		}
+		if len(cf.problems) != tt.problems {
+			t.Errorf("%s : problems %v, want %d", tt.name, cf.problems, tt.problems)
+		}
+	}
+}
+
+func TestReadCfgMatchesQcfg(t *testing.T) {
+	/*
+	 Without %include, %defaults or %template the blocks must read as
+	 qcfg.NewCfg reads them. Every row and key found in any block is
+	 looked up in every block, so a key either side drops is caught.
+	 */
+	tests := []struct {
+		name string
+		text string // blank to read samplecfg.cfg
+	}{
+		{"samplecfg.cfg", ""},
+		{"plain blocks", `
+# leading comment
+%block a
+{
+  ftp-watcher :: hostname=h; user=u;   # trailing comment
+  += destination=/d;
+  += file_pattern=*.csv
+  scheduler :: start_time=000000; end_time=235959;
+}
+
+%block b
+{
+  ftp-watcher :: hostname=h2; user=; passwd=p=q;
+  ftp-watcher :: user=v;
+  lmirror :: plugin_a=split;
+}`},
+		{"no blocks", "# nothing but a comment\n"},
+	}
+	const missing = "\x00missing"
+	for _, tt := range tests {
+		file := "samplecfg.cfg"
+		if tt.text != "" {
+			file = filepath.Join(t.TempDir(), "main.cfg")
+			if err := ioutil.WriteFile(file, []byte(tt.text), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cf := read_cfg(file)
+		if len(cf.errors) > 0 || len(cf.problems) > 0 {
+			t.Errorf("%s : errors %v, problems %v", tt.name, cf.errors, cf.problems)
+		}
+		want := qcfg.NewCfg(file, file, false)
+		names := make([]string, 0)
+		keys := make(map[string]bool)
+		for _, blk := range cf.blocks {
+			names = append(names, blk.Name)
+			for _, e := range blk.effective() {
+				keys[e.Row+"::"+e.Key] = true
+			}
+		}
+		if wnames := want.GetBlocks(); len(wnames) != len(names) || (len(names) > 0 && reflect.DeepEqual(wnames, names) == false) {
+			t.Errorf("%s : blocks %v, qcfg %v", tt.name, names, wnames)
+		}
+		got := cf.qcfg()
+		for _, name := range names {
+			for id := range keys {
+				rk := strings.SplitN(id, "::", 2)
+				if g, w := got.Str(name, rk[0], rk[1], missing), want.Str(name, rk[0], rk[1], missing); g != w {
+					t.Errorf("%s : %s %s = %q, qcfg %q", tt.name, name, id, g, w)
+				}
+			}
+		}
+	}
+}
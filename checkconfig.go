@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Keys each row of a block may set, lmirror also takes <label>_<param> for its stages
+var _CONFIG_KEYS = map[string][]string{
+	_CONFIG_PARAM_ROW: {"hostname", "user", "passwd", "destination", "mode", "debug", "tz", "server_tz",
+		"dest_file_check", "skip_dirRfile_time_staler_than_days", "skip_file_time_staler_than_days",
+		"skip_dir_name_staler_than_days", "thread_no", "poll_time", "list_internal_read_timeout", "stall_duration",
+		"log_file_stale_duration", "slow_transfer_kbps", "backfill_kbps", "net_timeout", "cmd_timeout",
+		"post_retries", "post_retry_backoff", "start_dir", "skip_patterns", "passwd_file", "passwd_env", "passwd_cmd",
+		"passwd_store"},
+	_CONFIG_DISTRIBUTION_ROW:   {"method"},
+	_CONFIG_DOWNLOAD_CHECK_ROW: {"app"},
+	_CONFIG_POST_DOWNLOAD_ROW:  {"app"},
+	_CONFIG_PROXY_ROW:          {"useProxy", "hostname"},
+	_CONFIG_SCHEDULER_ROW:      {"start_time", "end_time", "warn_time", "warn_cmd"},
+	_CONFIG_ALERT_ROW:          {"recipient", "body", "subject"},
+	_CONFIG_LMIRROR_ROW:        {"plugins"},
+}
+
+// config_problem is a diagnostic of --Checkconfig
+type config_problem struct {
+	File  string
+	Line  int
+	Block string
+	Fatal bool
+	Msg   string
+}
+
+func (p config_problem) String() string {
+	level := "warning"
+	if p.Fatal {
+		level = "error"
+	}
+	if p.Block == "" {
+		return fmt.Sprintf("%s:%d: %s: %s", p.File, p.Line, level, p.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s: %s", p.File, p.Line, p.Block, level, p.Msg)
+}
+
+type config_checker struct {
+	problems []config_problem
+}
+
+func (cc *config_checker) errorf(blk *cfg_block, pos cfg_pos, format string, args ...interface{}) {
+	cc.add(blk, pos, true, fmt.Sprintf(format, args...))
+}
+
+func (cc *config_checker) warnf(blk *cfg_block, pos cfg_pos, format string, args ...interface{}) {
+	cc.add(blk, pos, false, fmt.Sprintf(format, args...))
+}
+
+func (cc *config_checker) add(blk *cfg_block, pos cfg_pos, fatal bool, msg string) {
+	p := config_problem{File: pos.File, Line: pos.Line, Fatal: fatal, Msg: msg}
+	if blk != nil {
+		p.Block = blk.label()
+	}
+	cc.problems = append(cc.problems, p)
+}
+
+func edit_distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func did_you_mean(name string, known []string) string {
+	best, best_dist := "", 3
+	for _, k := range known {
+		if d := edit_distance(strings.ToLower(name), strings.ToLower(k)); d < best_dist {
+			best, best_dist = k, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return ", did you mean " + best + "?"
+}
+
+func (cc *config_checker) check_keys(blk *cfg_block) {
+	/*
+	 Reports unknown rows and keys, which qcfg ignores, and keys set twice
+	 in the same section
+	 */
+	labels := make([]string, 0)
+	if e := blk.find(_CONFIG_LMIRROR_ROW, "plugins"); e != nil {
+		for _, spec := range strings.Split(e.Value, ",") {
+			spec = strings.TrimSpace(spec)
+			if idx := strings.Index(spec, "/"); idx != -1 {
+				spec = spec[idx+1:]
+			}
+			if spec != "" {
+				labels = append(labels, spec)
+			}
+		}
+	}
+	rows := make([]string, 0)
+	for row := range _CONFIG_KEYS {
+		rows = append(rows, row)
+	}
+	seen := make(map[string]cfg_pos)
+	for _, e := range blk.Entries {
+		keys, ok := _CONFIG_KEYS[e.Row]
+		if !ok {
+			cc.errorf(blk, e.Pos, "unknown row %s%s", e.Row, did_you_mean(e.Row, rows))
+			continue
+		}
+		known := false
+		for _, k := range keys {
+			known = known || k == e.Key
+		}
+		candidates := keys
+		if e.Row == _CONFIG_LMIRROR_ROW && known == false {
+			// A stage parameter, given to every stage or as <label>_<param> to one
+			prefixes := append([]string{""}, labels...)
+			candidates = append([]string{}, keys...)
+			for _, label := range prefixes {
+				if label != "" {
+					label += "_"
+				}
+				if _, ok := _LMIRROR_STAGE_PARAMS[strings.TrimPrefix(e.Key, label)]; ok && strings.HasPrefix(e.Key, label) {
+					known = true
+				}
+				for k := range _LMIRROR_STAGE_PARAMS {
+					candidates = append(candidates, label+k)
+				}
+			}
+		}
+		if known == false {
+			cc.errorf(blk, e.Pos, "unknown key %s in row %s, it is ignored%s", e.Key, e.Row, did_you_mean(e.Key, candidates))
+			continue
+		}
+		if pos, ok := seen[e.Row+"::"+e.Key]; ok {
+			cc.warnf(blk, e.Pos, "%s :: %s= also set at %s", e.Row, e.Key, pos)
+		}
+		seen[e.Row+"::"+e.Key] = e.Pos
+	}
+}
+
+func check_writable(dir string) error {
+	/*
+	 Checks that dir, or the nearest existing dir above it where it would
+	 be made, is a directory this process can write to
+	 */
+	for p := path.Clean(dir); ; p = path.Dir(p) {
+		fi, err := os.Stat(p)
+		if err == nil {
+			if fi.IsDir() == false {
+				return errors.New(p + " is not a directory")
+			}
+			// 2 is W_OK
+			if syscall.Access(p, 2) != nil {
+				return errors.New(p + " is not writable")
+			}
+			return nil
+		}
+		if os.IsNotExist(err) == false {
+			return err
+		}
+		if p == "/" || p == "." {
+			return nil
+		}
+	}
+}
+
+// template_dir returns the dir part of a path template before its first placeholder
+func template_dir(tmpl string) string {
+	if idx := strings.Index(tmpl, "__"); idx != -1 {
+		tmpl = tmpl[:idx]
+	}
+	if strings.HasSuffix(tmpl, "/") == false {
+		tmpl = path.Dir(tmpl)
+	}
+	return tmpl
+}
+
+func (cc *config_checker) check_block(fw *FTPWatcher, blk *cfg_block, watch_data map[string]interface{}) {
+	/*
+	 Reports what load_block_config found wrong with the values of a
+	 block, and checks the dirs, plugins and files they name
+	 */
+	cfg := block_config(watch_data)
+	for _, cerr := range watch_data["config_errors"].([]config_error) {
+		line := blk.line(cerr.Row, cerr.Key)
+		report := cc.errorf
+		if cerr.Fatal == false {
+			report = cc.warnf
+		}
+		if cerr.Msg == "missing" {
+			report(blk, line, "missing %s :: %s=", cerr.Row, cerr.Key)
+		} else {
+			report(blk, line, "%s= : %s", cerr.Key, cerr.Msg)
+		}
+	}
+	if e := blk.find(_CONFIG_PARAM_ROW, "dest_file_check"); e != nil && e.Value != "true" && e.Value != "false" {
+		cc.warnf(blk, e.Pos, "dest_file_check=%s is taken as false, only true turns it on", e.Value)
+	}
+	if cfg.UseProxy && blk.find(_CONFIG_PROXY_ROW, "hostname") == nil {
+		cc.warnf(blk, blk.line(_CONFIG_PROXY_ROW, "useProxy"), "useProxy=1 without hostname=, %s would be used", cfg.ProxyHost)
+	}
+	if dest := cfg.Dest; dest != "" {
+		if err := check_writable(dest); err != nil {
+			cc.errorf(blk, blk.line(_CONFIG_PARAM_ROW, "destination"), "destination=%s : %v", dest, err)
+		}
+	}
+	if err := check_writable(cfg.LogDir); err != nil {
+		cc.errorf(blk, blk.Pos, "log dir %s : %v", cfg.LogDir, err)
+	}
+	plugins_line := blk.line(_CONFIG_LMIRROR_ROW, "plugins")
+	for _, stage := range cfg.Stages {
+		line := func(param string) cfg_pos {
+			if e := blk.find(_CONFIG_LMIRROR_ROW, stage.Label+"_"+param); e != nil {
+				return e.Pos
+			}
+			return blk.line(_CONFIG_LMIRROR_ROW, param)
+		}
+		if err := fw.check_lmirror_stage(stage); err != nil {
+			cc.errorf(blk, plugins_line, "%v, the block would not start", err)
+			continue
+		}
+		if _, err := time.ParseDuration(stage.Params["plugin_timeout"]); err != nil {
+			cc.warnf(blk, line("plugin_timeout"), "plugin_timeout=%s of %s is not a duration, %s would be used",
+				stage.Params["plugin_timeout"], stage.Label, _DEFAULT_PLUGIN_TIMEOUT)
+		}
+		for _, param := range []string{"lmirror_path_format", "extract_dir"} {
+			if tmpl := stage.Params[param]; tmpl != "" {
+				if err := check_writable(template_dir(tmpl)); err != nil {
+					cc.errorf(blk, line(param), "%s of %s : %v", param, stage.Label, err)
+				}
+			}
+		}
+		for _, param := range []string{"decrypt_keyring", "decrypt_passphrase_file"} {
+			if file := stage.Params[param]; file != "" && stage.Plugin == "decrypt" {
+				if fp, err := os.Open(file); err != nil {
+					cc.errorf(blk, line(param), "%s of %s : %v", param, stage.Label, err)
+				} else {
+					fp.Close()
+				}
+			}
+		}
+	}
+}
+
+func check_config(configFile string) []config_problem {
+	/*
+	 Checks every block of configFile, with its includes, defaults and
+	 templates, and returns what is wrong with it sorted by file and line
+	 */
+	cc := new(config_checker)
+	cf := read_cfg(configFile)
+	cc.problems = append(cc.problems, cf.errors...)
+	cc.problems = append(cc.problems, cf.problems...)
+	if len(cf.blocks) == 0 && len(cf.errors) == 0 {
+		cc.errorf(nil, cfg_pos{File: configFile}, "no %%block in the cfg file")
+	}
+	for _, sec := range cf.sections {
+		cc.check_keys(sec)
+	}
+	if len(cf.errors) == 0 {
+		fw := new(FTPWatcher)
+		fw._command_separator = "^"
+		fw.lmirror_plugins = make(map[string]LmirrorPlugin)
+		fw.register_builtin_plugins()
+		for idx, watch_data := range cf.watchlist() {
+			cc.check_block(fw, cf.blocks[idx], watch_data)
+		}
+	}
+	sort.SliceStable(cc.problems, func(i, j int) bool {
+		if cc.problems[i].File != cc.problems[j].File {
+			return cc.problems[i].File < cc.problems[j].File
+		}
+		return cc.problems[i].Line < cc.problems[j].Line
+	})
+	return cc.problems
+}
+
+func CheckConfig(configFile string) int {
+	/*
+	 Entry point of --Checkconfig. Returns the exit status : 0 if the cfg
+	 file has no errors, warnings aside, 1 if it has some
+	 */
+	errs, warnings := 0, 0
+	for _, p := range check_config(configFile) {
+		fmt.Println(p)
+		if p.Fatal {
+			errs++
+		} else {
+			warnings++
+		}
+	}
+	fmt.Printf("%s : %d errors, %d warnings\n", configFile, errs, warnings)
+	if errs > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+	"github.com/LDCS/goftp"
+)
+
+// Block states reported through the CIM "status" command
+const (
+	_STATE_IDLE        = "idle"
+	_STATE_LISTING     = "listing"
+	_STATE_DOWNLOADING = "downloading"
+	_STATE_SLEEPING    = "sleeping"
+	_STATE_PAUSED      = "paused"
+)
+
+// block_state is the runtime control state of a single watcher block.
+// It is shared between the watcher goroutine and the CIM callbacks.
+type block_state struct {
+	mu        sync.Mutex
+	state     string
+	file      string
+	until     time.Time
+	since     time.Time
+	paused    bool
+	cancelled bool
+	transfer  io.Closer
+	conn      *ftp.ServerConn
+	trigger   chan bool
+	resume    chan bool
+	// Progress counters for the watchdog
+	heartbeat       time.Time
+	transfer_bytes  int64
+	total_bytes     int64
+	last_listing    time.Time
+	last_listing_at string
+	restarts        int
+	wd_bytes        int64
+	wd_time         time.Time
+	slow_reported   string
+	period_changes  []PeriodChange
+	// Outcome counters, summarised by --Once
+	downloaded    int
+	failures      int
+	last_failures []string
+	// Alerts already sent, so that retries of the same file do not repeat them
+	alerted map[string]bool
+}
+
+// BlockStatus is the JSON view of a block_state
+type BlockStatus struct {
+	Block         string
+	State         string
+	File          string `json:",omitempty"`
+	Until         string `json:",omitempty"`
+	Since         string
+	Paused        bool
+	Heartbeat     string
+	TransferBytes int64
+	TotalBytes    int64
+	LastListing   string `json:",omitempty"`
+	LastListingAt string `json:",omitempty"`
+	Restarts      int
+	PeriodChanges []PeriodChange `json:",omitempty"`
+	Downloaded    int
+	Failures      int
+	LastFailures  []string `json:",omitempty"`
+}
+
+func new_block_state() *block_state {
+	bs := new(block_state)
+	bs.state = _STATE_IDLE
+	bs.since = time.Now()
+	bs.heartbeat = bs.since
+	bs.trigger = make(chan bool, 1)
+	bs.resume = make(chan bool, 1)
+	return bs
+}
+
+func (fw *FTPWatcher) _block_state(watch_data map[string]interface{}) *block_state {
+	return block_rt(watch_data).state
+}
+
+func (bs *block_state) set(state, file string, until time.Time) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.state = state
+	bs.file = file
+	bs.until = until
+	bs.since = time.Now()
+	bs.heartbeat = bs.since
+}
+
+func (bs *block_state) is_paused() bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.paused
+}
+
+func (bs *block_state) status(blockname string) BlockStatus {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	st := BlockStatus{Block: blockname, State: bs.state, File: bs.file, Paused: bs.paused}
+	st.Since = bs.since.Format("20060102 15:04:05")
+	if bs.until.IsZero() == false {
+		st.Until = bs.until.Format("20060102 15:04:05")
+	}
+	st.Heartbeat = bs.heartbeat.Format("20060102 15:04:05")
+	st.TransferBytes = bs.transfer_bytes
+	st.TotalBytes = bs.total_bytes
+	if bs.last_listing.IsZero() == false {
+		st.LastListing = bs.last_listing.Format("20060102 15:04:05")
+		st.LastListingAt = bs.last_listing_at
+	}
+	st.Restarts = bs.restarts
+	st.PeriodChanges = append([]PeriodChange{}, bs.period_changes...)
+	st.Downloaded = bs.downloaded
+	st.Failures = bs.failures
+	st.LastFailures = append([]string{}, bs.last_failures...)
+	return st
+}
+
+// first_alert returns true the first time it is called with key
+func (bs *block_state) first_alert(key string) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.alerted == nil {
+		bs.alerted = make(map[string]bool)
+	}
+	if bs.alerted[key] {
+		return false
+	}
+	bs.alerted[key] = true
+	return true
+}
+
+func (bs *block_state) do_trigger() {
+	select {
+	case bs.trigger <- true:
+	default:
+		// A trigger is already pending
+	}
+}
+
+func (bs *block_state) do_pause() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.paused = true
+}
+
+func (bs *block_state) do_resume() {
+	bs.mu.Lock()
+	bs.paused = false
+	bs.mu.Unlock()
+	select {
+	case bs.resume <- true:
+	default:
+	}
+}
+
+// start_transfer remembers the remote reader so that an in-flight transfer can be cancelled
+func (bs *block_state) start_transfer(rc io.Closer) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.transfer = rc
+	bs.transfer_bytes = 0
+	bs.heartbeat = time.Now()
+}
+
+func (bs *block_state) end_transfer() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.transfer = nil
+}
+
+func (bs *block_state) set_conn(conn *ftp.ServerConn) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.conn = conn
+}
+
+// abort_network closes the transfer and control connection in use, so that
+// a goroutine blocked on them returns with an error
+func (bs *block_state) abort_network() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.transfer != nil {
+		bs.transfer.Close()
+	}
+	if bs.conn != nil {
+		bs.conn.Quit()
+		bs.conn = nil
+	}
+}
+
+func (bs *block_state) clear_cancel() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.cancelled = false
+}
+
+func (bs *block_state) transfer_cancelled() bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.cancelled
+}
+
+// do_cancel closes the remote reader of the in-flight transfer, returns false if there is none
+func (bs *block_state) do_cancel() bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.transfer == nil {
+		return false
+	}
+	bs.cancelled = true
+	bs.transfer.Close()
+	return true
+}
+
+func (fw *FTPWatcher) sleep_or_trigger(ctx context.Context, watch_data map[string]interface{}, sleep_duration time.Duration) bool {
+	/*
+	 Sleeps for sleep_duration, returns true if woken up early by a trigger
+	 */
+	bs := fw._block_state(watch_data)
+	bs.set(_STATE_SLEEPING, "", time.Now().Add(sleep_duration))
+	defer bs.set(_STATE_IDLE, "", time.Time{})
+	select {
+	case <-bs.trigger:
+		block_rt(watch_data).logger.Println("Woken up by a trigger")
+		return true
+	case <-ctx.Done():
+	case <-time.After(sleep_duration):
+	}
+	return false
+}
+
+func (fw *FTPWatcher) wait_if_paused(ctx context.Context, watch_data map[string]interface{}) {
+	/*
+	 Blocks for as long as the block is paused
+	 */
+	bs := fw._block_state(watch_data)
+	if bs.is_paused() == false {
+		return
+	}
+	block_rt(watch_data).logger.Println("Block is paused, waiting for resume")
+	bs.set(_STATE_PAUSED, "", time.Time{})
+	for bs.is_paused() && ctx.Err() == nil {
+		select {
+		case <-bs.resume:
+		case <-ctx.Done():
+		case <-time.After(time.Minute):
+		}
+	}
+	bs.set(_STATE_IDLE, "", time.Time{})
+	block_rt(watch_data).logger.Println("Block resumed")
+}
+
+func (fw *FTPWatcher) find_watcher(blockname string) map[string]interface{} {
+	for _, watch_data := range fw.get_watchers() {
+		if block_config(watch_data).Name == blockname {
+			return watch_data
+		}
+	}
+	return nil
+}
+
+func control_block(data interface{}, cmd string, args ...string) string {
+	/*
+	 CIM callback for the block control commands trigger, pause, resume and cancel
+	 */
+	fw := data.(*FTPWatcher)
+	if len(args) < 1 {
+		return "No block name provided!"
+	}
+	out := ""
+	for _, blockname := range args {
+		watch_data := fw.find_watcher(blockname)
+		if watch_data == nil {
+			out += "No block called " + blockname + "\n"
+			continue
+		}
+		bs := fw._block_state(watch_data)
+		switch cmd {
+		case "trigger":
+			bs.do_trigger()
+			out += "Triggered a pass for " + blockname + "\n"
+		case "pause":
+			bs.do_pause()
+			out += "Paused " + blockname + "\n"
+		case "resume":
+			bs.do_resume()
+			out += "Resumed " + blockname + "\n"
+		case "cancel":
+			if bs.do_cancel() == false {
+				out += "No transfer in progress for " + blockname + "\n"
+				continue
+			}
+			out += "Cancelled the transfer in progress for " + blockname + "\n"
+		default:
+			return ""
+		}
+		block_rt(watch_data).logger.Printf("CIM command %s\n", cmd)
+	}
+	return out
+}
+
+func show_status(data interface{}, cmd string, args ...string) string {
+	/*
+	 CIM callback listing the current state of all or the given blocks
+	 */
+	fw := data.(*FTPWatcher)
+	if cmd != "status" {
+		return ""
+	}
+	blocks := args
+	if len(blocks) == 0 {
+		for _, watch_data := range fw.get_watchers() {
+			blocks = append(blocks, block_config(watch_data).Name)
+		}
+		sort.Strings(blocks)
+	}
+	statuses := make([]BlockStatus, 0)
+	for _, blockname := range blocks {
+		watch_data := fw.find_watcher(blockname)
+		if watch_data == nil {
+			return fmt.Sprintf("No block called %s", blockname)
+		}
+		statuses = append(statuses, fw._block_state(watch_data).status(blockname))
+	}
+	out, _ := json.MarshalIndent(statuses, "", "    ")
+	return string(out)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// test_watcher returns a watcher with blocks of the given names, not running
+func test_watcher(names ...string) *FTPWatcher {
+	fw := new(FTPWatcher)
+	fw.ctx, fw.cancel = context.WithCancel(context.Background())
+	for _, name := range names {
+		rt := &block_runtime{logger: log.New(ioutil.Discard, "", 0), state: new_block_state()}
+		fw.watchers = append(fw.watchers, map[string]interface{}{"config": &BlockConfig{Name: name}, "runtime": rt})
+	}
+	return fw
+}
+
+// test_closer counts its Close calls
+type test_closer struct {
+	closed int
+}
+
+func (tc *test_closer) Close() error {
+	tc.closed++
+	return nil
+}
+
+func TestControlBlock(t *testing.T) {
+	tests := []struct {
+		cmd     string
+		args    []string
+		out     string
+		paused  bool
+		trigger bool
+	}{
+		{"trigger", []string{"a"}, "Triggered a pass for a\n", false, true},
+		{"trigger", []string{"a", "nosuch"}, "Triggered a pass for a\nNo block called nosuch\n", false, true},
+		{"pause", []string{"a"}, "Paused a\n", true, false},
+		{"resume", []string{"a"}, "Resumed a\n", false, false},
+		{"cancel", []string{"a"}, "No transfer in progress for a\n", false, false},
+		{"trigger", nil, "No block name provided!", false, false},
+		{"bogus", []string{"a"}, "", false, false},
+	}
+	for _, tt := range tests {
+		fw := test_watcher("a", "b")
+		if out := control_block(fw, tt.cmd, tt.args...); out != tt.out {
+			t.Errorf("%s %v = %q, want %q", tt.cmd, tt.args, out, tt.out)
+		}
+		bs := fw._block_state(fw.find_watcher("a"))
+		if bs.is_paused() != tt.paused {
+			t.Errorf("%s %v : paused %v, want %v", tt.cmd, tt.args, bs.is_paused(), tt.paused)
+		}
+		if pending := len(bs.trigger) > 0; pending != tt.trigger {
+			t.Errorf("%s %v : trigger pending %v, want %v", tt.cmd, tt.args, pending, tt.trigger)
+		}
+		if other := fw._block_state(fw.find_watcher("b")); other.is_paused() || len(other.trigger) > 0 {
+			t.Errorf("%s %v : touched block b", tt.cmd, tt.args)
+		}
+	}
+
+	// A second trigger while one is pending does not block
+	fw := test_watcher("a")
+	control_block(fw, "trigger", "a", "a")
+	if len(fw._block_state(fw.find_watcher("a")).trigger) != 1 {
+		t.Errorf("two triggers should leave one pending")
+	}
+}
+
+func TestShowStatus(t *testing.T) {
+	fw := test_watcher("b", "a")
+	fw._block_state(fw.find_watcher("b")).set(_STATE_DOWNLOADING, "x.csv", time.Time{})
+	tests := []struct {
+		cmd    string
+		args   []string
+		blocks []string // nil if the output is not JSON
+		out    string
+	}{
+		{"status", nil, []string{"a", "b"}, ""},
+		{"status", []string{"b"}, []string{"b"}, ""},
+		{"status", []string{"nosuch"}, nil, "No block called nosuch"},
+		{"bogus", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		out := show_status(fw, tt.cmd, tt.args...)
+		if tt.blocks == nil {
+			if out != tt.out {
+				t.Errorf("%s %v = %q, want %q", tt.cmd, tt.args, out, tt.out)
+			}
+			continue
+		}
+		statuses := make([]BlockStatus, 0)
+		if err := json.Unmarshal([]byte(out), &statuses); err != nil {
+			t.Errorf("%s %v : %v in %q", tt.cmd, tt.args, err, out)
+			continue
+		}
+		blocks := make([]string, 0)
+		for _, st := range statuses {
+			blocks = append(blocks, st.Block)
+			want := _STATE_IDLE
+			if st.Block == "b" {
+				want = _STATE_DOWNLOADING
+			}
+			if st.State != want {
+				t.Errorf("%s %v : block %s is %s, want %s", tt.cmd, tt.args, st.Block, st.State, want)
+			}
+		}
+		if reflect.DeepEqual(blocks, tt.blocks) == false {
+			t.Errorf("%s %v : blocks %v, want %v", tt.cmd, tt.args, blocks, tt.blocks)
+		}
+	}
+}
+
+func TestDoCancel(t *testing.T) {
+	bs := new_block_state()
+	if bs.do_cancel() || bs.transfer_cancelled() {
+		t.Errorf("cancel without a transfer should do nothing")
+	}
+	tc := &test_closer{}
+	bs.start_transfer(tc)
+	if bs.do_cancel() == false || bs.transfer_cancelled() == false || tc.closed != 1 {
+		t.Errorf("cancel of a transfer : cancelled %v, closed %d times", bs.transfer_cancelled(), tc.closed)
+	}
+	bs.end_transfer()
+	bs.clear_cancel()
+	if bs.do_cancel() || bs.transfer_cancelled() || tc.closed != 1 {
+		t.Errorf("cancel after the transfer ended : cancelled %v, closed %d times", bs.transfer_cancelled(), tc.closed)
+	}
+
+	// Through the CIM command
+	fw := test_watcher("a")
+	fw._block_state(fw.find_watcher("a")).start_transfer(tc)
+	if out := control_block(fw, "cancel", "a"); out != "Cancelled the transfer in progress for a\n" || tc.closed != 2 {
+		t.Errorf("cancel = %q, closed %d times", out, tc.closed)
+	}
+}
+
+func TestSleepOrTrigger(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		trigger bool
+		sleep   time.Duration
+		want    bool
+	}{
+		{"trigger pending", context.Background(), true, time.Hour, true},
+		{"slept", context.Background(), false, time.Millisecond, false},
+		{"cancelled", cancelled, false, time.Hour, false},
+	}
+	for _, tt := range tests {
+		fw := test_watcher("a")
+		watch_data := fw.find_watcher("a")
+		bs := fw._block_state(watch_data)
+		if tt.trigger {
+			bs.do_trigger()
+		}
+		if got := fw.sleep_or_trigger(tt.ctx, watch_data, tt.sleep); got != tt.want {
+			t.Errorf("%s : woken %v, want %v", tt.name, got, tt.want)
+		}
+		if st := bs.status("a"); st.State != _STATE_IDLE || st.Until != "" {
+			t.Errorf("%s : left %s until %q, want idle", tt.name, st.State, st.Until)
+		}
+	}
+
+	// Sleeping shows in the status until a trigger wakes it
+	fw := test_watcher("a")
+	watch_data := fw.find_watcher("a")
+	woken := make(chan bool)
+	go func() {
+		woken <- fw.sleep_or_trigger(context.Background(), watch_data, time.Hour)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for fw._block_state(watch_data).status("a").State != _STATE_SLEEPING && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if st := fw._block_state(watch_data).status("a"); st.State != _STATE_SLEEPING || st.Until == "" {
+		t.Errorf("sleeping block is %s until %q", st.State, st.Until)
+	}
+	control_block(fw, "trigger", "a")
+	if <-woken == false {
+		t.Errorf("trigger did not wake the sleeping block")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Start of a credentials store file, also authenticated with its content
+const _CREDSTORE_HEADER = "ftpwatcher-credentials-1\n"
+const _CREDSTORE_FILE = "credentials.store"
+
+// credential is an entry of the credentials store
+type credential struct {
+	Secret  string
+	Created string
+	Rotated string `json:",omitempty"`
+}
+
+// credential_store is the encrypted store of the passwords named by passwd_store=
+type credential_store struct {
+	file    string
+	key     []byte
+	entries map[string]*credential
+}
+
+func credstore_file() string {
+	if opt.Credstore != "" {
+		return opt.Credstore
+	}
+	return path.Join(opt.Logbasedir, _CREDSTORE_FILE)
+}
+
+func read_key_file(key_file string) ([]byte, error) {
+	/*
+	 Reads the key unlocking the store, 32 bytes written as 64 hex digits.
+	 The file must not be readable by group or others.
+	 */
+	if key_file == "" {
+		return nil, errors.New("No key file, give it with --Credkey")
+	}
+	fi, err := os.Stat(key_file)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&077 != 0 {
+		return nil, fmt.Errorf("Key file %s is accessible by group or others, chmod 600 it", key_file)
+	}
+	buf, err := ioutil.ReadFile(key_file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Key file %s does not hold 64 hex digits", key_file)
+	}
+	return key, nil
+}
+
+func open_credential_store(file, key_file string) (*credential_store, error) {
+	/*
+	 Reads and decrypts the store, an empty one if file does not exist yet
+	 */
+	key, err := read_key_file(key_file)
+	if err != nil {
+		return nil, err
+	}
+	cs := &credential_store{file: file, key: key, entries: make(map[string]*credential)}
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return cs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	gcm, err := cs.cipher()
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(string(buf), _CREDSTORE_HEADER) == false || len(buf) < len(_CREDSTORE_HEADER)+gcm.NonceSize() {
+		return nil, errors.New(file + " is not a credentials store")
+	}
+	buf = buf[len(_CREDSTORE_HEADER):]
+	plain, err := gcm.Open(nil, buf[:gcm.NonceSize()], buf[gcm.NonceSize():], []byte(_CREDSTORE_HEADER))
+	if err != nil {
+		return nil, errors.New("Cannot decrypt " + file + ", wrong key file or damaged store")
+	}
+	if err := json.Unmarshal(plain, &cs.entries); err != nil {
+		return nil, fmt.Errorf("%s : %v", file, err)
+	}
+	return cs, nil
+}
+
+func (cs *credential_store) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(cs.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (cs *credential_store) get(name string) (string, error) {
+	entry, ok := cs.entries[name]
+	if !ok {
+		return "", fmt.Errorf("No entry %s in %s", name, cs.file)
+	}
+	return entry.Secret, nil
+}
+
+func (cs *credential_store) save() error {
+	/*
+	 Encrypts the store under a fresh nonce and replaces the file with it
+	 */
+	gcm, err := cs.cipher()
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(cs.entries)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	out := append([]byte(_CREDSTORE_HEADER), nonce...)
+	out = gcm.Seal(out, nonce, plain, []byte(_CREDSTORE_HEADER))
+	tmp := cs.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, out, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cs.file)
+}
+
+func read_secret(in io.Reader) (string, error) {
+	/*
+	 Reads a secret from the first line of in
+	 */
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("Empty secret on stdin")
+	}
+	return line, nil
+}
+
+func new_key_file(key_file string) error {
+	/*
+	 Writes a new random key to key_file, which must not exist yet
+	 */
+	if key_file == "" {
+		return errors.New("No key file, give it with --Credkey")
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(key_file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fp.WriteString(hex.EncodeToString(key) + "\n")
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func Credentials(cmd string) int {
+	/*
+	 Entry point of --Creds, managing the store given by --Credstore with
+	 the key file given by --Credkey :
+	   newkey   writes a new key file
+	   add      adds the entry --Entry, its secret read from stdin
+	   rotate   replaces the secret of the entry --Entry, read from stdin
+	   list     lists the entries with when they were added and rotated
+	 Secrets are never printed. Returns the exit status : 0 on success,
+	 1 on failure, 2 on bad arguments
+	 */
+	if cmd == "newkey" {
+		if err := new_key_file(opt.Credkey); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println("Wrote a new key to", opt.Credkey)
+		return 0
+	}
+	if cmd != "add" && cmd != "rotate" && cmd != "list" {
+		fmt.Println("--Creds takes newkey, add, rotate or list, not", cmd)
+		return 2
+	}
+	cs, err := open_credential_store(credstore_file(), opt.Credkey)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if cmd == "list" {
+		names := make([]string, 0)
+		for name := range cs.entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			entry := cs.entries[name]
+			rotated := entry.Rotated
+			if rotated == "" {
+				rotated = "never"
+			}
+			fmt.Printf("%s : added %s, rotated %s\n", name, entry.Created, rotated)
+		}
+		fmt.Printf("%s : %d entries\n", cs.file, len(names))
+		return 0
+	}
+	if opt.Entry == "" {
+		fmt.Println("--Creds", cmd, "needs --Entry")
+		return 2
+	}
+	entry, exists := cs.entries[opt.Entry]
+	if cmd == "add" && exists {
+		fmt.Println("Entry", opt.Entry, "already exists, use --Creds rotate to change it")
+		return 1
+	} else if cmd == "rotate" && exists == false {
+		fmt.Println("No entry", opt.Entry, "in", cs.file)
+		return 1
+	}
+	secret, err := read_secret(os.Stdin)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	now := time.Now().Format("20060102 15:04:05")
+	if cmd == "add" {
+		cs.entries[opt.Entry] = &credential{Secret: secret, Created: now}
+	} else {
+		entry.Secret, entry.Rotated = secret, now
+	}
+	if err := cs.save(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("%s entry %s in %s\n", map[string]string{"add": "Added", "rotate": "Rotated"}[cmd], opt.Entry, cs.file)
+	return 0
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"time"
+)
+
+func (fw *FTPWatcher) net_timeout(watch_data map[string]interface{}) time.Duration {
+	if d := block_config(watch_data).NetTimeout; d > 0 {
+		return d
+	}
+	return 5 * time.Minute
+}
+
+func (fw *FTPWatcher) net_deadline(watch_data map[string]interface{}, what string) *time.Timer {
+	/*
+	 Puts a deadline on a network operation. If the returned timer is not
+	 stopped in time, the connection is closed so that the operation fails
+	 instead of hanging. Reset the timer to extend the deadline. The timer
+	 fires on its own goroutine, so it does not touch watch_data.
+	 */
+	rt := block_rt(watch_data)
+	timeout := fw.net_timeout(watch_data)
+	return time.AfterFunc(timeout, func() {
+		rt.logger.Println("Deadline of", timeout, "exceeded for", what, "- closing the connection")
+		rt.state.abort_network()
+	})
+}
+
+func (fw *FTPWatcher) kill_watcher(watch_data map[string]interface{}, timeout time.Duration) bool {
+	/*
+	 Cancels the watcher goroutine of a block, unblocks any network
+	 operation it is stuck in and waits up to timeout for it to exit
+	 */
+	rt := block_rt(watch_data)
+	wh := rt.get_watcher()
+	if wh == nil {
+		return true
+	}
+	wh.cancel()
+	rt.state.abort_network()
+	return wait_with_timeout(func() { <-wh.done }, timeout)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Suffixes of the files the decrypt plugin decrypts, stripped from the plaintext name
+var _DECRYPT_SUFFIXES = []string{".pgp", ".gpg", ".asc"}
+
+func read_keyring(keyring string) (openpgp.EntityList, error) {
+	buf, err := ioutil.ReadFile(keyring)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(buf), []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(buf))
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(buf))
+}
+
+func decrypt_passphrase(lctx *LmirrorContext) ([]byte, error) {
+	/*
+	 Returns the passphrase from decrypt_passphrase_file or decrypt_passphrase_env,
+	 blank if neither is set
+	 */
+	if lctx.Params["decrypt_passphrase_file"] != "" {
+		buf, err := ioutil.ReadFile(lctx.Params["decrypt_passphrase_file"])
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(buf, "\r\n"), nil
+	}
+	if lctx.Params["decrypt_passphrase_env"] != "" {
+		return []byte(os.Getenv(lctx.Params["decrypt_passphrase_env"])), nil
+	}
+	return nil, nil
+}
+
+func decrypt_file(lctx *LmirrorContext, infile, outfile string) error {
+	/*
+	 Decrypts infile into outfile and checks the signature if there is one
+	 */
+	keyring, err := read_keyring(lctx.Params["decrypt_keyring"])
+	if err != nil {
+		return errors.New("Cannot read keyring " + lctx.Params["decrypt_keyring"] + " : " + err.Error())
+	}
+	fp, err := os.Open(infile)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var r io.Reader = bufio.NewReader(fp)
+	if head, _ := r.(*bufio.Reader).Peek(10); bytes.Equal(head, []byte("-----BEGIN")) {
+		block, err := armor.Decode(r)
+		if err != nil {
+			return err
+		}
+		r = block.Body
+	}
+	prompted := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted {
+			return nil, errors.New("No key could be unlocked with the passphrase")
+		}
+		prompted = true
+		pass, err := decrypt_passphrase(lctx)
+		if err != nil {
+			return nil, err
+		}
+		if symmetric {
+			return pass, nil
+		}
+		for _, k := range keys {
+			if k.PrivateKey != nil && k.PrivateKey.Encrypted {
+				k.PrivateKey.Decrypt(pass)
+			}
+		}
+		return nil, nil
+	}
+	md, err := openpgp.ReadMessage(r, keyring, prompt, nil)
+	if err != nil {
+		return err
+	}
+	// The plaintext is readable by the daemon's user only, a leftover temp file is
+	// removed first as O_CREATE would keep its mode
+	tmp := outfile + "@"
+	os.Remove(tmp)
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, md.UnverifiedBody)
+	out.Close()
+	// The signature is only checked once the body has been read to the end
+	if err == nil && md.IsSigned {
+		if md.SignedBy == nil {
+			err = fmt.Errorf("Signed by unknown key %X", md.SignedByKeyId)
+		} else if md.SignatureError != nil {
+			err = errors.New("Bad signature : " + md.SignatureError.Error())
+		}
+	}
+	if err == nil && md.IsSigned == false && lctx.Params["decrypt_require_signature"] == "1" {
+		err = errors.New("Not signed")
+	}
+	if err == nil {
+		err = os.Rename(tmp, outfile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if md.IsSigned {
+		lctx.Logger.Printf("decrypt plugin : good signature on %s by key %X\n", infile, md.SignedByKeyId)
+	}
+	return nil
+}
+
+func alert_decrypt_failed(remote_path string) {
+	kvpl := fmt.Sprintf("subtab=ftpwatcher;level=critical;subject=%s decrypt failed for %s;escalate=ops;escalate-minutes1=5;escalate-minutes2=15", short_hostname(), remote_path)
+	doAlert(kvpl)
+}
+
+func lmirror_plugin_decrypt(fw *FTPWatcher, lctx *LmirrorContext) ([]string, error) {
+	/*
+	 Decrypts .pgp, .gpg and .asc files with decrypt_keyring and passes the
+	 plaintext on without the suffix. Other files are passed on unchanged.
+	 On a failure the download is kept, as fetching it again would fail
+	 the same way, and left to the post processing retries. An alert is
+	 sent the first time each download fails.
+	 */
+	destfile, infile := lctx.Destfile, lctx.Infile
+	logger := lctx.Logger
+	outfile := ""
+	for _, suffix := range _DECRYPT_SUFFIXES {
+		if strings.HasSuffix(strings.ToLower(infile), suffix) {
+			outfile = infile[:len(infile)-len(suffix)]
+		}
+	}
+	if outfile == "" {
+		logger.Println("decrypt plugin :", infile, "is not encrypted, passing it on")
+		return []string{infile}, nil
+	}
+	fi, err := os.Stat(infile)
+	if err != nil {
+		logger.Println("decrypt plugin error : Cannot stat", infile)
+		return nil, err
+	}
+	modtime := fi.ModTime()
+	is_main := fw.is_lmirror_main(destfile, infile)
+	if err := decrypt_file(lctx, infile, outfile); err != nil {
+		logger.Println("decrypt plugin error :", infile, ":", err, "- keeping it")
+		if lctx.state == nil || lctx.state.first_alert("decrypt "+infile+" "+modtime.Format("20060102 15:04:05")) {
+			alert_decrypt_failed(lctx.RemotePath)
+		}
+		return nil, err
+	}
+	os.Chtimes(outfile, modtime, modtime)
+	if is_main == true {
+		if err := relink_lmirror_main(lctx.Logger, destfile, outfile, modtime); err != nil {
+			logger.Println("decrypt plugin error : Cannot create link", destfile, "->", outfile)
+			return []string{outfile}, err
+		}
+		if infile != destfile {
+			os.Remove(infile)
+		}
+	}
+	return []string{outfile}, nil
+}
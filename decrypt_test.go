@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecryptFailureKeepsFile(t *testing.T) {
+	dir := t.TempDir()
+	alerts := filepath.Join(dir, "alerts")
+	alertcmd := filepath.Join(dir, "alert.sh")
+	if err := ioutil.WriteFile(alertcmd, []byte("#!/bin/sh\necho \"$2\" >> "+alerts+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	saved := opt.Alertcmd
+	opt.Alertcmd = alertcmd
+	defer func() { opt.Alertcmd = saved }()
+
+	destfile := filepath.Join(dir, "f.csv.gpg")
+	if err := ioutil.WriteFile(destfile, []byte("not a pgp message"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lctx := &LmirrorContext{Params: map[string]string{"decrypt_keyring": filepath.Join(dir, "nosuch.asc")},
+		Logger: log.New(ioutil.Discard, "", 0), Destfile: destfile, Infile: destfile, RemotePath: "/f.csv.gpg",
+		state: new_block_state()}
+	fw := new(FTPWatcher)
+	// The first failure and a retry of the same download
+	for attempt := 1; attempt <= 2; attempt++ {
+		if _, err := lmirror_plugin_decrypt(fw, lctx); err == nil {
+			t.Fatalf("attempt %d : decrypted without a keyring", attempt)
+		}
+		if _, err := os.Stat(destfile); err != nil {
+			t.Errorf("attempt %d : the download was removed : %v", attempt, err)
+		}
+	}
+	buf, _ := ioutil.ReadFile(alerts)
+	if lines := strings.Split(strings.TrimSpace(string(buf)), "\n"); len(lines) != 1 || strings.Contains(lines[0], "/f.csv.gpg") == false {
+		t.Errorf("alerts %q, want one for /f.csv.gpg", lines)
+	}
+}
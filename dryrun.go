@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"time"
+)
+
+// dry_run_plan is what a --Dryrun pass of a block found it would do
+type dry_run_plan struct {
+	block     string
+	downloads int
+	bytes     uint64
+	skipped   int
+	local     int
+	errors    int
+}
+
+func (fw *FTPWatcher) _dry_run_plan(watch_data map[string]interface{}) *dry_run_plan {
+	return block_rt(watch_data).dry_run
+}
+
+func (plan *dry_run_plan) note(format string, args ...interface{}) {
+	fmt.Printf("%s : %s\n", plan.block, fmt.Sprintf(format, args...))
+}
+
+func (plan *dry_run_plan) skip(remote_path, reason string) {
+	plan.skipped++
+	plan.note("skip %s : %s", remote_path, reason)
+}
+
+func (fw *FTPWatcher) plan_commands(watch_data map[string]interface{}, plan *dry_run_plan, what, commands string, cv command_vars) {
+	/*
+	 Shows the ^ separated commands as they would be run on cv.File
+	 */
+	for _, command := range fw._split_run_cmd(commands) {
+		args, env, err := expand_command(watch_data, command, cv)
+		if err != nil {
+			plan.errors++
+			plan.note("    %s : %v", what, err)
+			continue
+		}
+		plan.note("    %s : %q", what, append(env, args...))
+	}
+}
+
+func (fw *FTPWatcher) lmirror_plan(watch_data map[string]interface{}, destfile, infile, remote_path string, t1, t2 time.Time) []string {
+	/*
+	 Describes each lmirror stage of the block for infile, with the
+	 lmirror path it would use
+	 */
+	lines := make([]string, 0)
+	for _, stage := range block_config(watch_data).Stages {
+		line := "lmirror stage " + stage.Label
+		if stage.matches(infile) == false {
+			line += " : not matching, passed on"
+		} else if stage.Params["lmirror_path_format"] != "" {
+			lctx := fw.new_lmirror_context(watch_data, stage, destfile, infile, remote_path, t1, t2)
+			lm_path, err := lctx.expand_param("lmirror_path_format", infile, t2, nil, nil)
+			if err != nil {
+				line += fmt.Sprintf(" : %v", err)
+			} else {
+				line += " : lmirror path " + lm_path
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (fw *FTPWatcher) plan_download(watch_data map[string]interface{}, plan *dry_run_plan, remote_path, localdir, fullname string,
+	size uint64, local, remote time.Time) {
+	/*
+	 Shows the download of remote_path as fullname and what would follow it
+	 */
+	reason := "not downloaded yet"
+	if local.IsZero() == false {
+		reason = "local copy from " + local.Format("20060102 15:04:05") + " is older"
+	}
+	plan.downloads++
+	plan.bytes += size
+	plan.note("download %s, %d bytes, mtime %s, as %s : %s", remote_path, size, remote.Format("20060102 15:04:05"), fullname, reason)
+	if dir := fw._distribution_dir(path.Base(fullname), remote, localdir, watch_data); dir != "" {
+		plan.note("    distribution=%v would put it in %s, but the pass does not apply distribution=", block_config(watch_data).Distribution, dir)
+	}
+	if download_check := block_config(watch_data).DownloadCheck; download_check != "" {
+		tempname := path.Join(path.Dir(fullname), fw.__temp_prefix+path.Base(fullname))
+		fw.plan_commands(watch_data, plan, "download check", download_check,
+			command_vars{File: tempname, RemotePath: remote_path, RemoteMtime: remote})
+	}
+	if post_download := block_config(watch_data).PostDownload; post_download != "" {
+		fw.plan_commands(watch_data, plan, "post-download", post_download,
+			command_vars{File: fullname, RemotePath: remote_path, RemoteMtime: remote})
+	}
+	for _, line := range fw.lmirror_plan(watch_data, fullname, fullname, remote_path, local, remote) {
+		plan.note("    %s", line)
+	}
+}
+
+func (fw *FTPWatcher) plan_deletions(watch_data map[string]interface{}, plan *dry_run_plan, localdir string, remote_files, remote_dirs []string) {
+	/*
+	 Shows the local files that mode=mirror would delete as they are not
+	 on the server. The pass does not delete them, so they are only listed.
+	 */
+	fl, err := ioutil.ReadDir(localdir)
+	if err != nil {
+		return
+	}
+	names := make([]string, 0)
+	for _, f := range fl {
+		if f.Name()[0] != '@' {
+			names = append(names, f.Name())
+		}
+	}
+	for _, name := range fw._files_to_delete(names, remote_files, remote_dirs, watch_data) {
+		plan.local++
+		plan.note("local only %s : mode=mirror would delete it, but the pass does not delete", path.Join(localdir, name))
+	}
+}
+
+func DryRun(configFile string) int {
+	/*
+	 Entry point of --Dryrun without --Reprocess. Runs a pass over every
+	 block or those given by --Blocks, one after the other, logging in and
+	 listing as usual but only printing what would be downloaded, where it
+	 would end up and what would run on it. Nothing is written but the
+	 dry run's own log. Returns the exit status : 0 if the plan is
+	 complete, 1 if a login, listing or template failed, 2 on bad arguments
+	 */
+	watchlist, err := load_watchlist(configFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	selected, err := select_blocks(watchlist, opt.Blocks)
+	if err != nil {
+		fmt.Println(err, "in", configFile)
+		return 2
+	}
+	fw := newFTPWatcher(selected, false)
+	fw.config_file = configFile
+	status := 0
+	for _, watch_data := range fw.get_watchers() {
+		blockname := block_config(watch_data).Name
+		plan := &dry_run_plan{block: blockname}
+		block_rt(watch_data).dry_run = plan
+		pq := fw._post_queue(watch_data)
+		pq.mu.Lock()
+		for _, job := range pq.list() {
+			if job.Dead == false && time.Now().Before(job.NextTry) == false {
+				plan.note("retry post-processing of %s, %d failed attempts so far", job.File, job.Attempts)
+			}
+		}
+		pq.mu.Unlock()
+		block_rt(watch_data).logger.Println("Dry run pass")
+		fw.adjust_stale_time(watch_data)
+		fw.run_pass(fw.ctx, watch_data)
+		block_rt(watch_data).quit_server()
+		bs := fw._block_state(watch_data).status(blockname)
+		for _, what := range bs.LastFailures {
+			plan.note("failed : %s", what)
+		}
+		plan.note("%d downloads, %d bytes, %d skipped, %d local only, %d failures, %d bad commands",
+			plan.downloads, plan.bytes, plan.skipped, plan.local, bs.Failures, plan.errors)
+		if bs.Failures > 0 || plan.errors > 0 {
+			status = 1
+		}
+	}
+	return status
+}
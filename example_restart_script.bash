@@ -19,8 +19,13 @@ tstamp=$(date)
 
 echo "Attempting restart : tstamp = $tstamp" >> $startlog
 
+# ftpwatcher drains transfers and post processing for up to --Draintimeout (default 5m) on QUIT
 pkill -QUIT -f $cmd
-sleep 2
+for i in $(seq 1 66)
+do
+    pgrep -f $cmd > /dev/null || break
+    sleep 5
+done
 pgrep -f $cmd > /dev/null
 
 if [ "$?" == "0" ]
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Version of the JSON protocol spoken with external lmirror plugins.
+// A plugin answers with the version it implements, from 1 up to this one.
+const _EXT_PLUGIN_PROTOCOL_VERSION = 1
+
+// ExtPluginRequest is written as one JSON document to the plugin's stdin
+type ExtPluginRequest struct {
+	Version        int               `json:"version"`
+	Block          string            `json:"block"`
+	Label          string            `json:"label"`
+	Params         map[string]string `json:"params"`
+	Destfile       string            `json:"destfile"`
+	Infile         string            `json:"infile"`
+	RemotePath     string            `json:"remote_path"`
+	RemoteMtime    string            `json:"remote_mtime"`
+	PreviousMtime  string            `json:"previous_mtime,omitempty"`
+	PreviousPeriod string            `json:"previous_period,omitempty"`
+	TempDir        string            `json:"temp_dir"`
+}
+
+// ExtPluginLog is a log line reported by a plugin, written to the block log
+type ExtPluginLog struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// ExtPluginError is the structured error a plugin reports instead of outputs
+type ExtPluginError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+func (e *ExtPluginError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// ExtPluginResponse is read as one JSON document from the plugin's stdout
+type ExtPluginResponse struct {
+	Version int             `json:"version"`
+	Outputs []LmirrorOutput `json:"outputs"`
+	Logs    []ExtPluginLog  `json:"logs"`
+	Error   *ExtPluginError `json:"error"`
+}
+
+// external_plugin runs plugin_cmd for every input and speaks the JSON protocol with it
+type external_plugin struct{}
+
+func (p external_plugin) Run(fw *FTPWatcher, lctx *LmirrorContext) (*LmirrorResult, error) {
+	req := ExtPluginRequest{
+		Version:        _EXT_PLUGIN_PROTOCOL_VERSION,
+		Block:          lctx.Block,
+		Label:          lctx.Label,
+		Params:         lctx.Params,
+		Destfile:       lctx.Destfile,
+		Infile:         lctx.Infile,
+		RemotePath:     lctx.RemotePath,
+		RemoteMtime:    lctx.RemoteMtime.Format(time.RFC3339),
+		PreviousPeriod: lctx.PreviousPeriod,
+		TempDir:        fw.__tmp_dir,
+	}
+	if lctx.PreviousMtime.IsZero() == false {
+		req.PreviousMtime = lctx.PreviousMtime.Format(time.RFC3339)
+	}
+	in, _ := json.Marshal(req)
+	timeout := plugin_timeout(lctx)
+	stdout, stderr, err := run_with_timeout(lctx.Params["plugin_cmd"], fw.__tmp_dir, in, timeout)
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		if line != "" {
+			lctx.Logger.Println(lctx.Label, "stderr :", line)
+		}
+	}
+	resp := new(ExtPluginResponse)
+	if jerr := json.Unmarshal([]byte(stdout), resp); jerr != nil {
+		if err != nil {
+			return nil, &ExtPluginError{Code: "exec", Message: err.Error(), Retryable: true}
+		}
+		return nil, &ExtPluginError{Code: "protocol", Message: "Cannot parse plugin response : " + jerr.Error()}
+	}
+	for _, l := range resp.Logs {
+		lctx.Logger.Printf("%s %s : %s\n", lctx.Label, l.Level, l.Message)
+	}
+	if resp.Version < 1 || resp.Version > _EXT_PLUGIN_PROTOCOL_VERSION {
+		return nil, &ExtPluginError{Code: "protocol", Message: fmt.Sprintf("Plugin speaks protocol version %d, 1 to %d is supported", resp.Version, _EXT_PLUGIN_PROTOCOL_VERSION)}
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	if err != nil {
+		return nil, &ExtPluginError{Code: "exec", Message: err.Error(), Retryable: true}
+	}
+	result := new(LmirrorResult)
+	for _, out := range resp.Outputs {
+		if out.Path == "" {
+			return nil, &ExtPluginError{Code: "protocol", Message: "Output without a path"}
+		}
+		// Trust nothing but the path, size and checksum are taken from the file
+		checked, cerr := lmirror_output(out.Path)
+		if cerr != nil {
+			return nil, &ExtPluginError{Code: "output", Message: cerr.Error()}
+		}
+		if out.Sha256 != "" && out.Sha256 != checked.Sha256 {
+			return nil, &ExtPluginError{Code: "output", Message: "Checksum mismatch for " + out.Path}
+		}
+		result.Outputs = append(result.Outputs, checked)
+	}
+	return result, nil
+}
+
+func plugin_timeout(lctx *LmirrorContext) time.Duration {
+	timeout, err := time.ParseDuration(lctx.Params["plugin_timeout"])
+	if err != nil || timeout <= 0 {
+		lctx.Logger.Println("Bad plugin_timeout", lctx.Params["plugin_timeout"], "for", lctx.Label, "using", _DEFAULT_PLUGIN_TIMEOUT)
+		timeout, _ = time.ParseDuration(_DEFAULT_PLUGIN_TIMEOUT)
+	}
+	return timeout
+}
+
+func run_with_timeout(command, dir string, stdin []byte, timeout time.Duration) (string, string, error) {
+	/*
+	 Runs command through bash in its own process group, feeding it stdin.
+	 The whole group is killed if it runs longer than timeout.
+	 Returns stdout, stderr and an error on failure or timeout.
+	 */
+	c := exec.Command("bash", "-c", command)
+	c.Dir = dir
+	c.Env = child_environ()
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout, stderr bytes.Buffer
+	c.Stdin = bytes.NewReader(stdin)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Start(); err != nil {
+		return "", "", err
+	}
+	killed, err := wait_or_kill(c, timeout)
+	if killed {
+		return stdout.String(), stderr.String(), errors.New(fmt.Sprintf("%s : killed after %s", command, timeout))
+	}
+	if err != nil {
+		return stdout.String(), stderr.String(), fmt.Errorf("%s : %v", command, err)
+	}
+	return stdout.String(), stderr.String(), nil
+}
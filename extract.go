@@ -0,0 +1,230 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"github.com/LDCS/qcfg"
+)
+
+// Archive types the extract plugin unpacks, by filename suffix, longest first
+var _EXTRACT_SUFFIXES = []string{".tar.gz", ".tar.bz2", ".tbz2", ".tbz", ".tgz", ".tar", ".zip"}
+
+// extract_member is called for every regular file in an archive
+type extract_member func(name string, mtime time.Time, r io.Reader) error
+
+func archive_suffix(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, suffix := range _EXTRACT_SUFFIXES {
+		if strings.HasSuffix(lower, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+func walk_zip(infile string, fn extract_member) error {
+	zr, err := zip.OpenReader(infile)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.FileInfo().Mode().IsRegular() == false {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(f.Name, f.Modified, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walk_tar(infile, suffix string, fn extract_member) error {
+	fp, err := os.Open(infile)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	switch suffix {
+	case ".tar.gz", ".tgz":
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case ".tar.bz2", ".tbz2", ".tbz":
+		r = bzip2.NewReader(fp)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Links and devices are skipped, a link could point outside the output dir
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if err := fn(hdr.Name, hdr.ModTime, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func safe_member_path(name string) (string, error) {
+	/*
+	 Returns the cleaned relative path of an archive member, or an error
+	 if it is absolute or climbs out of the output dir (zip-slip)
+	 */
+	name = strings.Replace(name, "\\", "/", -1)
+	if path.IsAbs(name) {
+		return "", errors.New("Absolute member path " + name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") || cleaned == "." {
+		return "", errors.New("Member path escapes the output dir " + name)
+	}
+	return cleaned, nil
+}
+
+func lmirror_plugin_extract(fw *FTPWatcher, lctx *LmirrorContext) ([]string, error) {
+	/*
+	 Unpacks zip and tar archives into extract_dir (default: next to the
+	 archive). extract_include restricts the members by pattern and
+	 extract_path_format places each member under extract_dir. Other
+	 files are passed on unchanged.
+	 */
+	destfile, infile := lctx.Destfile, lctx.Infile
+	logger := lctx.Logger
+	suffix := archive_suffix(infile)
+	if suffix == "" {
+		logger.Println("extract plugin :", infile, "is not an archive, passing it on")
+		return []string{infile}, nil
+	}
+	fi, err := os.Stat(infile)
+	if err != nil {
+		logger.Println("extract plugin error : Cannot stat", infile)
+		return nil, err
+	}
+	modtime := fi.ModTime()
+	archive := path.Base(infile)
+	archive = archive[:len(archive)-len(suffix)]
+	outdir := path.Dir(infile)
+	if lctx.Params["extract_dir"] != "" {
+		dir, err := lctx.expand_param("extract_dir", infile, modtime, map[string]string{"ARCHIVE": archive}, nil)
+		if err != nil {
+			logger.Println("extract plugin error :", err)
+			return nil, err
+		}
+		outdir = path.Clean(dir)
+	}
+	includes := make([]string, 0)
+	if lctx.Params["extract_include"] != "" {
+		includes = strings.Split(lctx.Params["extract_include"], _SKIP_PATTERNS_SEP)
+	}
+
+	outfiles := make([]string, 0)
+	outputs := make([]string, 0)
+	member := func(name string, mtime time.Time, r io.Reader) error {
+		rel, err := safe_member_path(name)
+		if err != nil {
+			return err
+		}
+		if len(includes) > 0 {
+			included := false
+			for _, pat := range includes {
+				m1, _ := path.Match(pat, rel)
+				m2, _ := path.Match(pat, path.Base(rel))
+				if m1 || m2 {
+					included = true
+					break
+				}
+			}
+			if included == false {
+				return nil
+			}
+		}
+		if mtime.IsZero() {
+			mtime = modtime
+		}
+		member_path, err := lctx.expand_param("extract_path_format", infile, modtime,
+			map[string]string{"ARCHIVE": archive, "MEMBER": rel, "MEMBER_DIR": path.Dir(rel), "MEMBER_BASE": path.Base(rel)},
+			map[string]time.Time{"MEMBER_DATE": mtime})
+		if err != nil {
+			return err
+		}
+		dst := path.Join(outdir, member_path)
+		if strings.HasPrefix(dst, outdir+"/") == false {
+			return errors.New("Member " + name + " placed outside the output dir as " + dst)
+		}
+		if lctx.make_dir(path.Dir(dst), fw._default_permission) == false {
+			return errors.New("Cannot make dir " + path.Dir(dst))
+		}
+		tmp := dst + "@"
+		fp, err := os.OpenFile(tmp, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fp, r)
+		fp.Close()
+		if err == nil {
+			err = os.Rename(tmp, dst)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		os.Chtimes(dst, mtime, mtime)
+		outfiles = append(outfiles, dst[len(outdir)+1:])
+		outputs = append(outputs, dst)
+		return nil
+	}
+	if suffix == ".zip" {
+		err = walk_zip(infile, member)
+	} else {
+		err = walk_tar(infile, suffix, member)
+	}
+	if err != nil {
+		logger.Println("extract plugin error :", infile, ":", err)
+		return nil, err
+	}
+	logger.Println("extract plugin : extracted", len(outputs), "members of", infile, "into", outdir)
+	if fw.is_lmirror_main(destfile, infile) == false {
+		return outputs, nil
+	}
+
+	// Record the members so the already-downloaded check finds them, as with split,
+	// keeping what adaptive-transpath recorded about the file in the same meta file
+	meta := destfile + ".meta"
+	ccfg := qcfg.NewCfgMem(meta)
+	if _, err := os.Stat(meta); err == nil {
+		ccfg = qcfg.NewCfg(meta, meta, false)
+	}
+	ccfg.EditEntry("extract", "file", "outdir", outdir)
+	set_meta_outfiles(ccfg, "extract", outfiles)
+	ccfg.CfgWrite(meta)
+	if err := relink_lmirror_main(lctx.Logger, destfile, meta, modtime); err != nil {
+		logger.Println("extract plugin error : Cannot create link", destfile, "->", meta)
+		return outputs, err
+	}
+	return outputs, nil
+}
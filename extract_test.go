@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"github.com/LDCS/qcfg"
+)
+
+// test_member is a member of a test archive, a symlink if link is set
+type test_member struct {
+	name string
+	body string
+	link string
+}
+
+func write_test_zip(t *testing.T, file string, members []test_member) {
+	fp, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	zw := zip.NewWriter(fp)
+	for _, m := range members {
+		w, err := zw.Create(m.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(m.body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func write_test_tar(t *testing.T, file string, members []test_member) {
+	fp, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	tw := tar.NewWriter(fp)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(m.body))}
+		if m.link != "" {
+			hdr = &tar.Header{Name: m.name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: m.link}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(m.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// run_extract extracts archive into dir/out and returns the files found under dir
+func run_extract(t *testing.T, dir, archive string) ([]string, error) {
+	fw := new(FTPWatcher)
+	fw._default_permission = 0755
+	lctx := &LmirrorContext{Params: map[string]string{"extract_dir": filepath.Join(dir, "out"), "extract_path_format": "__MEMBER__"},
+		BlockConfig: &BlockConfig{Name: "test"}, Logger: log.New(ioutil.Discard, "", 0),
+		Destfile: filepath.Join(dir, "dest", filepath.Base(archive)), Infile: archive, state: new_block_state()}
+	_, err := lmirror_plugin_extract(fw, lctx)
+	files := make([]string, 0)
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() == false && p != archive {
+			rel, _ := filepath.Rel(dir, p)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func TestSafeMemberPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a.csv", "a.csv", true},
+		{"sub/./a.csv", "sub/a.csv", true},
+		{"sub/../a.csv", "a.csv", true},
+		{"sub\\a.csv", "sub/a.csv", true},
+		{"..", "", false},
+		{"../evil", "", false},
+		{"sub/../../evil", "", false},
+		{"..\\evil", "", false},
+		{"/etc/passwd", "", false},
+		{"\\etc\\passwd", "", false},
+		{".", "", false},
+		{"sub/..", "", false},
+	}
+	for _, tt := range tests {
+		got, err := safe_member_path(tt.name)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("safe_member_path(%q) = %q, %v, want %q, ok %v", tt.name, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExtractZipSlip(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []test_member
+		files   []string
+		ok      bool
+	}{
+		{"plain", []test_member{{name: "a.csv", body: "a"}, {name: "sub/b.csv", body: "b"}}, []string{"out/a.csv", "out/sub/b.csv"}, true},
+		{"dot dot", []test_member{{name: "../evil", body: "x"}}, []string{}, false},
+		{"deep dot dot", []test_member{{name: "sub/../../evil", body: "x"}}, []string{}, false},
+		{"absolute", []test_member{{name: "/abs", body: "x"}}, []string{}, false},
+		{"backslash", []test_member{{name: "..\\evil", body: "x"}}, []string{}, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "f.zip")
+		write_test_zip(t, archive, tt.members)
+		files, err := run_extract(t, dir, archive)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s : error %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if reflect.DeepEqual(files, tt.files) == false {
+			t.Errorf("%s : wrote %v, want %v", tt.name, files, tt.files)
+		}
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(dir), "evil")); err == nil {
+			t.Errorf("%s : wrote outside the temp dir", tt.name)
+		}
+	}
+}
+
+func TestExtractTarSymlink(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "f.tar")
+	// A link out of the output dir followed by a member written through it
+	write_test_tar(t, archive, []test_member{
+		{name: "ln", link: "../../outside"},
+		{name: "ln/x", body: "x"},
+		{name: "a.csv", body: "a"},
+	})
+	files, err := run_extract(t, dir, archive)
+	if err != nil {
+		t.Fatalf("extract : %v", err)
+	}
+	if want := []string{"out/a.csv", "out/ln/x"}; reflect.DeepEqual(files, want) == false {
+		t.Errorf("wrote %v, want %v", files, want)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "out", "ln")); err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("out/ln should be a plain dir")
+	}
+	if _, err := os.Lstat(filepath.Join(filepath.Dir(dir), "outside")); err == nil {
+		t.Errorf("wrote through the symlink member")
+	}
+}
+
+func TestMetaOutfiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+	}{
+		{"plain", []string{"a.csv", "sub/b.csv"}},
+		{"commas", []string{"a,b.csv", "c.csv"}},
+		{"odd chars", []string{"with space.csv", "semi;colon%41.csv", "plus+eq=.csv"}},
+	}
+	for _, tt := range tests {
+		cfg := qcfg.NewCfgMem("test.meta")
+		set_meta_outfiles(cfg, "extract", tt.files)
+		if got := meta_outfiles(cfg, "extract"); reflect.DeepEqual(got, tt.files) == false {
+			t.Errorf("%s : read back %q, want %q", tt.name, got, tt.files)
+		}
+	}
+
+	// Split programs write the names comma separated without an encoding
+	cfg := qcfg.NewCfgMem("test.meta")
+	cfg.EditEntry("split", "file", "outfiles", "a%2C.csv,b.csv")
+	if got := meta_outfiles(cfg, "split"); strings.Join(got, "|") != "a%2C.csv|b.csv" {
+		t.Errorf("split outfiles read as %q", got)
+	}
+}
@@ -3,11 +3,14 @@
 package main
 
 import (
+    "context"
     "github.com/LDCS/genutil"
     "github.com/LDCS/qcfg"
     "fmt"
     "os"
     "os/signal"
+    "syscall"
+    "sync"
     "os/exec"
     "log"
     "time"
@@ -16,10 +19,10 @@ import (
     "strconv"
     "github.com/LDCS/goftp"
     "path"
+    "path/filepath"
     "regexp"
     "io/ioutil"
     "io"
-    "github.com/LDCS/compresstype"
     "github.com/LDCS/sflag"
     "encoding/json"
     "github.com/LDCS/cim"
@@ -39,6 +42,10 @@ var(
 	_MODE_CHOICES = []string{"mirror", "archive"}
 	_SKIP_PATTERNS_SEP = ","
 	_SKIP_PATTERNS_LITERAL_SEP = "_COMMA_"
+	_DEFAULT_PLUGIN_TIMEOUT = "10m"
+	_DEFAULT_MODE = "mirror"
+	_DEFAULT_PROXY_HOST = "foo.bar.net"
+	_DEFAULT_SKIP_PATTERNS = []string{".", ".."}
 	thread_no = 10
 	thread_id = 1
 )
@@ -49,15 +56,40 @@ var opt = struct{
 	Inst          string       "Instance number"
 	Logbasedir    string       "Log files base directory|/data0/logs/ftpwatcher"
 	Alertcmd      string       "Alert command|NOCMD"
+	Draintimeout  string       "How long to wait for transfers and post processing on shutdown|5m"
+	Reprocess     string       "Re-run the post processing of the files already downloaded by this block and exit"
+	Files         string       "With --Reprocess, glob of the files to reprocess, relative to the block's destination|*"
+	Backfill      string       "Mirror the files of this block from --From to --To once, whatever their age, and exit"
+	From          string       "With --Reprocess or --Backfill, only files with an mtime on or after this YYYYMMDD"
+	To            string       "With --Reprocess or --Backfill, only files with an mtime on or before this YYYYMMDD"
+	Dateddirs     bool         "With --Backfill, select the YYYYMMDD dirs from --From to --To instead of file mtimes"
+	Kbps          int          "With --Backfill, transfer speed limit in KB/s, overriding backfill_kbps="
+	Once          bool         "Mirror every block once, waiting for its post processing, and exit"
+	Blocks        string       "With --Once, --Dryrun or --Dumpconfig, comma separated blocks to use instead of all of them"
+	Checkconfig   bool         "Check every block of the cfg file, print what is wrong with it and exit"
+	Dumpconfig    bool         "Print every block as merged from its %include, %defaults and %template sections and exit"
+	Dryrun        bool         "Only show what would be done : with --Reprocess the files, else a pass over the blocks"
+	Creds         string       "Manage the encrypted credentials store and exit : newkey, add, rotate or list"
+	Entry         string       "With --Creds add or rotate, name of the entry, its secret is read from stdin"
+	Credstore     string       "Encrypted credentials store read by passwd_store=, default credentials.store in --Logbasedir"
+	Credkey       string       "Key file unlocking --Credstore, made by --Creds newkey"
 }{}
 
 func parseArgs() {
 
 	sflag.Parse(&opt)
+    if ((opt.Checkconfig || opt.Dumpconfig) && opt.Config != "") || opt.Creds != "" {
+		// Checking or dumping a cfg file or managing credentials needs no instance
+		return
+    }
     if opt.Config == "" || opt.Inst == "" {
 		fmt.Println("Usage: ftpwatcher --Config /path/to/ftpwatcher.cfg --Inst <two digit instance number>")
 		panic("Config file path or instance number not specified")
     }
+    if d, err := time.ParseDuration(opt.Draintimeout); err != nil || d <= 0 {
+		fmt.Println("Bad --Draintimeout", opt.Draintimeout, ": a duration above 0 such as 90s or 5m is needed")
+		os.Exit(2)
+    }
 }
 
 // worker can't be a method so it accepts FTPWatcher objectptr
@@ -72,7 +104,8 @@ type work struct {
     //opt2 interface{}
 }
 
-type lmirror_plugin_function func (*FTPWatcher, map[string]interface{}, string, string, ...interface{}) (string, error)
+// lmirror_plugin_function is the simple form of an LmirrorPlugin, returning only the output paths
+type lmirror_plugin_function func (*FTPWatcher, *LmirrorContext) ([]string, error)
 
 type WatchInfo struct {
     ReportTstamp string
@@ -101,6 +134,10 @@ type FTPWatcher struct {
     __pid_filename string
     __tmp_dir string
     __stats_filename string
+    // Post processing queue file in each block's log dir
+    __post_queue_file string
+    // Prefix of the temp names downloads are written to
+    __temp_prefix string
     __default_mode string
     // How long to wait in seconds before looping, used in daemon mode
     __loop_wait_time int
@@ -111,16 +148,30 @@ type FTPWatcher struct {
     daemon bool
     watchers []map[string]interface{}
     tids []int
-    lmirror_plugins map[string]lmirror_plugin_function
+    lmirror_plugins map[string]LmirrorPlugin
     jsondata []map[string]interface{}
+    // Guards jsondata, updated by the watchers, post processing and CIM commands
+    jsondata_mu sync.Mutex
     bytes_per_hour map[string][]int64
     total_bytes map[string]int64
+    // Cancelled on shutdown to stop scheduling new work
+    ctx context.Context
+    cancel context.CancelFunc
+    drain_timeout time.Duration
+    active_passes sync.WaitGroup
+    post_process_pending sync.WaitGroup
+    temp_files map[string]bool
+    temp_files_mu sync.Mutex
+    // Guards watchers, which is replaced on reload
+    watchers_mu sync.RWMutex
+    reload_mu sync.Mutex
+    config_file string
 }
 
 func newFTPWatcher(watchlist []map[string]interface{}, start_daemon bool) (fw *FTPWatcher) {
     fw = new(FTPWatcher)
-    fw.__proxy_hostname = "foo.bar.net"
-    fw.__skip_patterns = []string{".", ".."}
+    fw.__proxy_hostname = _DEFAULT_PROXY_HOST
+    fw.__skip_patterns = _DEFAULT_SKIP_PATTERNS
     fw._max_retry_attempts = 5
     fw._MAX_THREADS = 10
     fw._dscope_filename_dates_rec, _ = regexp.Compile("(?P<month>\\d{2})(?P<day>\\d{2})\\.")
@@ -130,38 +181,65 @@ func newFTPWatcher(watchlist []map[string]interface{}, start_daemon bool) (fw *F
     fw.__log_err_filename = fmt.Sprintf("ftpwatcher-%s.err", opt.Inst)
     fw.__pid_filename = fmt.Sprintf("ftpwatcher-%s.pid", opt.Inst)
     fw.__stats_filename = fmt.Sprintf("ftpwatcher-stats-%s.json", opt.Inst)
-    fw.__tmp_dir = fmt.Sprintf("/tmp/ftpwatcher-%s.d", opt.Inst)
-    fw.__default_mode = "mirror"
+    fw.__post_queue_file = _POST_QUEUE_FILE
+    fw.__temp_prefix = "@"
+    if opt.Backfill != "" {
+		// A backfill may run beside the daemon, on the same block, so it keeps its own log, queue and temp names
+		fw.__log_filename = fmt.Sprintf("ftpwatcher-%s-backfill-%s.log", opt.Inst, time.Now().Format("20060102"))
+		fw.__post_queue_file = _BACKFILL_POST_QUEUE_FILE
+		fw.__temp_prefix = _BACKFILL_TEMP_PREFIX
+    } else if opt.Dryrun && opt.Reprocess == "" {
+		fw.__log_filename = fmt.Sprintf("ftpwatcher-%s-dryrun-%s.log", opt.Inst, time.Now().Format("20060102"))
+    }
+    // Each process of the instance, daemon or --Once, --Backfill and --Reprocess runs, has its own temp dir
+    fw.__tmp_dir = fmt.Sprintf("/tmp/ftpwatcher-%s.d/%d", opt.Inst, os.Getpid())
+    fw.__default_mode = _DEFAULT_MODE
     fw.__loop_wait_time = 300
     fw._command_separator = "^"
     fw._DELETED_SUFFIX = ".DELETED"
     fw._default_permission = 0755
     fw.daemon = start_daemon
     fw.watchers = watchlist
-    fw.lmirror_plugins = make(map[string]lmirror_plugin_function)
+    fw.lmirror_plugins = make(map[string]LmirrorPlugin)
     fw.jsondata = make([]map[string]interface{}, 1)
     fw.jsondata[0] = make(map[string]interface{})
     fw.bytes_per_hour = make(map[string][]int64)
     fw.total_bytes = make(map[string]int64)
+    fw.ctx, fw.cancel = context.WithCancel(context.Background())
+    fw.temp_files = make(map[string]bool)
+    fw.drain_timeout, _ = time.ParseDuration(opt.Draintimeout) // Checked by parseArgs
     genutil.EnsureDirOrDie("/tmp", fmt.Sprintf("ftpwatcher-%s.d", opt.Inst))
+    genutil.EnsureDirOrDie(path.Dir(fw.__tmp_dir), path.Base(fw.__tmp_dir))
     if fw.makedir(fmt.Sprintf(fw.__log_dir, ""), fw._default_permission, fw.watchers[0]) == false {
 		os.Stdout.WriteString("Could not make ftpwatcher log directory\n")
 		os.Exit(1)
     }
-    fw._setup_error_logging()
-    if fw._check_watch_data(fw.watchers) == false {
-		os.Stderr.WriteString("Configuration error in one or more watchers, exiting\n")
+    // Configuration errors go to the terminal, stderr is redirected to the .err file only once they are checked
+    if fw._check_watch_data(fw.watchers, nil) == false {
+		os.Stderr.WriteString("Configuration error in one or more watchers, see the block logs or run with --Checkconfig, exiting\n")
 		os.Exit(1)
     }
+    fw.register_builtin_plugins()
+    if fw.check_lmirror_cfg_parms(fw.watchers) == false {
+		os.Stderr.WriteString("Bad lmirror stage in one or more watchers, see the block logs or run with --Checkconfig, exiting\n")
+		os.Exit(1)
+    }
+    if fw.daemon {
+		fw._setup_error_logging()
+    }
+    if fw.daemon == false {
+		// One-off commands leave the json and pid files, warn scheduler and CIM server to the daemon
+		return
+    }
+    fw.update_json(func(data map[string]interface{}) {
+		data["ftpwatcher"] = FtpWatcherInfo{time.Now().Format("20060102 15:04:05"), time.Now().Format("20060102 15:04:05")}
+    })
+    // Also writes the JSON file, with the post processing left queued by the last run
+    fw.publish_post_queues()
     fw._setup_signal_handling()
     fw._write_pid_file()
     //fw._init_stats()
     fw._start_warn_scheduler(fw.watchers)
-    fw.register_lmirror_func("transpath", lmirror_plugin_transpath)
-    fw.register_lmirror_func("adaptive-transpath", lmirror_plugin_adaptive_transpath)
-    fw.register_lmirror_func("transzip", lmirror_plugin_transzip)
-    fw.register_lmirror_func("split", lmirror_plugin_split)
-    fw.check_lmirror_cfg_parms()
     go start_cim_server(fw)
     //go gen_stats(fw)
     return
@@ -190,12 +268,12 @@ func (fw *FTPWatcher) _init_stats() {
 		json.Unmarshal(buf, &fw.bytes_per_hour)
     } else {
 		for _, watch_data := range fw.watchers {
-			fw.bytes_per_hour[watch_data["blockname"].(string)] = make([]int64, 0)
+			fw.bytes_per_hour[block_config(watch_data).Name] = make([]int64, 0)
 		}
 		fw.write_stats_file()
     }
     for _, watch_data := range fw.watchers {
-		fw.total_bytes[watch_data["blockname"].(string)] = 0
+		fw.total_bytes[block_config(watch_data).Name] = 0
     }
 
 }
@@ -213,6 +291,8 @@ func show_info(data interface{}, cmd string, args ...string) string {
     if cmd != "info" { return "" }
     if len(args) < 1 { return "No dotted path provided!" }
     path := strings.Split(args[0], ".")
+    fw.jsondata_mu.Lock()
+    defer fw.jsondata_mu.Unlock()
     if len(path) == 1 {
 		if path[0] == "main" {
 			out, _ := json.MarshalIndent(fw.jsondata[0], "", "    ")
@@ -237,6 +317,14 @@ func start_cim_server(fw *FTPWatcher) {
     cn.Children = []*cim.CimNode{}
     cn.Callbacks = make(map[string]cim.CBfunc)
     cn.Callbacks["info"] = show_info
+    cn.Callbacks["status"] = show_status
+    cn.Callbacks["reload"] = reload_config
+    cn.Callbacks["reclassify"] = reclassify_file
+    cn.Callbacks["postqueue"] = post_queue_command
+    cn.Callbacks["retry"] = post_queue_command
+    for _, cmd := range []string{"trigger", "pause", "resume", "cancel"} {
+		cn.Callbacks[cmd] = control_block
+    }
     hostname,_ := os.Hostname()
     cs, err := cim.NewCimServer(hostname, "ftpwatcher" + opt.Inst, cn, fw)
     if err != nil {
@@ -249,372 +337,298 @@ func start_cim_server(fw *FTPWatcher) {
 }
 
 
-func CopyFile(dst, src string) (int64, error) {
-    sf, err := os.Open(src)
-    if err != nil {
-		return 0, err
-    }
-    defer sf.Close()
-    df, err := os.Create(dst)
-    if err != nil {
-		return 0, err
-    }
-    defer df.Close()
-    return io.Copy(df, sf)
+func split_command(split_cmd, infile, meta, tmp_dir string) string {
+    /*
+     The split_cmd= command line for infile. It is run by bash -c and the
+     paths come from remote file names, so each of them is quoted.
+     */
+    base, file := path.Split(infile)
+    return split_cmd + fmt.Sprintf(" --Inbase %s --Infile %s --Metafile %s --Outbase %s --Tempbase %s", shell_quote(base),
+		shell_quote(file), shell_quote(meta), shell_quote(base), shell_quote(tmp_dir))
 }
 
-func lmirror_plugin_split(fw *FTPWatcher, watch_data map[string]interface{}, destfile, lmirror_file string, opts ...interface{}) (string,error) {
-    fi, _ := os.Lstat(destfile)
+func lmirror_plugin_split(fw *FTPWatcher, lctx *LmirrorContext) ([]string, error) {
+    destfile, infile := lctx.Destfile, lctx.Infile
+    fi, err := os.Stat(infile)
+    if err != nil {
+		lctx.Logger.Println("split plugin error : Cannot stat", infile)
+		return nil, err
+    }
     modtime := fi.ModTime()
-    if lmirror_file == "" {
+    is_main := fw.is_lmirror_main(destfile, infile)
+    if infile == destfile {
 		// First do transpath
-		lmirror_file, _ = lmirror_plugin_transpath(fw, watch_data, destfile, lmirror_file)
+		outs, err := lmirror_plugin_transpath(fw, lctx)
+		if err != nil {
+			return outs, err
+		}
+		infile = outs[0]
     }
-    //ok, _ := fw._parse_run_cmd(lmirror_file, watch_data["lmirror_split_cmd"].(string), watch_data)
     meta := destfile + ".meta"
-    base, file := path.Split(lmirror_file)
-    cmd := watch_data["lmirror_split_cmd"].(string)
-    cmd += fmt.Sprintf(" --Inbase %s --Infile %s --Metafile %s --Outbase %s --Tempbase %s", base, file, meta, base, fw.__tmp_dir)
-    buf := genutil.BashExecOrDie(false, cmd, fw.__tmp_dir);
-    watch_data["logger"].(*log.Logger).Println(watch_data["lmirror_split_cmd"].(string), "output : ", buf)
+    if is_main == false {
+		// Not the downloaded file itself, so there is no link to point at the meta file
+		meta = path.Join(fw.__tmp_dir, path.Base(infile) + "." + time.Now().Format("20060102T150405.000") + ".meta")
+		defer os.Remove(meta)
+    }
+    cmd := split_command(lctx.Params["split_cmd"], infile, meta, fw.__tmp_dir)
+    stdout, stderr, err := run_with_timeout(cmd, fw.__tmp_dir, nil, plugin_timeout(lctx))
+    lctx.Logger.Println(lctx.Params["split_cmd"], "output : ", stdout, stderr)
+    if err != nil {
+		lctx.Logger.Println("split plugin error :", err)
+		return nil, err
+    }
+
+    outdir, outfiles := read_split_meta(meta)
+    outputs := make([]string, 0)
+    for _, outfile := range outfiles {
+		outputs = append(outputs, path.Join(outdir, outfile))
+    }
+    if is_main == false {
+		return outputs, nil
+    }
 
     err1 := os.Remove(destfile)
     if err1 != nil {
-		watch_data["logger"].(*log.Logger).Println(
+		lctx.Logger.Println(
 			"split plugin error : Cannot remove link", destfile)
-		return lmirror_file, err1
+		return outputs, err1
     }
-
-    // fp, err2 := os.Create(meta)
-    // if err2 != nil {
-    // 	watch_data["logger"].(*log.Logger).Println(
-    // 	    "split plugin error : Cannot create meta file", meta)
-    // 	return lmirror_file, err1
-    // }
-    // // Write tstamp inside the text file
-    // //fp.WriteString(modtime.Format(time.RFC822))
-    // fp.Close()
     err3 := os.Symlink(meta, destfile)
     if err3 != nil {
-		watch_data["logger"].(*log.Logger).Println(
-			"transzip plugin error : Cannot create link", destfile, "->", meta)
-		return meta, err1
+		lctx.Logger.Println(
+			"split plugin error : Cannot create link", destfile, "->", meta)
+		return outputs, err3
     }
-    fw._parse_run_cmd(destfile, "touch -h -t " + modtime.Format("200601021504.05"), watch_data)
+    touch_link(lctx.Logger, destfile, modtime)
     //os.Chtimes(destfile, modtime, modtime)
-    return lmirror_file, nil
+    return outputs, nil
 }
 
-func lmirror_plugin_transzip(fw *FTPWatcher, watch_data map[string]interface{}, destfile, lmirror_file string, opts ...interface{}) (string,error) {
-    fi, _ := os.Lstat(destfile)
-    modtime := fi.ModTime()
-    if lmirror_file == "" {
-		// transpath did not run
-		newdestfile, err1 := compresstype.Convert(destfile, watch_data["lmirror_zip_fmt"].(string))
-		if err1 != nil {
-			watch_data["logger"].(*log.Logger).Println(
-				"transzip plugin error : Cannot convert type of ", destfile, "to", watch_data["lmirror_zip_fmt"].(string), "Error : ", err1)
-			//fmt.Println(err1)
-			return destfile, err1
-		}
-		// err2 := os.Rename(newdestfile, destfile)
-		// if err2 != nil {
-		//     watch_data["logger"].(*log.Logger).Println("transzip plugin error : Cannot rename", newdestfile, "to", destfile)
-		//     return newdestfile, err2
-		// }
-		// os.Chtimes(destfile, modtime, modtime)
-		err2 := os.Symlink(newdestfile, destfile)
-		if err2 != nil {
-			watch_data["logger"].(*log.Logger).Println("Cannot create symlink ", destfile, "to", newdestfile)
-			return newdestfile, err2
-		}
-		os.Chtimes(newdestfile, modtime, modtime)
-		// Can't use Chtimes for changing timestamp of link
-		fw._parse_run_cmd(destfile, "touch -h -t " + modtime.Format("200601021504.05"), watch_data)
-		return destfile, nil
+func lmirror_plugin_transzip(fw *FTPWatcher, lctx *LmirrorContext) ([]string, error) {
+    destfile, infile := lctx.Destfile, lctx.Infile
+    fi, err := os.Stat(infile)
+    if err != nil {
+		lctx.Logger.Println("transzip plugin error : Cannot stat", infile)
+		return nil, err
     }
-    newlmfile, err1 := compresstype.Convert(lmirror_file, watch_data["lmirror_zip_fmt"].(string))
+    modtime := fi.ModTime()
+    is_main := fw.is_lmirror_main(destfile, infile)
+    newfile, err1 := fw.convert_zip(lctx, infile, modtime)
     if err1 != nil {
-		watch_data["logger"].(*log.Logger).Println(
-			"transzip plugin error : Cannot convert type of ", lmirror_file, "to", watch_data["lmirror_zip_fmt"].(string))
-		return lmirror_file, err1
+		lctx.Logger.Println(
+			"transzip plugin error : Cannot convert type of ", infile, "to", lctx.Params["zipfmt"], "Error : ", err1, "- keeping it, sending alert...")
+		doAlert(fmt.Sprintf("subtab=ftpwatcher;level=critical;subject=%s transzip to %s failed for %s;escalate=ops;escalate-minutes1=5;escalate-minutes2=15",
+			short_hostname(), lctx.Params["zipfmt"], lctx.RemotePath))
+		return []string{infile}, err1
     }
-    err2 := os.Remove(destfile)
-    if err2 != nil {
-		watch_data["logger"].(*log.Logger).Println(
-			"transzip plugin error : Cannot remove the link", destfile)
-		return newlmfile, err1
+    if newfile == infile {
+		return []string{infile}, nil
     }
-    err3 := os.Symlink(newlmfile, destfile)
-    if err3 != nil {
-		watch_data["logger"].(*log.Logger).Println(
-			"transzip plugin error : Cannot create link", destfile, "->", newlmfile)
-		return newlmfile, err1
+    if is_main == true {
+		if err2 := relink_lmirror_main(lctx.Logger, destfile, newfile, modtime); err2 != nil {
+			lctx.Logger.Println(
+				"transzip plugin error : Cannot create link", destfile, "->", newfile)
+			return []string{newfile}, err2
+		}
     }
-    //os.Chtimes(destfile, modtime, modtime)
-    fw._parse_run_cmd(destfile, "touch -h -t " + modtime.Format("200601021504.05"), watch_data)
-    os.Chtimes(newlmfile, modtime, modtime)
-    return newlmfile, nil
+    if lctx.Params["zip_keep_original"] != "1" && infile != destfile {
+		os.Remove(infile)
+    }
+    return []string{newfile}, nil
 }
 
-func lmirror_plugin_transpath(fw *FTPWatcher, watch_data map[string]interface{}, destfile, lmirror_file string, opts ...interface{}) (string,error) {
-    fi, _ := os.Stat(destfile)
+func lmirror_plugin_transpath(fw *FTPWatcher, lctx *LmirrorContext) ([]string, error) {
+    infile := lctx.Infile
+    fi, err := os.Stat(infile)
+    if err != nil {
+		lctx.Logger.Println("transpath plugin error : Cannot stat", infile)
+		return nil, err
+    }
     modtime := fi.ModTime()
-    lm_path := watch_data["lmirror_path_fmt"].(string)
-    lm_path = strings.Replace(lm_path, "__CURDATE__", modtime.Format("20060102"), -1)
-    lm_path = strings.Replace(lm_path, "__CURDIR__", watch_data["curdir"].(string), -1)
-    lm_path = strings.Replace(lm_path, "__SUNDAY__", modtime.AddDate(0, 0, -int(modtime.Weekday())).Format("20060102"), -1)
-    r := regexp.MustCompile("[12][90][0-9][0-9][01][0-9][0123][0-9]")
-    nominal_date_dir := ""
-    if r.MatchString(destfile) == true {
-		nominal_date_dir = r.FindString(destfile)
-    } else {
-		nominal_date_dir = modtime.Format("undated/20060102")
+    lm_path, err := lctx.expand_param("lmirror_path_format", infile, modtime, nil, nil)
+    if err != nil {
+		lctx.Logger.Println("transpath plugin error :", err)
+		return []string{infile}, err
     }
-    lm_path = strings.Replace(lm_path, "__NOMINAL_DATE__", nominal_date_dir, -1)
 
-    dst := ""
-    if fw.makedir( lm_path, fw._default_permission, watch_data) == false {
-		watch_data["logger"].(*log.Logger).Println("transpath plugin error : Cannot make lmirror_dir = ", lm_path)
-		return destfile, errors.New("Cannot make lmirror_dir = " + lm_path)
-    } else {
-		_, fname := path.Split(destfile)
-		dst = path.Join(lm_path, fname)
-		_, err := os.Stat(dst)
-		if err == nil {
-			old := dst + ".old"
-			os.Remove(old)
-			watch_data["logger"].(*log.Logger).Println("transpath: ALERT :", dst, "exists, taking a backup before overwriting.")
-			os.Rename(dst, old)
-		}
-		//os.Remove(dst)
-		_, err = CopyFile(dst, destfile)
-		if err != nil {
-			watch_data["logger"].(*log.Logger).Printf("transpath plugin error : Cannot copy %s to %s\n", destfile, dst)
-			return destfile, err
-		}
-		err = os.Remove(destfile)
-		if err != nil {
-			watch_data["logger"].(*log.Logger).Printf("transpath plugin error : Cannot remove %s\n", destfile)
-			return destfile, err
-		}
-		err = os.Symlink(dst, destfile)
-		if err != nil {
-			watch_data["logger"].(*log.Logger).Printf("transpath plugin error : Cannot create symlink %s->%s\n", destfile, dst)
-			return dst, err
-		}
-		//os.Chtimes(destfile, modtime, modtime)
-		fw._parse_run_cmd(destfile, "touch -h -t " + modtime.Format("200601021504.05"), watch_data)
-		watch_data["logger"].(*log.Logger).Println("transpath : finished running touch -h -t on", destfile, "Now changing timestamp of", dst)
-		os.Chtimes(dst, modtime, modtime)
-		watch_data["logger"].(*log.Logger).Println("transpath : Finished changing timestamp of", dst)
+    dst, err := fw.place_lmirror_file(lctx, "transpath", infile, lm_path, modtime)
+    if err != nil {
+		return []string{infile}, err
     }
-
-    return dst, nil
+    return []string{dst}, nil
 }
 
-func lmirror_plugin_adaptive_transpath(fw *FTPWatcher, watch_data map[string]interface{}, destfile, lmirror_file string, opts ...interface{}) (string,error) {
-    fi, _ := os.Stat(destfile)
+func lmirror_plugin_adaptive_transpath(fw *FTPWatcher, lctx *LmirrorContext) ([]string, error) {
+    destfile, infile := lctx.Destfile, lctx.Infile
+    fi, err := os.Stat(infile)
+    if err != nil {
+		lctx.Logger.Println("adaptive-transpath plugin error : Cannot stat", infile)
+		return nil, err
+    }
     modtime := fi.ModTime()
-    t1 := opts[0].(time.Time)
-    t2 := opts[1].(time.Time)
-    lm_path_orig := watch_data["lmirror_path_fmt"].(string)
-    lm_path_orig = strings.Replace(lm_path_orig, "__CURDATE__", modtime.Format("20060102"), -1)
-    lm_path_orig = strings.Replace(lm_path_orig, "__CURDIR__", watch_data["curdir"].(string), -1)
-    lm_path_orig = strings.Replace(lm_path_orig, "__SUNDAY__", modtime.AddDate(0, 0, -int(modtime.Weekday())).Format("20060102"), -1)
-    lm_path := ""
-    lm_path_old := ""
-    lm_path_new := ""
-    meta := destfile + ".meta"
-    _, err := os.Stat(meta)
-    oldperiod := ""
-    period := ""
-    var ccfg *qcfg.CfgBlock = nil
-    if err == nil {
-		// Metafile exists
-		ccfg = qcfg.NewCfg(meta, meta, false)
-		oldperiod = ccfg.Str("ftpwatcher", "file", "periodicity", "")
-		watch_data["logger"].(*log.Logger).Println("Old period for ", destfile, "is", oldperiod)
-    }    
-    if t1.IsZero() {
-		// This is the first download
-		lm_path = lm_path_orig
-    } else {
-		lm_path_new_daily := path.Join(lm_path_orig, t2.Format("20060102"))
-		lm_path_old_daily := path.Join(lm_path_orig, t1.Format("20060102"))
-		lm_path_new_weekly := path.Join(lm_path_orig, t2.AddDate(0, 0, -int(t2.Weekday())).Format("20060102"))
-		lm_path_old_weekly := path.Join(lm_path_orig, t1.AddDate(0, 0, -int(t1.Weekday())).Format("20060102"))
-		if t2.Weekday() == time.Sunday {
-			lm_path_new_weekly = path.Join(lm_path_orig, t2.AddDate(0, 0, -7).Format("20060102"))
-		}
-		if t1.Weekday() == time.Sunday {
-			lm_path_old_weekly = path.Join(lm_path_orig, t1.AddDate(0, 0, -7).Format("20060102"))
-		}
-		lm_path_new_monthly := path.Join(lm_path_orig, t2.Format("200601"))
-		lm_path_old_monthly := path.Join(lm_path_orig, t1.Format("200601"))
-
-		if err != nil {
-			// No metafile 
-			ccfg = qcfg.NewCfgMem(meta)
-		}
-		timediff := t2.Sub(t1)
-		if timediff < 2*24*time.Hour {
-			//Daily update cycle
-			lm_path_new = lm_path_new_daily
-			lm_path_old = lm_path_old_daily
-			period = "daily"
-			if oldperiod == "weekly" {
-				period = "weekly"
-				lm_path_new = lm_path_new_weekly
-				lm_path_old = lm_path_old_weekly
-				watch_data["logger"].(*log.Logger).Println("adaptive transpath plugin has detected daily update cycle for", destfile, "but using old period weekly")
-			} else if oldperiod == "monthly" {
-				period = "monthly"
-				lm_path_new = lm_path_new_monthly
-				lm_path_old = lm_path_old_monthly
-				watch_data["logger"].(*log.Logger).Println("adaptive transpath plugin has detected daily update cycle for", destfile, "but using old period monthly")
-			} else {
-				watch_data["logger"].(*log.Logger).Println("adaptive transpath plugin has detected daily update cycle for", destfile)
-			}
-		} else if timediff < 8*24*time.Hour {
-			// Weekly update cycle
-			lm_path_new = lm_path_new_weekly
-			lm_path_old = lm_path_old_weekly
-			period = "weekly"
-            if oldperiod == "monthly" {
-				period = "monthly"
-				lm_path_new = lm_path_new_monthly
-                lm_path_old = lm_path_old_monthly
-				watch_data["logger"].(*log.Logger).Println("adaptive transpath plugin has detected weekly update cycle for", destfile, "but using old period monthly")
-            } else {
-				watch_data["logger"].(*log.Logger).Println("adaptive transpath plugin has detected weekly update cycle for", destfile)
-			}
-		} else if timediff < 2*31*24*time.Hour {
-			// Monthly update cycle
-			period = "monthly"
-			lm_path_new = lm_path_new_monthly
-			lm_path_old = lm_path_old_monthly	    
-			watch_data["logger"].(*log.Logger).Println("adaptive transpath plugin has detected monthly update cycle for", destfile)
-		}
-		ccfg.EditEntry("ftpwatcher", "file", "periodicity", period)
-		ccfg.CfgWrite(meta)
-		lm_path = lm_path_new
-		_, fname := path.Split(destfile)
+    t1 := lctx.PreviousMtime
+    t2 := lctx.RemoteMtime
+    lm_path_orig, err := lctx.expand_param("lmirror_path_format", infile, modtime, nil, nil)
+    if err != nil {
+		lctx.Logger.Println("adaptive-transpath plugin error :", err)
+		return []string{infile}, err
+    }
+    // Both checked when the cfg was loaded
+    periods, _ := parse_adaptive_periods(lctx.Params["adaptive_periods"])
+    history, _ := strconv.Atoi(lctx.Params["adaptive_history"])
+
+    pm := read_period_meta(destfile + ".meta")
+    oldperiod := pm.period
+    if len(pm.arrivals) == 0 {
+		// Meta file from before the arrival history was kept
+		pm.add_arrival(t1, history)
+    }
+    pm.add_arrival(t2, history)
+    period := oldperiod
+    if pm.pinned == false {
+		if detected := classify_arrivals(pm.arrivals, periods); detected != "" {
+			period = detected
+		}
+    }
+    lctx.Logger.Println("adaptive transpath plugin : period of", destfile, "is", period,
+		"from", len(pm.arrivals), "arrivals, was", oldperiod)
+    if oldperiod != "" && period != oldperiod {
+		fw.record_period_change(lctx.Logger, lctx.state, destfile, oldperiod, period)
+    }
+    pm.period = period
+    pm.write()
+
+    lm_path := lm_path_orig
+    if t1.IsZero() == false && period != "" {
+		lm_path = path.Join(lm_path_orig, _ADAPTIVE_PERIOD_DIRS[period](t2))
+		lm_path_old := path.Join(lm_path_orig, _ADAPTIVE_PERIOD_DIRS[period](t1))
+		// The first download was placed before its period was known
+		fname := path.Base(infile)
 		_, err1 := os.Stat(path.Join(lm_path_orig, fname))
 		_, err2 := os.Stat(path.Join(lm_path_old, fname))
 		if err1 == nil && err2 != nil {
-			if fw.makedir(lm_path_old, fw._default_permission, watch_data) == false {
-				watch_data["logger"].(*log.Logger).Println("adaptive-transpath plugin error : Cannot make lm_path_old = ", lm_path_old)
+			if lctx.make_dir(lm_path_old, fw._default_permission) == false {
+				lctx.Logger.Println("adaptive-transpath plugin error : Cannot make lm_path_old = ", lm_path_old)
 			}
-			_, err := CopyFile(path.Join(lm_path_old, fname), path.Join(lm_path_orig, fname))
+			_, err := place_file(path.Join(lm_path_orig, fname), path.Join(lm_path_old, fname), t1, false, lctx.Params["fsync"] == "1")
 			if err != nil {
-				watch_data["logger"].(*log.Logger).Printf("adaptive-transpath plugin error : Cannot copy %s to %s\n", path.Join(lm_path_orig, fname), path.Join(lm_path_old, fname))
-            } else {
-				err = os.Remove(path.Join(lm_path_orig, fname))
-				if err != nil {
-					watch_data["logger"].(*log.Logger).Printf("adaptive-transpath plugin error : Cannot remove %s\n", path.Join(lm_path_orig, fname))
-				}
-				os.Chtimes(path.Join(lm_path_old, fname), t1, t1)
+				lctx.Logger.Printf("adaptive-transpath plugin error : Cannot move %s to %s\n", path.Join(lm_path_orig, fname), path.Join(lm_path_old, fname))
 			}
-			
 		}
     }
-    dst := ""
-    if fw.makedir( lm_path, fw._default_permission, watch_data) == false {
-		watch_data["logger"].(*log.Logger).Println("adaptive-transpath plugin error : Cannot make lmirror_dir = ", lm_path)
-		return destfile, errors.New("Cannot make lmirror_dir = " + lm_path)
-    } else {
-		_, fname := path.Split(destfile)
-		dst = path.Join(lm_path, fname)
-		_, err := os.Stat(dst)
-		if err == nil {
-			old := dst + ".old"
-			os.Remove(old)
-			watch_data["logger"].(*log.Logger).Println("adaptive-transpath: ALERT :", dst, "exists, taking a backup before overwriting.")
-			os.Rename(dst, old)
-		}
-		_, err = CopyFile(dst, destfile)
-		if err != nil {
-			watch_data["logger"].(*log.Logger).Printf("adaptive-transpath plugin error : Cannot copy %s to %s\n", destfile, dst)
-			return destfile, err
-		}
-		err = os.Remove(destfile)
-		if err != nil {
-			watch_data["logger"].(*log.Logger).Printf("adaptive-transpath plugin error : Cannot remove %s\n", destfile)
-			return destfile, err
-		}
-		err = os.Symlink(dst, destfile)
-		if err != nil {
-			watch_data["logger"].(*log.Logger).Printf("adaptive-transpath plugin error : Cannot create symlink %s->%s\n", destfile, dst)
-			return dst, err
-		}
-		//os.Chtimes(destfile, modtime, modtime)
-		fw._parse_run_cmd(destfile, "touch -h -t " + modtime.Format("200601021504.05"), watch_data)
-		os.Chtimes(dst, modtime, modtime)
-		//fmt.Println(modtime)
+    dst, err := fw.place_lmirror_file(lctx, "adaptive-transpath", infile, lm_path, modtime)
+    if err != nil {
+		return []string{infile}, err
     }
+    return []string{dst}, nil
+}
 
-    return dst, nil
+func (fw *FTPWatcher) register_builtin_plugins() {
+    fw.register_lmirror_func("transpath", lmirror_plugin_function(lmirror_plugin_transpath))
+    fw.register_lmirror_func("adaptive-transpath", lmirror_plugin_function(lmirror_plugin_adaptive_transpath))
+    fw.register_lmirror_func("transzip", lmirror_plugin_function(lmirror_plugin_transzip))
+    fw.register_lmirror_func("split", lmirror_plugin_function(lmirror_plugin_split))
+    fw.register_lmirror_func("exec", external_plugin{})
+    fw.register_lmirror_func("extract", lmirror_plugin_function(lmirror_plugin_extract))
+    fw.register_lmirror_func("decrypt", lmirror_plugin_function(lmirror_plugin_decrypt))
 }
 
-func (fw *FTPWatcher) register_lmirror_func(name string, lmirror_plugin_func lmirror_plugin_function) {
-    fw.lmirror_plugins[name] = lmirror_plugin_func
+func (fw *FTPWatcher) register_lmirror_func(name string, lmirror_plugin LmirrorPlugin) {
+    fw.lmirror_plugins[name] = lmirror_plugin
 }
 
-func (fw *FTPWatcher) check_lmirror_cfg_parms() {
-    // watchData["use_lmirror_plugins"] = lmirror_plugins_to_use
-    // watchData["lmirror_path_fmt"] = lmirror_path_fmt
-    // watchData["lmirror_zip_fmt"] = lmirrot_zip_fmt
-    // watchData["lmirror_split_cmd"] = lmirror_split_cmd
-    for _,watch_data := range fw.watchers {
-		
-		if watch_data["use_lmirror_plugins"] == "" || watch_data["use_lmirror_plugins"] == nil {
-			watch_data["use_lmirror_plugins"] = nil
-			continue
+func (fw *FTPWatcher) check_lmirror_cfg_parms(watchers []map[string]interface{}) bool {
+    /*
+     Checks every lmirror stage, returns false if a stage names an unknown
+     plugin or lacks a required parameter. Running the stages after it
+     would give them inputs they were never configured for, so such a
+     block must not start.
+     */
+    ok := true
+    for _,watch_data := range watchers {
+		for _, stage := range block_config(watch_data).Stages {
+			if err := fw.check_lmirror_stage(stage); err != nil {
+				block_rt(watch_data).logger.Println("Configuration error in", _CONFIG_LMIRROR_ROW, ":", err)
+				ok = false
+			}
 		}
+    }
+    return ok
+}
 
-		use_plugins := make(map[string]bool)
-		for _, plugin := range watch_data["use_lmirror_plugins"].([]string) {
-			use_plugins[plugin] = false
-			if _, exists := fw.lmirror_plugins[plugin]; exists == false {
-				watch_data["logger"].(*log.Logger).Printf("Error : No lmirror plugin called %s available.\n", plugin)
-			} 
-			if plugin == "transpath" || plugin == "split" {
-				if watch_data["lmirror_path_fmt"] == "" {
-					watch_data["logger"].(*log.Logger).Println(
-						"Error: No lmirror_path_fmt option in cfg with plugin", plugin)
-				} else {
-					if plugin == "split" && watch_data["lmirror_split_cmd"] == "" {
-						watch_data["logger"].(*log.Logger).Println(
-							"Error: No lmirror_split_cmd option in cfg with plugin", plugin)
-					} else {
-						use_plugins[plugin] = true
-					}
-				}
-			} else {
-				use_plugins[plugin] = true
-			}
+func (fw *FTPWatcher) check_lmirror_stage(stage *lmirror_stage) error {
+    /*
+     Checks that the plugin of stage exists and that its parameters are usable
+     */
+    if _, exists := fw.lmirror_plugins[stage.Plugin]; exists == false {
+		return fmt.Errorf("No lmirror plugin called %s available", stage.Plugin)
+    }
+    if stage.Plugin == "transpath" || stage.Plugin == "adaptive-transpath" || stage.Plugin == "split" {
+		if stage.Params["lmirror_path_format"] == "" {
+			return fmt.Errorf("No lmirror_path_format option in cfg with plugin %s", stage.Label)
+		}
+    }
+    if stage.Plugin == "split" && stage.Params["split_cmd"] == "" {
+		return fmt.Errorf("No split_cmd option in cfg with plugin %s", stage.Label)
+    }
+    if stage.Plugin == "exec" && stage.Params["plugin_cmd"] == "" {
+		return fmt.Errorf("No plugin_cmd option in cfg with plugin %s", stage.Label)
+    }
+    if _, err := parse_collision_policy(stage.Params["collision_policy"]); err != nil {
+		return fmt.Errorf("Bad collision_policy in cfg with plugin %s : %v", stage.Label, err)
+    }
+    if stage.Plugin == "adaptive-transpath" {
+		_, err1 := parse_adaptive_periods(stage.Params["adaptive_periods"])
+		_, err2 := strconv.Atoi(stage.Params["adaptive_history"])
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("Bad adaptive_periods or adaptive_history in cfg with plugin %s : %v %v", stage.Label, err1, err2)
+		}
+    }
+    if stage.Plugin == "transzip" {
+		if err := check_transzip_params(stage.Params); err != nil {
+			return fmt.Errorf("Bad transzip option in cfg with plugin %s : %v", stage.Label, err)
 		}
-		watch_data["use_lmirror_plugins"] = use_plugins
     }
+    if err := check_stage_templates(stage); err != nil {
+		return fmt.Errorf("Bad template in cfg with plugin %s : %v", stage.Label, err)
+    }
+    if stage.Plugin == "decrypt" && stage.Params["decrypt_keyring"] == "" {
+		return fmt.Errorf("No decrypt_keyring option in cfg with plugin %s", stage.Label)
+    }
+    return nil
 }
 
 func (fw *FTPWatcher) write_json_file() {
-    fp, _ := os.OpenFile(fw.__json_file, os.O_CREATE | os.O_WRONLY | os.O_TRUNC, 0666)
+    if fw.daemon == false {
+		// The JSON file belongs to the daemon of this instance
+		return
+    }
+    fw.jsondata_mu.Lock()
     out, _ := json.Marshal(fw.jsondata)
+    fw.jsondata_mu.Unlock()
+    fp, _ := os.OpenFile(fw.__json_file, os.O_CREATE | os.O_WRONLY | os.O_TRUNC, 0666)
     fp.Write(out)
     fp.Close()
 }
 
+func (fw *FTPWatcher) update_json(update func(data map[string]interface{})) {
+    /*
+     Runs update on the data of the JSON file, holding its lock
+     */
+    fw.jsondata_mu.Lock()
+    defer fw.jsondata_mu.Unlock()
+    update(fw.jsondata[0])
+}
+
 func (fw *FTPWatcher) _start_warn_scheduler( watchers []map[string]interface{} ) {
     /*
      Start warn scheduler thread for all watchers
      */
     for _, watch_data := range watchers {
-		warn_time, exists := watch_data["warn_time"]
-		if exists == true && warn_time != "" {
-			watch_data["logger"].(*log.Logger).Println("Starting warn scheduler")
-			warn_in_q := watch_data["warn_in_q"].(chan work)
+		if block_config(watch_data).WarnTime.Set {
+			block_rt(watch_data).logger.Println("Starting warn scheduler")
+			block_rt(watch_data).warns.Add(1)
+			warn_in_q := block_rt(watch_data).warn_in
 			fw._start_threads(warn_in_q, 1)
 			fw._add_work_to_chan(watch_data, warn_in_q, warn_scheduler)
 		}
@@ -637,34 +651,57 @@ func (fw *FTPWatcher) _add_work_to_chan(watch_data map[string]interface{}, in_q
     in_q<-*work_ptr
 }
 
+func (fw *FTPWatcher) _add_work_to_queue(watch_data map[string]interface{}, q *work_queue, worker_func worker, opts...interface{}) bool {
+    /*
+     As _add_work_to_chan, returns false if the queue was closed
+     */
+    return q.send(work{worker_func: worker_func, fw: fw, watch_data: watch_data, opt: opts})
+}
+
 func (fw *FTPWatcher) _split_run_cmd(command string) []string {
     /*
-     Splits commands in the case of multiple commands
+     Splits commands in the case of multiple commands, at separators
+     that are not quoted or escaped
      */
-    return strings.Split(command, fw._command_separator)
+    commands, _, err := tokenize_commands(command, []rune(fw._command_separator)[0])
+    if err != nil {
+		// Reported when the command is run or checked
+		return []string{command}
+    }
+    return commands
 }
 
 func (fw *FTPWatcher) _parse_run_cmd(filepath, command string, watch_data map[string]interface{}) (bool, string) {
     /*
      Parses command string and runs command on given filepath
      */
-    parts := strings.Fields(command)
-    env := []string{}
-    cmd := []string{}
-    for _, part := range parts {
-		if strings.Index(part, "=") != -1 {
-			env = append(env, part)
-		} else {
-			cmd = append(cmd, part)
+    result := fw.run_command(watch_data, command, command_vars{File: filepath})
+    if result.Err != nil {
+		return false, result.Err.Error() + " " + result.Stderr
+    }
+    return true, result.Stdout
+}
+
+func (fw *FTPWatcher) run_commands(watch_data map[string]interface{}, commands, what string, cv command_vars) error {
+    /*
+     Runs the ^ separated commands in turn on cv.File, stopping at the
+     first failure, whose error is returned
+     */
+    logger := block_rt(watch_data).logger
+    for _, command := range fw._split_run_cmd(commands) {
+		result := fw.run_command(watch_data, command, cv)
+		if result.Stdout != "" {
+			logger.Printf("%s stdout for %s :\n%s\n", what, cv.File, result.Stdout)
+		}
+		if result.Stderr != "" {
+			logger.Printf("%s stderr for %s :\n%s\n", what, cv.File, result.Stderr)
+		}
+		if result.Err != nil {
+			logger.Printf("%s exited with failure on %s : %v\n", what, cv.File, result.Err)
+			return result.Err
 		}
     }
-    cmd = append(cmd, filepath)
-    watch_data["logger"].(*log.Logger).Printf("Running cmd %s with ENV args %v\n", command, env)
-    c := exec.Command(cmd[0], cmd[1:]...)
-    c.Env = env
-    out, _ := c.CombinedOutput()
-    success := c.ProcessState.Success()
-    return success, string(out)
+    return nil
 }
 
 func (fw *FTPWatcher) warn_checker(filepath, warn_cmd string, watch_data map[string]interface{}) (bool) {
@@ -672,24 +709,14 @@ func (fw *FTPWatcher) warn_checker(filepath, warn_cmd string, watch_data map[str
      Run warn_cmd on filepath and return True/False
      on command success or failure respectively
      */
-    for _, command := range fw._split_run_cmd(warn_cmd) {
-		success, stderr := fw._parse_run_cmd(filepath, command, watch_data)
-
-		if success == false {
-			watch_data["logger"].(*log.Logger).Printf(
-				"Scheduled warn command has exited with failure.\n%s - filepath %s\n",
-				stderr, filepath)
-			return false
-		}
-    }
-    return true
+    return fw.run_commands(watch_data, warn_cmd, "Scheduled warn command", command_vars{File: filepath}) == nil
 }
 
 func (fw *FTPWatcher) mailer(recp string, watch_data map[string]interface{}, subject, body, key string) {
     /*
      Sent Email
      */
-    watch_data["logger"].(*log.Logger).Printf("Sending warn alert email : %s\n", subject)
+    block_rt(watch_data).logger.Printf("Sending warn alert email : %s\n", subject)
     /*
      TODO
      */
@@ -699,33 +726,34 @@ func warn_scheduler(fw *FTPWatcher, watch_data map[string]interface{}, tid int,
     /*
      Scheduler for running warn_cmd
      */
+    defer block_rt(watch_data).warns.Done()
     for {
-		tz, exists := watch_data["tz"]
-		now := time.Now()
-		if exists && (tz!="") {
-			now = fw._convert_local_timezone(time.Now(), watch_data["tz"].(string))
-		}
-		wt := watch_data["warn_time"].(time.Time)
-		warn_time := time.Date(now.Year(), now.Month(), now.Day(), wt.Hour(), wt.Minute(), wt.Second(), 0, now.Location())
+		now := time.Now().In(block_config(watch_data).location())
+		warn_time := block_config(watch_data).WarnTime.On(now)
 		if now.After(warn_time) {
 			// We are past today's warn time
 			wt1 := warn_time.AddDate(0, 0, 1) // Next warn time
 			sleep_duration := wt1.Sub(now)
-			watch_data["logger"].(*log.Logger).Printf("Next warn_time is %s. Sleeping for %s\n", wt1, sleep_duration)
-			time.Sleep(sleep_duration) // Sleep till then
+			block_rt(watch_data).logger.Printf("Next warn_time is %s. Sleeping for %s\n", wt1, sleep_duration)
+			warn_time = wt1
 		} else {
 			sleep_duration := warn_time.Sub(now)
-			watch_data["logger"].(*log.Logger).Printf("Next warn_time is %s. Sleeping for %s\n", warn_time, sleep_duration)
-			time.Sleep(sleep_duration)
-		}
-		if fw.warn_checker(watch_data["dest"].(string), watch_data["warn_cmd"].(string), watch_data) == false {
-			watch_data["logger"].(*log.Logger).Println("Warn cmd(s) ended with failure - running warn alert")
-			fw.mailer(watch_data["warn_alert_recp"].(string), watch_data,
-				watch_data["warn_alert_subj"].(string),
-				watch_data["warn_alert_body"].(string),
+			block_rt(watch_data).logger.Printf("Next warn_time is %s. Sleeping for %s\n", warn_time, sleep_duration)
+		}
+		select {
+		case <-block_rt(watch_data).ctx.Done():
+			block_rt(watch_data).logger.Println("Block stopped, exiting warn scheduler")
+			return
+		case <-time.After(warn_time.Sub(now)): // Sleep till then
+		}
+		if fw.warn_checker(block_config(watch_data).Dest, block_config(watch_data).WarnCmd, watch_data) == false {
+			block_rt(watch_data).logger.Println("Warn cmd(s) ended with failure - running warn alert")
+			fw.mailer(block_config(watch_data).AlertRecipient, watch_data,
+				block_config(watch_data).AlertSubject,
+				block_config(watch_data).AlertBody,
 				"warn_alert")
 		} else {
-			watch_data["logger"].(*log.Logger).Println("Warn cmd(s) finished successfully")
+			block_rt(watch_data).logger.Println("Warn cmd(s) finished successfully")
 		}
     }
 }
@@ -738,24 +766,42 @@ func (fw *FTPWatcher) _write_pid_file() {
 }
 
 func (fw *FTPWatcher) _setup_signal_handling() {
-    // capture ctrl+c and log the info
-    c := make(chan os.Signal, 1)
-    signal.Notify(c, os.Interrupt, os.Kill)
+    // capture ctrl+c, SIGTERM and SIGQUIT and shut down gracefully, a second signal exits at once
+    c := make(chan os.Signal, 2)
+    signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
     go func() {
-		for sig := range c {
-			os.Stdout.WriteString(fmt.Sprintf("Captured %v, stopping ftpwatcher and exiting..\n", sig))
+		sig := <-c
+		os.Stdout.WriteString(fmt.Sprintf("Captured %v, stopping ftpwatcher and exiting..\n", sig))
+		go func() {
+			sig := <-c
+			os.Stdout.WriteString(fmt.Sprintf("Captured %v again, exiting now\n", sig))
 			fw.quit_signal_handler(sig)
-			os.Exit(0)
-		}
+			os.Exit(1)
+		}()
+		fw.shutdown(sig)
+		os.Exit(0)
     }()    
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+		for _ = range hup {
+			os.Stdout.WriteString(fw.reload())
+		}
+    }()
 }
 
 func (fw *FTPWatcher) quit_signal_handler(sig os.Signal) {
-    for _, watch_data := range fw.watchers {
-		watch_data["logger"].(*log.Logger).Printf("Got signal %v, exiting" , sig)
+    for _, watch_data := range fw.get_watchers() {
+		block_rt(watch_data).logger.Printf("Got signal %v, exiting" , sig)
+    }
+    if fw.daemon == false {
+		// The json and stats files belong to the daemon of this instance
+		return
     }
-    old := fw.jsondata[0]["ftpwatcher"].(FtpWatcherInfo)
-    fw.jsondata[0]["ftpwatcher"] = FtpWatcherInfo{old.RunStart, time.Now().Format("20060102 15:04:05")}
+    fw.update_json(func(data map[string]interface{}) {
+		old, _ := data["ftpwatcher"].(FtpWatcherInfo)
+		data["ftpwatcher"] = FtpWatcherInfo{old.RunStart, time.Now().Format("20060102 15:04:05")}
+    })
     fw.write_json_file()
     fw.write_stats_file()
 }
@@ -793,223 +839,97 @@ func (fw *FTPWatcher) _start_threads(in_q chan work, thread_no int) {
     }
 }
 
-func (fw *FTPWatcher) _check_alert( watch_data map[string]interface{} ) bool {
-    /*
-     Check warn-alert email settings
-     */
-    warn_alert_recp, exists1 := watch_data["warn_alert_recp"]
-    warn_alert_subj, exists2 := watch_data["warn_alert_subj"]
-    warn_alert_body, exists3 := watch_data["warn_alert_body"]
-    if !(exists1 && exists2 && exists3 && (warn_alert_body!="") &&
-		(warn_alert_subj!="") && (warn_alert_recp!="")) {
-		return false
-    }
-    return true
-}
-
 func parseInt(num string) (n int, err error) {
     x, err := strconv.ParseInt(num, 10, 32)
     n = int(x)
     return
 }
 
-func (fw *FTPWatcher) _parse_time(timestr string, today time.Time, _logger *log.Logger) (time.Time, error) {
-    /*
-     Parse timestr and return Time object
-     */
-    if len(timestr) != 6 {
-		_logger.Println(timestr, "does not look like a valid timestamp!")
-		return time.Now(), errors.New("Not a valid timestamp")
-    }
-    hour, err1 := parseInt(timestr[0:2])
-    minutes, err2 := parseInt(timestr[2:4])
-    seconds, err3 := parseInt(timestr[4:6])
-    if err1!=nil || err2!=nil || err3!=nil {
-		_logger.Println(timestr, "does not look like a valid timestamp!")
-		return time.Now(), errors.New("Not a valid timestamp")
-    }
-    if !( hour<24 && hour>=0 && minutes<60 && minutes>=0 && seconds<60 && seconds>=0 ) {
-		_logger.Println(timestr, "does not look like a valid timestamp!")
-		return time.Now(), errors.New("Not a valid timestamp")
-    }
-    return time.Date(today.Year(), today.Month(), today.Day(), hour, minutes, seconds, 0, today.Location()), nil
-}
-
-func (fw *FTPWatcher) _check_scheduler( watch_data map[string]interface{} ) bool {
-    /*
-     Checks and parses scheduler settings
-     returns None on error
-     */
-    start_time, exist := watch_data["start_time"]
-    if exist && (start_time!="") {
-		st, err := fw._parse_time(start_time.(string),
-			watch_data["today"].(time.Time),
-			watch_data["logger"].(*log.Logger))
-		if err == nil {
-			watch_data["start_time"] = st
-		} else {
-			return false
-		}
-    } else {
-		return false
-    }
-    
-    end_time, exists := watch_data["end_time"]
-    if !(exists && (end_time!="")) {
-		watch_data["logger"].(*log.Logger).Println("Scheduler lacking end time setting, exiting.")
-		return false
-    }
-    et, err := fw._parse_time(end_time.(string),
-		watch_data["today"].(time.Time),
-		watch_data["logger"].(*log.Logger))
-    
-    if err == nil {
-		watch_data["end_time"] = et
-    } else {
-		return false
-    }
-    warn_time, exists := watch_data["warn_time"]
-    if exists && (warn_time != "") {
-		warn_cmd, exists := watch_data["warn_cmd"]
-		if !(exists && (warn_cmd != "")) {
-			watch_data["logger"].(*log.Logger).Println("Warn time with no warn_cmd setting.")
-			return false
-		} else if fw._check_alert(watch_data) == false {
-			watch_data["logger"].(*log.Logger).Println("Configuration error - Warn time with no warn-alert email settings.")
-			return false
-		}
-		wt, err := fw._parse_time(warn_time.(string),
-			watch_data["today"].(time.Time),
-			watch_data["logger"].(*log.Logger))
-		if err == nil {
-			watch_data["warn_time"] = wt
-		} else {
-			return false
-		}
-    }
-    return true
-}
-
-func (fw *FTPWatcher) _check_watch_data( watches []map[string]interface{} ) bool {
+func (fw *FTPWatcher) _check_watch_data( watches []map[string]interface{}, running map[string]map[string]interface{} ) bool {
     /*
      Goes through all watch data and creates loggers, ftp server objects and
-     logs in to each ftp server.
+     logs in to each ftp server. running has the blocks already running by
+     name, that the watch data replaces on reload. On failure the runtimes
+     made so far are discarded.
      */
+    ok := false
+    defer func() {
+		if ok == false {
+			fw.discard_runtimes(watches)
+		}
+    }()
     for _, watch_data := range watches {
-		tz, exists := watch_data["tz"]
-		if exists && (tz != "") {
-			watch_data["today"] = fw._convert_local_timezone(time.Now(), tz.(string))
-		} else {
-			watch_data["today"] = time.Now()
+		cfg := block_config(watch_data)
+		if fw.makedir(cfg.LogDir, fw._default_permission, watch_data) == false {
+			os.Stdout.WriteString(fmt.Sprintf("Could not create log directory %s!\n", cfg.LogDir))
+			return false
 		}
-		server_tz, exists := watch_data["server_tz"]
-		if ! (exists && (server_tz != "")) {
-			watch_data["server_tz"] = nil
+		var prev *block_runtime
+		if old, exists := running[cfg.Name]; exists {
+			prev = block_rt(old)
 		}
+		rt := fw.new_block_runtime(cfg, prev)
+		watch_data["runtime"] = rt
 
-		//Required parameters
-		hostname, exists := watch_data["hostname"]
-		if ! (exists && hostname != "") {
-			os.Stderr.WriteString("No hostname in data !\n")
-			return false
+		fatal := false
+		for _, cerr := range watch_data["config_errors"].([]config_error) {
+			if cerr.Fatal {
+				block_rt(watch_data).logger.Println("Configuration error in", cerr)
+				fatal = true
+			} else {
+				block_rt(watch_data).logger.Println("Configuration warning in", cerr)
+			}
 		}
-		user, exists1 := watch_data["user"]
-		passwd, exists2 := watch_data["passwd"]
-		if !( exists1 && user != "" && exists2 && passwd != "" ) {
-			os.Stderr.WriteString("No username or password in data!\n")
+		if fatal {
+			os.Stderr.WriteString(fmt.Sprintf("Configuration error in block %s, see its log\n", cfg.Name))
 			return false
 		}
-		block_name, _ := watch_data["block_name"]
-		watch_data["log_dir"] = fmt.Sprintf(fw.__log_dir , block_name.(string))
-		if fw.makedir(watch_data["log_dir"].(string), fw._default_permission, watch_data) == false {
-			os.Stdout.WriteString(fmt.Sprintf("Could not create log directory %s!\n", watch_data["log_dir"].(string)))
+		if fw.makedir(cfg.Dest, fw._default_permission, watch_data) == false {
+			block_rt(watch_data).logger.Println("Could not make destination path directory, exiting")
 			return false
 		}
-		debug, exist := watch_data["debug"]
-		watch_data["debug"] = false
-		if exist == true && debug == 1 {
-			watch_data["debug"] = true
-		}
-		watch_data["logger"] = fw._setup_logger(watch_data["debug"].(bool),
-			watch_data["log_dir"].(string),
-			watch_data["block_name"].(string))
-
-		dest, exist := watch_data["dest"]
-		if !(exist && (dest != "")) {
-			watch_data["logger"].(*log.Logger).Println("No destination path specified!")
-			os.Exit(1)
-		}
-		mode, exist := watch_data["mode"]
-		if !(exist && (mode != "")) {
-			watch_data["mode"] = fw.__default_mode
-		}
-		if fw.makedir(watch_data["dest"].(string), fw._default_permission, watch_data) == false {
-			watch_data["logger"].(*log.Logger).Println("Could not make destination path directory, exiting")
-			os.Exit(1)
-		}
-		post_download, exists := watch_data["post_download"]
-		lm, exists1 := watch_data["use_lmirror_plugins"]
-		if (exists && (post_download != "")) || (exists1 && (lm != "")) {
-			if exists == false {
-				watch_data["post_download"] = nil
-			}
-			tn, exists := watch_data["thread_no"]
-			if !(exists && tn!=0) {
+		if cfg.PostDownload != "" || len(cfg.Stages) > 0 {
+			if cfg.ThreadNo == 0 {
 				thread_no = fw._MAX_THREADS
 			} else {
-				thread_no = watch_data["thread_no"].(int)
+				thread_no = cfg.ThreadNo
 			}
 			
-			watch_data["post_process_in_queue"] = make(chan work, 10)
+			rt.post_in = new_work_queue(10)
 			//watch_data['post_process_out_queue'] = make(chan work, 10)
 			
 			//Pre start threads. They will get input from
 			//queue and start executing once queue has data
-			fw._start_threads(watch_data["post_process_in_queue"].(chan work),
+			fw._start_threads(rt.post_in.ch,
 				//watch_data['post_process_out_queue"],
 				thread_no)
-		} else {
-			watch_data["post_download"] = nil
-		}
-		download_check, exists := watch_data["download_check"]
-		if !(exists && (download_check!="")) {
-			watch_data["download_check"] = nil
-		}
-		newer_than_days, exists := watch_data["newer_than_days"]
-		if exists && (newer_than_days != "") {
-			watch_data["newer_than"] = watch_data["today"].(time.Time).AddDate(0, 0, -watch_data["newer_than_days"].(int))
-		} else {
-			watch_data["newer_than"] = nil
-		}
-		proxy_host, exist := watch_data["proxy_host"]
-		if !(exist && (proxy_host!="")) {
-			watch_data["proxy_host"] = fw.__proxy_hostname
 		}
-		skip_patterns, exists := watch_data["skip_patterns"]
-		if exists && (len(skip_patterns.([]string)) > 0) {
-			watch_data["skip_patterns"] = append(watch_data["skip_patterns"].([]string), fw.__skip_patterns...)
-		} else {
-			watch_data["skip_patterns"] = fw.__skip_patterns
-		}
-		if fw._check_scheduler(watch_data) == false {
-			watch_data["logger"].(*log.Logger).Println("Configuration error in scheduler, exiting")
-			//fmt.Println("check_scheduler == false")
-			os.Exit(1)
-		} else {
-			watch_data["warn_in_q"] = make(chan work, 10)
-			//watch_data["warn_out_q"] = make(chan work, 10)
-		}
-		log_new := watch_data["log_dir"].(string) + string(os.PathSeparator) + fw.__log_filename
+		//watch_data["warn_out_q"] = make(chan work, 10)
+		log_new := cfg.LogDir + string(os.PathSeparator) + fw.__log_filename
 		hostn, _ := os.Hostname()
 		hostn = strings.SplitN(hostn, ".", 2)[0]
 		log_new = strings.Replace(log_new, "/data0/logs", "/data0/nfs/logs/" + hostn, 1)
-		fw.jsondata[0][watch_data["blockname"].(string)] = WatchInfo{time.Now().Format("20060102 15:04:05"), 0, "0", "", "", log_new}
+		fw.update_json(func(data map[string]interface{}) {
+			data[cfg.Name] = WatchInfo{time.Now().Format("20060102 15:04:05"), 0, "0", "", "", log_new}
+		})
     }
-    fw.jsondata[0]["ftpwatcher"] = FtpWatcherInfo{time.Now().Format("20060102 15:04:05"), time.Now().Format("20060102 15:04:05")}
-    fw.write_json_file()
+    ok = true
     return true
 }
 
+func (fw *FTPWatcher) discard_runtimes( watches []map[string]interface{} ) {
+    /*
+     Stops the post process threads of blocks that were set up but will
+     not run, and cancels their contexts
+     */
+    for _, watch_data := range watches {
+		if rt, exists := watch_data["runtime"].(*block_runtime); exists {
+			rt.cancel()
+			rt.close_post_process_queue()
+		}
+    }
+}
+
 
 func (fw *FTPWatcher) _setup_error_logging() {
     // Redirects stderr to file
@@ -1030,9 +950,8 @@ func (fw *FTPWatcher) makedir( pathname string, mode os.FileMode, watch_data map
     }
     err := os.MkdirAll(pathname, mode)
     if err != nil {
-		logger, exists := watch_data["logger"]
-		if exists {
-			logger.(*log.Logger).Printf("Could not create the dir %s. Error : %s", pathname, err)
+		if rt, exists := watch_data["runtime"].(*block_runtime); exists {
+			rt.logger.Printf("Could not create the dir %s. Error : %s", pathname, err)
 			return false
 		}
     }
@@ -1050,26 +969,17 @@ func (fw *FTPWatcher) get_schedule(watch_data map[string]interface{}) (start_tim
 	start_time = time.Time{}
 	end_time = time.Time{}
 	now = time.Time{}
-    st, exists1 := watch_data["start_time"]
-    et, exists2 := watch_data["end_time"]
-    tz, exists3 := watch_data["tz"]
-    if !(exists1 && exists2 && (st != nil) && (et != nil)) {
+    cfg := block_config(watch_data)
+    if !(cfg.StartTime.Set && cfg.EndTime.Set) {
 		return
     }
-    now = time.Now()
-    if exists3 && (tz != "") {
-		now = fw._convert_local_timezone(time.Now(), tz.(string))
-    }
-    start_time = st.(time.Time)
-    end_time = et.(time.Time)
-    start_time = time.Date(now.Year(), now.Month(), now.Day(),
-		start_time.Hour(), start_time.Minute(), start_time.Second(), 0, now.Location())
-    end_time = time.Date(now.Year(), now.Month(), now.Day(),
-		end_time.Hour(), end_time.Minute(), end_time.Second(), 0, now.Location())
+    now = time.Now().In(cfg.location())
+    start_time = cfg.StartTime.On(now)
+    end_time = cfg.EndTime.On(now)
 	return
 }
 
-func (fw *FTPWatcher) check_schedule(watch_data map[string]interface{}) {
+func (fw *FTPWatcher) check_schedule(ctx context.Context, watch_data map[string]interface{}) {
     /*
      Check for schedule, wait if not in run period
      */
@@ -1084,103 +994,81 @@ func (fw *FTPWatcher) check_schedule(watch_data map[string]interface{}) {
 		// We are past today's end time
 		st1 := start_time.AddDate(0, 0, 1) // Next warn time
 		sleep_duration := st1.Sub(now)
-		watch_data["logger"].(*log.Logger).Printf("Time now %s not in schedule %s-%s, sleeping until %s\n",
+		block_rt(watch_data).logger.Printf("Time now %s not in schedule %s-%s, sleeping until %s\n",
 			now, st1, end_time.AddDate(0, 0, 1), sleep_duration)
-		time.Sleep(sleep_duration) 
+		fw.sleep_or_trigger(ctx, watch_data, sleep_duration)
     } else if now.Before(start_time) {
 		sleep_duration := start_time.Sub(now)
-		watch_data["logger"].(*log.Logger).Printf("Time now %s not in schedule %s-%s, sleeping until %s\n",
+		block_rt(watch_data).logger.Printf("Time now %s not in schedule %s-%s, sleeping until %s\n",
 			now, start_time, end_time, sleep_duration)
-		time.Sleep(sleep_duration)
+		fw.sleep_or_trigger(ctx, watch_data, sleep_duration)
     }
 
 }
 
 func (fw *FTPWatcher) adjust_stale_time(watch_data map[string]interface{}) {
-    skip_dirRfile_time_staler_than_days, exists := watch_data["skip_dirRfile_time_staler_than_days"]
-    if exists {
-		td := time.Now()
-		tz, exists3 := watch_data["tz"]
-		if exists3 && (tz != "") {
-			td = fw._convert_local_timezone(time.Now(), tz.(string))
-		}
-		watch_data["_skip_dirRfile_time_staler_than_days"] = td.AddDate(0, 0, -skip_dirRfile_time_staler_than_days.(int))
-    } else {
-		watch_data["_skip_dirRfile_time_staler_than_days"] =  nil
-    }
-    skip_file_time_staler_than_days, exists := watch_data["skip_file_time_staler_than_days"]
-    if exists {
-		td := time.Now()
-		tz, exists3 := watch_data["tz"]
-		if exists3 && (tz != "") {
-			td = fw._convert_local_timezone(time.Now(), tz.(string))
-		}
-		watch_data["_skip_file_time_staler_than_days"] = td.AddDate(0, 0, -skip_file_time_staler_than_days.(int))
-		//fmt.Println("_skip_file_time_staler_than_days = ", watch_data["_skip_file_time_staler_than_days"])
-    } else {
-		watch_data["_skip_file_time_staler_than_days"] =  nil
-    }
-    skip_dir_name_staler_than_days, exists := watch_data["skip_dir_name_staler_than_days"]
-    if exists {
-		td := time.Now()
-		tz, exists3 := watch_data["tz"]
-		if exists3 && (tz != "") {
-			td = fw._convert_local_timezone(time.Now(), tz.(string))
-		}
-		watch_data["_skip_dir_name_staler_than_days"] = td.AddDate(0, 0, -skip_dir_name_staler_than_days.(int))
-    } else {
-		watch_data["_skip_dir_name_staler_than_days"] =  nil
-    }
+    cfg := block_config(watch_data)
+    td := time.Now().In(cfg.location())
+    block_rt(watch_data).set_stale_limits(stale_limits{
+		dir_rfile: td.AddDate(0, 0, -cfg.SkipDirRFileStalerThanDays),
+		file:      td.AddDate(0, 0, -cfg.SkipFileStalerThanDays),
+		dir_name:  td.AddDate(0, 0, -cfg.SkipDirNameStalerThanDays),
+    })
 }
 
 func (fw *FTPWatcher) _connect_login_ftp(watch_data map[string]interface{}) bool {
-    use_proxy, exists := watch_data["use_proxy"]
-    hostname := watch_data["hostname"].(string)
-	list_internal_read_timeout := (time.Second*60)
-	if _, ok := watch_data["list_internal_read_timeout"]; ok == true { list_internal_read_timeout = watch_data["list_internal_read_timeout"].(time.Duration) }
-    if !(exists && use_proxy != 0) {
+    cfg := block_config(watch_data)
+    hostname := cfg.Hostname
+    passwd, err := cfg.login_passwd()
+    if err != nil {
+		block_rt(watch_data).logger.Println("Cannot get the ftp password,", err)
+		return false
+    }
+	list_internal_read_timeout := cfg.ListInternalReadTimeout
+    if cfg.UseProxy == false {
 		sv, err1 := ftp.Connect(hostname, list_internal_read_timeout)
-		watch_data["ftp_server"] = sv
+		block_rt(watch_data).set_server(sv)
 		if err1 != nil {
-			watch_data["logger"].(*log.Logger).Printf(
+			block_rt(watch_data).logger.Printf(
 				"Could not establish a connection to host, not continuing for hostname %s\n", hostname)
-			watch_data["ftp_server"] = nil
+			block_rt(watch_data).set_server(nil)
 			return false
 		}
-		err2 := watch_data["ftp_server"].(*ftp.ServerConn).Login(watch_data["user"].(string), watch_data["passwd"].(string))
+		fw._block_state(watch_data).set_conn(sv)
+		deadline := fw.net_deadline(watch_data, "LOGIN " + hostname)
+		err2 := sv.Login(cfg.User, passwd)
+		deadline.Stop()
 		if err2 != nil {
-			watch_data["logger"].(*log.Logger).Printf(
-				"Could not login to %s as %s\n", hostname, watch_data["user"].(string))
-			if watch_data["ftp_server"] != nil {
-				watch_data["ftp_server"].(*ftp.ServerConn).Quit()
-			}
-			watch_data["ftp_server"] = nil
+			block_rt(watch_data).logger.Printf(
+				"Could not login to %s as %s\n", hostname, cfg.User)
+			block_rt(watch_data).quit_server()
 			return false
 		}
     } else {
-		proxy_host := watch_data["proxy_host"].(string)
+		proxy_host := cfg.ProxyHost
 		srv, err1 := ftp.Connect(proxy_host, list_internal_read_timeout)
-		watch_data["ftp_server"] = srv
+		block_rt(watch_data).set_server(srv)
 		if err1 != nil {
-			watch_data["logger"].(*log.Logger).Printf(
+			block_rt(watch_data).logger.Printf(
 				"Could not establish a connection to host, not continuing for proxy hostname %s\n", proxy_host)
-			watch_data["ftp_server"] = nil
+			block_rt(watch_data).set_server(nil)
 			return false
 		}
-		err2 := watch_data["ftp_server"].(*ftp.ServerConn).Login(
-			watch_data["user"].(string) + "@" + hostname, watch_data["passwd"].(string))
+		fw._block_state(watch_data).set_conn(srv)
+		deadline := fw.net_deadline(watch_data, "LOGIN " + hostname)
+		err2 := srv.Login(
+			cfg.User + "@" + hostname, passwd)
+		deadline.Stop()
 		if err2 != nil {
-			watch_data["logger"].(*log.Logger).Printf(
-				"Could not login to %s as %s\n", hostname, watch_data["user"].(string))
-			if watch_data["ftp_server"] != nil {
-				watch_data["ftp_server"].(*ftp.ServerConn).Quit()
-			}
-			watch_data["ftp_server"] = nil
+			block_rt(watch_data).logger.Printf(
+				"Could not login to %s as %s\n", hostname, cfg.User)
+			block_rt(watch_data).quit_server()
 			return false
 		}
 		
     }
-	watch_data["lastconnectat"] = time.Now()
+	block_rt(watch_data).set_connected_at(time.Now())
+	fw._block_state(watch_data).set_conn(block_rt(watch_data).server())
     return true
 }
 
@@ -1189,6 +1077,10 @@ func (fw *FTPWatcher) _check_directory(dirpath string, watch_data map[string]int
      Check if dirpath exists locally,
      try to create if not
      */
+    if fw._dry_run_plan(watch_data) != nil {
+		// A dry run creates nothing
+		return true
+    }
     return fw.makedir( dirpath, fw._default_permission, watch_data )
 }
 
@@ -1197,9 +1089,12 @@ func (fw *FTPWatcher) _write_directory_list(listing []*ftp.FTPListData,
     /*
      Writes directory listing to filename
      */
+    if fw._dry_run_plan(watch_data) != nil {
+		return
+    }
     fp, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, fw._default_permission)
     if err != nil {
-		watch_data["logger"].(*log.Logger).Printf("Error writing file %s\n", filename)
+		block_rt(watch_data).logger.Printf("Error writing file %s\n", filename)
 		return
     }
     for _, line := range listing {
@@ -1214,16 +1109,24 @@ func (fw *FTPWatcher) _skip_pattern(filename string, watch_data map[string]inter
      Returns True if so, False otherwise
      */
     
-    _skip := false
-    for _, pat := range watch_data["skip_patterns"].([]string) {
+    pat := fw._matching_skip_pattern(filename, watch_data)
+    if pat != "" {
+		block_rt(watch_data).logger.Printf("Skip pattern %s matches %s\n", pat, filename)
+    }
+    return pat != ""
+}
+
+func (fw *FTPWatcher) _matching_skip_pattern(filename string, watch_data map[string]interface{}) string {
+    /*
+     Returns the first skip pattern matching filename, "" if none does
+     */
+    for _, pat := range block_config(watch_data).SkipPatterns {
 		matched, _ := path.Match(pat, filename)
 		if matched == true {
-			watch_data["logger"].(*log.Logger).Printf("Skip pattern %s matches %s\n", pat, filename)
-			_skip = true
-			break
+			return pat
 		}
     }
-    return _skip
+    return ""
 }
 
 func (fw *FTPWatcher) _adjust_filedate_tz(datestamp time.Time, tz, server_tz string) time.Time {
@@ -1268,22 +1171,35 @@ func (fw *FTPWatcher) _check_distribution_method(filename string,
      Checks distribution method and returns directory
      to save file into
      */
+    move_to_dir := fw._distribution_dir(filename, remotefile_datetime, localdir, watch_data)
+    if block_config(watch_data).Distribution == "dated-dirs" && move_to_dir != "" {
+		if fw._check_directory(move_to_dir, watch_data) == false {
+			return ""
+		}
+    }
+    return move_to_dir
+}
+
+func (fw *FTPWatcher) _distribution_dir(filename string,
+    remotefile_datetime time.Time, localdir string, watch_data map[string]interface{}) string {
+    /*
+     Returns the directory the distribution method puts filename
+     in, "" for localdir itself
+     */
     move_to_dir := ""
-    if watch_data["distribution"] == nil {
+    distribution := block_config(watch_data).Distribution
+    if distribution == "" {
 		return move_to_dir
     }
-    if watch_data["distribution"] == "dated-dirs" {
+    if distribution == "dated-dirs" {
 		move_to_dir = localdir + string(os.PathSeparator) + remotefile_datetime.Format("20060102")
-		if fw._check_directory(move_to_dir, watch_data) == false {
-			return ""
-		}
-    } else if watch_data["distribution"] == "dscope" {
+    } else if distribution == "dscope" {
 		matches := fw._dscope_filename_dates_rec.FindStringSubmatch(filename)
 		if len(matches) == 3 {
 			month, _ := parseInt(matches[1])
 			day, _ := parseInt(matches[2])
 			year := 0
-			today := watch_data["today"].(time.Time)
+			today := block_rt(watch_data).today
 			if month == int(today.Month()) {
 				year = today.Year()
 			} else if (month > 11) && (int(today.Month()) < 2) {
@@ -1306,10 +1222,10 @@ func (fw *FTPWatcher) _make_symlink(source_file, dest_file, temp_file_name strin
      Creates a symlink on local filesystem
      source_file -> temp_file_name
      */
-    watch_data["logger"].(*log.Logger).Printf("Creating symlink %s -> %s\n", source_file, dest_file)
+    block_rt(watch_data).logger.Printf("Creating symlink %s -> %s\n", source_file, dest_file)
     err := os.Symlink(dest_file, temp_file_name)
     if err != nil {
-		watch_data["logger"].(*log.Logger).Printf("Can't create %s: %s\n",
+		block_rt(watch_data).logger.Printf("Can't create %s: %s\n",
 			temp_file_name, err)
     }
 }
@@ -1320,21 +1236,19 @@ func (fw *FTPWatcher) get_timestamp_of_link_file(lnkfile string, watch_data map[
 		// No meta/link present, so either no lmirror or file has not been downloaded
 		tstamp_str := genutil.ReadableFilenameTimestamp(lnkfile)
 		if tstamp_str == "" {
-			watch_data["logger"].(*log.Logger).Println("genutil.ReadableFilenameTimestamp returned blank for", lnkfile)
+			block_rt(watch_data).logger.Println("genutil.ReadableFilenameTimestamp returned blank for", lnkfile)
 			return time.Time{}
 		}
 		tstamp, _ := time.Parse("Mon 20060102 15:04:05 MST", tstamp_str)
 		return tstamp
 	}
     symlink_tstamp := fi.ModTime()
-	if dest_file_check, ok := watch_data["dest_file_check"].(bool); ok && dest_file_check {
-		tstamp_cache, ok := watch_data["tstamp_cache"].(map[string]time.Time)
-		if !ok { return symlink_tstamp }
-		targ_tstamp, ok := tstamp_cache[lnkfile]
-		if targ_tstamp.IsZero() || (!ok) {
+	if block_config(watch_data).DestFileCheck {
+		targ_tstamp := block_rt(watch_data).tstamp(lnkfile)
+		if targ_tstamp.IsZero() {
 			// This will find out the timestamp of the destination file
 			targ_tstamp = getTimestamp(lnkfile)
-			tstamp_cache[lnkfile] = targ_tstamp
+			block_rt(watch_data).set_tstamp(lnkfile, targ_tstamp)
 		}
 		return targ_tstamp
 	}
@@ -1367,10 +1281,10 @@ func getTimestampFromMetafile(metafile string) time.Time {
 	if err != nil { return time.Time{} }
 	tstamp := fi.ModTime()
 	cfg := qcfg.NewCfg(metafile + "." + time.Now().Format("20060102T150405.000"), metafile, false)
-	blocks := cfg.GetBlocks()
-	if len(blocks) == 0 { return time.Time{} }
-	outdir := cfg.Str(blocks[0], "file", "outdir", "NODIR")
-	files := strings.Split(cfg.Str(blocks[0], "file", "outfiles", ""), ",")
+	block := meta_outputs_block(cfg)
+	if block == "" { return time.Time{} }
+	outdir := cfg.Str(block, "file", "outdir", "NODIR")
+	files := meta_outfiles(cfg, block)
 	if len(files) == 0 { // No component files, so check the target file
 		basename := path.Base(metafile)
 		fname := outdir + "/" + strings.TrimSuffix(basename, ".meta")
@@ -1400,11 +1314,8 @@ func (fw *FTPWatcher) check_filename_timestamp(file_last_modified, timestamp tim
     if (file_last_modified.After(timestamp) == true) || (file_last_modified.Equal(timestamp) == true) {
 		return true
     }
-	if dest_file_check, ok := watch_data["dest_file_check"].(bool); ok && dest_file_check {
-		tstamp_cache, ok := watch_data["tstamp_cache"].(map[string]time.Time)
-		if ok {
-			tstamp_cache[localfname] = time.Time{}  // This causes to compute tstamp afresh next time because we are going to download now
-		}
+	if block_config(watch_data).DestFileCheck {
+		block_rt(watch_data).set_tstamp(localfname, time.Time{})  // This causes to compute tstamp afresh next time because we are going to download now
 	}
     return false
 }
@@ -1414,38 +1325,44 @@ func (fw *FTPWatcher) _open_file(filename string, watch_data map[string]interfac
      Opens filename and returns file handle, handles IO errors
      */
 
-	watch_data["logger"].(*log.Logger).Printf("Opening %s to write data\n", filename)
+	block_rt(watch_data).logger.Printf("Opening %s to write data\n", filename)
     fp, err = os.OpenFile(filename, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, fw._default_permission)
     if err != nil {
-		watch_data["logger"].(*log.Logger).Printf("Can't create %s: %s\n", 
+		block_rt(watch_data).logger.Printf("Can't create %s: %s\n", 
 			filename, err)
 		return
     }
-	watch_data["logger"].(*log.Logger).Printf("Opened %s to write data\n", filename)
+	block_rt(watch_data).logger.Printf("Opened %s to write data\n", filename)
     return
 }
 
-func (fw *FTPWatcher) ftp_get_file(filename string, fp *os.File, size uint64, watch_data map[string]interface{}) (bts int64, success bool) {
+func (fw *FTPWatcher) ftp_get_file(ctx context.Context, filename string, fp *os.File, size uint64, watch_data map[string]interface{}) (bts int64, success bool) {
     // make a buffer to keep chunks that are read
     buf := make([]byte, 4096)
     success = false
     bts = 0
     if fw._reconnect_if_required(watch_data) == false {
 		
-		watch_data["logger"].(*log.Logger).Printf("Cannot reconnect. Giving up on the file", filename)
+		block_rt(watch_data).logger.Printf("Cannot reconnect. Giving up on the file", filename)
 		return bts, false
     }
-    sc := watch_data["ftp_server"].(*ftp.ServerConn)
+    sc := block_rt(watch_data).server()
+	bs := fw._block_state(watch_data)
+	bs.clear_cancel()
 	t0 := time.Now()
 	sc.SetReadTimeoutFlag()
-    for retry_attempts:=1 ; ((retry_attempts <= fw._max_retry_attempts) && (success == false)) ; retry_attempts++ {
+    for retry_attempts:=1 ; ((retry_attempts <= fw._max_retry_attempts) && (success == false) && (bs.transfer_cancelled() == false) && (ctx.Err() == nil)) ; retry_attempts++ {
+		deadline := fw.net_deadline(watch_data, "RETR " + filename)
 		rfp, err := sc.Retr(filename)
 		if err!=nil {
-			watch_data["logger"].(*log.Logger).Printf(
+			deadline.Stop()
+			block_rt(watch_data).logger.Printf(
 				"Cannot RETR %s : %s\nRetry attempt %d\n", filename, err, retry_attempts)
 			continue
 		}
+		bs.start_transfer(rfp)
 		bts = 0
+		started := time.Now()
 		fp.Seek(0,0)
 		// make a read buffer
 		//r := bufio.NewReader(rfp)
@@ -1453,18 +1370,23 @@ func (fw *FTPWatcher) ftp_get_file(filename string, fp *os.File, size uint64, wa
 		//w := bufio.NewWriter(fp)
 		for {
 			// read a chunk
+			deadline.Reset(fw.net_timeout(watch_data))
 			n, err := rfp.Read(buf)
+			if bs.transfer_cancelled() == true {
+				block_rt(watch_data).logger.Printf("Transfer of %s cancelled\n", filename)
+				break
+			}
 			if err != nil && err != io.EOF {
-				watch_data["logger"].(*log.Logger).Printf(
+				block_rt(watch_data).logger.Printf(
 					"Cannot Read %s : %s\nRetry attempt %d\n", filename, err, retry_attempts)
 				break
 			}
 			if n != 0 && err == io.EOF {
-				watch_data["logger"].(*log.Logger).Println("While reading file n =", n, "and err == EOF")
+				block_rt(watch_data).logger.Println("While reading file n =", n, "and err == EOF")
 			}
 			if n == 0 {
 				if bts != int64(size) {
-					watch_data["logger"].(*log.Logger).Println("Error : Downloaded size =", bts, " does not match filesize =", int64(size), "Retry attempt = ", retry_attempts)
+					block_rt(watch_data).logger.Println("Error : Downloaded size =", bts, " does not match filesize =", int64(size), "Retry attempt = ", retry_attempts)
 					break
 				}
 				success = true
@@ -1472,33 +1394,37 @@ func (fw *FTPWatcher) ftp_get_file(filename string, fp *os.File, size uint64, wa
 			}
 			// write a chunk
 			if _, err := fp.Write(buf[:n]); err != nil {
-				watch_data["logger"].(*log.Logger).Printf(
+				block_rt(watch_data).logger.Printf(
 					"Cannot Write to %s : %s\nRetry attempt %d\n", fp.Name(), err, retry_attempts)
 				break
 			}
 			bts = bts + int64(n)
+			bs.add_bytes(int64(n))
+			throttle_transfer(watch_data, bts, started)
 			if time.Now().Sub(t0) >= 10*time.Minute {
-				watch_data["logger"].(*log.Logger).Println("       Downloaded %d bytes.", bts)
+				block_rt(watch_data).logger.Println("       Downloaded %d bytes.", bts)
 				t0 = time.Now()
 			}
 			
 		}
 
 		//if err = w.Flush(); err != nil {
-		//	watch_data["logger"].(*log.Logger).Printf(
+		//	block_rt(watch_data).logger.Printf(
 		//		"Cannot Flush %s : %s\nRetry attempt %d\n", fp.Name(), err, retry_attempts)
 		//	success = false
 		//}
-		watch_data["logger"].(*log.Logger).Println("Closing rfp")
+		block_rt(watch_data).logger.Println("Closing rfp")
+		deadline.Stop()
+		bs.end_transfer()
 		rfp.Close()
-		watch_data["logger"].(*log.Logger).Println("Closed rfp, Closing fp")
+		block_rt(watch_data).logger.Println("Closed rfp, Closing fp")
 		fp.Close()
-		watch_data["logger"].(*log.Logger).Println("Closed fp")
+		block_rt(watch_data).logger.Println("Closed fp")
 		
     }
 	sc.UnsetReadTimeoutFlag()
     if success == false {
-		watch_data["logger"].(*log.Logger).Printf("Have re-tried file %s %d times, giving up.\n",
+		block_rt(watch_data).logger.Printf("Have re-tried file %s %d times, giving up.\n",
 			filename, fw._max_retry_attempts)
     }
 
@@ -1508,7 +1434,7 @@ func (fw *FTPWatcher) ftp_get_file(filename string, fp *os.File, size uint64, wa
 func (fw *FTPWatcher) del_file(fullname string, watch_data map[string]interface{}) bool {
     err := os.RemoveAll(fullname)
     if err != nil {
-		watch_data["logger"].(*log.Logger).Printf("Error deleting path %s : %s\n", fullname, err)
+		block_rt(watch_data).logger.Printf("Error deleting path %s : %s\n", fullname, err)
 		return false
     }
     return true
@@ -1518,7 +1444,7 @@ func (fw *FTPWatcher) del_file(fullname string, watch_data map[string]interface{
 func (fw *FTPWatcher) _rename_file(orig_filename, new_filename string, watch_data map[string]interface{}) bool {
     err := os.Rename(orig_filename, new_filename)
     if err != nil {
-		watch_data["logger"].(*log.Logger).Printf("Error renaming %s as %s : %s\n", orig_filename, new_filename, err)
+		block_rt(watch_data).logger.Printf("Error renaming %s as %s : %s\n", orig_filename, new_filename, err)
 		return false
     }
     return true
@@ -1527,7 +1453,7 @@ func (fw *FTPWatcher) _rename_file(orig_filename, new_filename string, watch_dat
 func (fw *FTPWatcher) _chmod(filename string, watch_data map[string]interface{}) bool {
     err := os.Chmod(filename, fw._default_permission)
     if err != nil {
-		watch_data["logger"].(*log.Logger).Printf("Error doing chmod %s : %s\n", filename, err)
+		block_rt(watch_data).logger.Printf("Error doing chmod %s : %s\n", filename, err)
 		return false
     }
     return true
@@ -1539,23 +1465,21 @@ func (fw *FTPWatcher) _set_file_utime(filename string, file_datetime time.Time,
      Sets the given filenames' utime to one generated
      from the given datetime object
      */
-    watch_data["logger"].(*log.Logger).Printf("Setting %s timestamp to %s\n", filename, file_datetime)
+    block_rt(watch_data).logger.Printf("Setting %s timestamp to %s\n", filename, file_datetime)
     os.Chtimes(filename, file_datetime, file_datetime)
 }
 
-func (fw *FTPWatcher) download_checker(filepath string, checker_cmd string, watch_data map[string]interface{}) bool {
-    
-    for _, command := range fw._split_run_cmd(checker_cmd) {
-		success, stderr := fw._parse_run_cmd(filepath, command, watch_data)
+func (fw *FTPWatcher) download_checker(filepath string, checker_cmd string, watch_data map[string]interface{}, remote_path string, remote_mtime time.Time) bool {
+    /*
+     Runs the download check on the downloaded filepath, false if it failed
+     */
+    return fw.run_commands(watch_data, checker_cmd, "Post download check",
+		command_vars{File: filepath, RemotePath: remote_path, RemoteMtime: remote_mtime}) == nil
+}
 
-		if success == false {
-			watch_data["logger"].(*log.Logger).Printf(
-				"Post download check exited with error! - %s. Deleting file %s\n",
-				stderr, filepath)
-			return false
-		}
-    }
-    return true
+func alert_download_check_failed(remote_path string) {
+    kvpl := fmt.Sprintf("subtab=ftpwatcher;level=critical;subject=%s download check failed for %s;escalate=ops;escalate-minutes1=5;escalate-minutes2=15", short_hostname(), remote_path)
+    doAlert(kvpl)
 }
 
 func (fw *FTPWatcher) _check_remote_local_files(remote_files_list, subdir_list []string, local_dir string,
@@ -1586,7 +1510,21 @@ func (fw *FTPWatcher) _delete_files_from_dir(local_dir string, files_list,
     /*
      Removes files or dirs from local_dir that don't exist in remote_files_list or remote_subdir_list
      */
+    for _, name := range fw._files_to_delete(files_list, remote_files_list, remote_subdir_list, watch_data) {
+		fullname := local_dir + string(os.PathSeparator) + name
+		block_rt(watch_data).logger.Printf("Removing local file/dir %s\n", fullname)
+		fw.del_file(fullname, watch_data)
+    }
+}
 
+func (fw *FTPWatcher) _files_to_delete(files_list,
+    remote_files_list,
+    remote_subdir_list []string,
+    watch_data map[string]interface{}) []string {
+    /*
+     Returns the names in files_list that are neither in remote_files_list nor
+     in remote_subdir_list, leaving out hidden names and skip patterns
+     */
     temp := make([]string, 0)
     for _, name := range files_list {
 		in_remote_file_list := false
@@ -1607,26 +1545,26 @@ func (fw *FTPWatcher) _delete_files_from_dir(local_dir string, files_list,
 			temp = append(temp, name)
 		}
     }
-    files_list = temp
-    for _, name := range files_list {
+    deletes := make([]string, 0)
+    for _, name := range temp {
 		delete_file := true
-		if name[0] == '.' {
+		if name[0] == '.' || strings.HasPrefix(name, _BACKFILL_TEMP_PREFIX) {
+			// A backfill running beside the daemon may be writing the temp file
 			continue
 		}
 		for _, pattern := range fw.__skip_patterns {
 			matched, _ := path.Match(pattern, name)
 			if matched == true {
-				watch_data["logger"].(*log.Logger).Printf("Skip pattern %s matches %s\n", pattern, name)
+				block_rt(watch_data).logger.Printf("Skip pattern %s matches %s\n", pattern, name)
 				delete_file = false
 				break
 			}
 		}
 		if delete_file == true {
-			fullname := local_dir + string(os.PathSeparator) + name
-			watch_data["logger"].(*log.Logger).Printf("Removing local file/dir %s\n", fullname)
-			fw.del_file(fullname, watch_data)
+			deletes = append(deletes, name)
 		}
     }
+    return deletes
 }
 
 func download_process(fw *FTPWatcher, watch_data map[string]interface{}, tid int, opts...interface{}) {
@@ -1634,54 +1572,51 @@ func download_process(fw *FTPWatcher, watch_data map[string]interface{}, tid int
      Does post processing to the downloaded file
      This function is the target for each post process thread
      */
-    if len(opts) != 4 {
+    defer fw.post_process_pending.Done()
+    if len(opts) != 5 {
 		return
     }
     fullname := opts[0].(string)
     cmd := opts[1].(string)
     t1 := opts[2].(time.Time)
     t2 := opts[3].(time.Time)
-    if watch_data["post_download"] != "" && cmd != ""  && watch_data["post_download"] != nil {
-		for _, command := range fw._split_run_cmd(cmd) {
-			success, stderr := fw._parse_run_cmd(fullname, command, watch_data)
-			
-			if success == false {
-				watch_data["logger"].(*log.Logger).Printf(
-					"Post download processing exited with error! - %s.\n",
-					stderr)
-				return
-			} else {
-				watch_data["logger"].(*log.Logger).Printf("Did post processing on filepath %s - output - %s\n",
-					fullname, stderr)
-			}
+    remote_path := opts[4].(string)
+    if block_config(watch_data).PostDownload != "" && cmd != "" {
+		cv := command_vars{File: fullname, RemotePath: remote_path, RemoteMtime: t2}
+		if err := fw.run_commands(watch_data, cmd, "Post download processing", cv); err != nil {
+			fw.post_failed(watch_data, fullname, remote_path, t1, t2, err)
+			return
 		}
+		block_rt(watch_data).logger.Printf("Did post processing on filepath %s\n", fullname)
     }
-    if watch_data["use_lmirror_plugins"] != nil {
-		// Call LMirror plugin functions described in cfg file
-		plugins := watch_data["use_lmirror_plugins"].(map[string]bool)
-		destfile := fullname
-		lmirror_file := ""
-		if plugins["transpath"] == true {
-			lmirror_file, _ = fw.lmirror_plugins["transpath"](fw, watch_data, destfile, "")
-		} else if plugins["adaptive-transpath"] == true {
-			lmirror_file, _ = fw.lmirror_plugins["adaptive-transpath"](fw, watch_data, destfile, "", t1, t2)
+    if len(block_config(watch_data).Stages) > 0 {
+		// A retry after a stage relinked the file starts from what the link points at
+		infile := fullname
+		if fi, err := os.Lstat(fullname); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if infile, err = filepath.EvalSymlinks(fullname); err != nil {
+				fw.post_failed(watch_data, fullname, remote_path, t1, t2, errors.New("Dangling link " + fullname))
+				return
+			}
 		}
-		if plugins["transzip"] == true {
-			lmirror_file, _ = fw.lmirror_plugins["transzip"](fw, watch_data, destfile, lmirror_file)
+		// Call LMirror plugin functions described in cfg file, in the order given there
+		outputs, err := fw.run_lmirror_pipeline_from(watch_data, fullname, infile, remote_path, t1, t2)
+		if err != nil {
+			fw.post_failed(watch_data, fullname, remote_path, t1, t2, err)
+			return
 		}
-		if plugins["split"] == true {
-			_, _ = fw.lmirror_plugins["split"](fw, watch_data, destfile, lmirror_file)
+		for _, out := range outputs {
+			block_rt(watch_data).logger.Printf("lmirror output %s size %d sha256 %s\n", out.Path, out.Size, out.Sha256)
 		}
     }
+    fw.post_succeeded(watch_data, fullname)
     return
 }
 
 func (fw *FTPWatcher) _isLoggedIn(watch_data map[string]interface{}) bool {
-    fs := watch_data["ftp_server"]
-    if fs == nil {
+    fserver := block_rt(watch_data).server()
+    if fserver == nil {
 		return false
     }
-    fserver := fs.(*ftp.ServerConn)
     _, err := fserver.CurrentDir()
     if err != nil {
 		return false
@@ -1691,44 +1626,42 @@ func (fw *FTPWatcher) _isLoggedIn(watch_data map[string]interface{}) bool {
 
 func (fw *FTPWatcher) _reconnect_if_required(watch_data map[string]interface{}) bool {
 
-	watch_data["logger"].(*log.Logger).Println("Entered _reconnect_if_required()")
-	defer watch_data["logger"].(*log.Logger).Println("Leaving  _reconnect_if_required()")
+	block_rt(watch_data).logger.Println("Entered _reconnect_if_required()")
+	defer block_rt(watch_data).logger.Println("Leaving  _reconnect_if_required()")
 	if fw._isLoggedIn(watch_data) == false {
-		if watch_data["ftp_server"] != nil {
-			watch_data["ftp_server"].(*ftp.ServerConn).Quit()
-		}
-		watch_data["logger"].(*log.Logger).Println("Connection Lost. Reconnecting...")
+		block_rt(watch_data).quit_server()
+		block_rt(watch_data).logger.Println("Connection Lost. Reconnecting...")
 		if fw._connect_login_ftp(watch_data) == false {
-			watch_data["logger"].(*log.Logger).Println("Login Failed!")
+			block_rt(watch_data).logger.Println("Login Failed!")
 			return false
 		}
-		watch_data["lastconnectat"] = time.Now()
-		fserver := watch_data["ftp_server"].(*ftp.ServerConn)
-		curdir := watch_data["curdir"].(string)
-		watch_data["logger"].(*log.Logger).Println("Restoring the wd to", curdir)
+		block_rt(watch_data).set_connected_at(time.Now())
+		fserver := block_rt(watch_data).server()
+		curdir := block_rt(watch_data).dir()
+		block_rt(watch_data).logger.Println("Restoring the wd to", curdir)
 		if fserver.ChangeDir(curdir) != nil {
-			watch_data["logger"].(*log.Logger).Printf("CWD to %s Failed!\n", curdir)
+			block_rt(watch_data).logger.Printf("CWD to %s Failed!\n", curdir)
 			return false
 		}
 		return fw._isLoggedIn(watch_data)
 		
 	}
 
-	if tmp, ok := watch_data["lastconnectat"]; ok == true {
+	if tmp := block_rt(watch_data).connected_at(); tmp.IsZero() == false {
 
-		if time.Now().Sub(tmp.(time.Time)) > (time.Minute) {
-			watch_data["logger"].(*log.Logger).Println("The connection is older than 1 minute, reconnecting...")
-			watch_data["ftp_server"].(*ftp.ServerConn).Quit()
+		if time.Now().Sub(tmp) > (time.Minute) {
+			block_rt(watch_data).logger.Println("The connection is older than 1 minute, reconnecting...")
+			block_rt(watch_data).quit_server()
 			if fw._connect_login_ftp(watch_data) == false {
-				watch_data["logger"].(*log.Logger).Println("Login Failed!")
+				block_rt(watch_data).logger.Println("Login Failed!")
 				return false
 			}
-			watch_data["logger"].(*log.Logger).Println("Reconnection successfull")
-			fserver := watch_data["ftp_server"].(*ftp.ServerConn)
-			curdir := watch_data["curdir"].(string)
-			watch_data["logger"].(*log.Logger).Println("Restoring the wd to", curdir)
+			block_rt(watch_data).logger.Println("Reconnection successfull")
+			fserver := block_rt(watch_data).server()
+			curdir := block_rt(watch_data).dir()
+			block_rt(watch_data).logger.Println("Restoring the wd to", curdir)
 			if fserver.ChangeDir(curdir) != nil {
-				watch_data["logger"].(*log.Logger).Printf("CWD to %s Failed!\n", curdir)
+				block_rt(watch_data).logger.Printf("CWD to %s Failed!\n", curdir)
 				return false
 			}
 			return fw._isLoggedIn(watch_data)
@@ -1739,62 +1672,59 @@ func (fw *FTPWatcher) _reconnect_if_required(watch_data map[string]interface{})
 
 }
 
-func (fw *FTPWatcher) mirrorsubdir(localdir string, watch_data map[string]interface{}, goroutine_start_time_local time.Time) {
+func (fw *FTPWatcher) mirrorsubdir(ctx context.Context, localdir string, watch_data map[string]interface{}) {
     /*
      Recursively mirrors ftp location and stores in localdir
      start_directory is optional directory of ftp server to start in.
-     newer_than is datetime object to compare remote file against. Files older
-     than given datetime will not be downloaded
      */
     var bytes_downloaded int64 = 0
     var numfiles_downloaded int = 0
     var last_downloaded_filename string = ""
     var download_dir = ""
-	if goroutine_start_time_local.Before(watch_data["goroutine_start_time"].(time.Time)) == true {
-		// A new goroutine has been issued. so stop this one.
-		watch_data["logger"].(*log.Logger).Println("mirrorsubdir : goroutine_start_time_local =", goroutine_start_time_local, "goroutine_start_time_current =", watch_data["goroutine_start_time"].(time.Time),
-			"Exiting this goroutine")
+	if ctx.Err() != nil {
+		// The watcher has been cancelled, so stop this one.
+		block_rt(watch_data).logger.Println("mirrorsubdir : watcher cancelled, exiting this goroutine")
 		return
 	}
 
-    newer_than, _ := watch_data["newer_than"]
     //start_directory, exists2 := watch_data["start_dir"]
 /*
     ftp_server, exists3 := watch_data["ftp_server"]
     if !(exists3 && ftp_server!=nil && fw._isLoggedIn(watch_data) == true) {
 		if fw._connect_login_ftp(watch_data) == false {
-			watch_data["logger"].(*log.Logger).Println("Login Failed!")
+			block_rt(watch_data).logger.Println("Login Failed!")
 			return
 		}
     }
 
 */
 	if fw._reconnect_if_required(watch_data) == false {
-		watch_data["logger"].(*log.Logger).Println("Could not reconnect. Giving up")
+		block_rt(watch_data).logger.Println("Could not reconnect. Giving up")
+		fw._block_state(watch_data).add_failure("login to " + block_config(watch_data).Hostname)
 		return
 	}
-    fserver := watch_data["ftp_server"].(*ftp.ServerConn)
+    fserver := block_rt(watch_data).server()
 	
     curdir, err := fserver.CurrentDir()
     if err != nil {
-		watch_data["logger"].(*log.Logger).Println("PWD failed!")
+		block_rt(watch_data).logger.Println("PWD failed!")
 		return
     }
 
-	if path.Clean(curdir) != path.Clean(watch_data["curdir"].(string)) {
-		watch_data["logger"].(*log.Logger).Println("In wrong remote directory =", curdir, "Expected =", watch_data["curdir"].(string), "Exiting mirrorsubdir()")
+	if path.Clean(curdir) != path.Clean(block_rt(watch_data).dir()) {
+		block_rt(watch_data).logger.Println("In wrong remote directory =", curdir, "Expected =", block_rt(watch_data).dir(), "Exiting mirrorsubdir()")
 		return
 	}
-	if defaultdir, okdef := watch_data["defaultdir"].(string); okdef && (defaultdir != ""){
-		dest := watch_data["dest"].(string)
+	if defaultdir := block_rt(watch_data).default_dir(); defaultdir != "" {
+		dest := block_config(watch_data).Dest
 		lastpart := strings.Replace(localdir, dest, "", 1)
 		if path.Clean(dest + "/" + defaultdir + "/" + lastpart) != path.Clean(dest + "/" + curdir) {
-			watch_data["logger"].(*log.Logger).Println("Mismatch between adjusted local dir =", dest + "/(defaultdir=" + defaultdir + ")/" + lastpart, "and dest/curdir =", dest + "/" + curdir,
+			block_rt(watch_data).logger.Println("Mismatch between adjusted local dir =", dest + "/(defaultdir=" + defaultdir + ")/" + lastpart, "and dest/curdir =", dest + "/" + curdir,
 				"Exiting mirrorsubdir()")
 			return
 		}
-	} else if path.Clean(localdir) != path.Clean(watch_data["dest"].(string) + "/" + curdir) {
-		watch_data["logger"].(*log.Logger).Println("Mismatch between localdir =", localdir, "and dest/curdir =", watch_data["dest"].(string) + "/" + curdir, "Exiting mirrorsubdir()")
+	} else if path.Clean(localdir) != path.Clean(block_config(watch_data).Dest + "/" + curdir) {
+		block_rt(watch_data).logger.Println("Mismatch between localdir =", localdir, "and dest/curdir =", block_config(watch_data).Dest + "/" + curdir, "Exiting mirrorsubdir()")
 		return
 	}
 
@@ -1804,34 +1734,41 @@ func (fw *FTPWatcher) mirrorsubdir(localdir string, watch_data map[string]interf
     // 		return
     // 	}
     // 	if fserver.ChangeDir(start_directory.(string)) != nil {
-    // 		watch_data["logger"].(*log.Logger).Println("CWD Failed!")
+    // 		block_rt(watch_data).logger.Println("CWD Failed!")
     // 		return
     // 	} else {
     // 		curdir, err = fserver.CurrentDir()
     // 		if err != nil {
-    // 			watch_data["logger"].(*log.Logger).Println("PWD failed!")
+    // 			block_rt(watch_data).logger.Println("PWD failed!")
     // 			return
     // 		}
     // 	}
     // }
     //}
     //watch_data["curdir"] = curdir
+    plan := fw._dry_run_plan(watch_data)
     if fw._check_directory(localdir, watch_data) == false {
 		return
     }
     subdirs := make([]string, 0)
     listing := make([]*ftp.FTPListData, 0)
 	time.Sleep(2*time.Second)
-    watch_data["logger"].(*log.Logger).Printf("Listing remote directory %s...\n", curdir)
-    if listing, err = fserver.List(curdir); err != nil {
-		watch_data["logger"].(*log.Logger).Printf("Could not get remote directory listing for %s : err = %s\n", curdir, err.Error())
+	fw._block_state(watch_data).set(_STATE_LISTING, curdir, time.Time{})
+    block_rt(watch_data).logger.Printf("Listing remote directory %s...\n", curdir)
+    deadline := fw.net_deadline(watch_data, "LIST " + curdir)
+    listing, err = fserver.List(curdir)
+    deadline.Stop()
+    if err != nil {
+		block_rt(watch_data).logger.Printf("Could not get remote directory listing for %s : err = %s\n", curdir, err.Error())
+		fw._block_state(watch_data).add_failure("LIST " + curdir)
 		return
     }
-	watch_data["logger"].(*log.Logger).Printf("Listing completed for remote directory %s...\n", curdir)
+	block_rt(watch_data).logger.Printf("Listing completed for remote directory %s...\n", curdir)
+	fw._block_state(watch_data).listing_done(curdir)
     download_dir = curdir
-    hour := watch_data["today"].(time.Time).Hour()
-    minute := watch_data["today"].(time.Time).Minute()
-    fw._write_directory_list(listing, fmt.Sprintf(watch_data["log_dir"].(string) + string(os.PathSeparator) + "directory_listing-%d:%d",
+    hour := block_rt(watch_data).today.Hour()
+    minute := block_rt(watch_data).today.Minute()
+    fw._write_directory_list(listing, fmt.Sprintf(block_config(watch_data).LogDir + string(os.PathSeparator) + "directory_listing-%d:%d",
 		hour, minute), watch_data)
     filesfound := make([]string, 0)
     dated_dirs := make([]string, 0)
@@ -1842,61 +1779,73 @@ func (fw *FTPWatcher) mirrorsubdir(localdir string, watch_data map[string]interf
     t0 := time.Now()
     for _, list_out := range listing {
 		// if fw._reconnect_if_required(watch_data) == false {
-		// 	watch_data["logger"].(*log.Logger).Println("Could not reconnect. Giving up")
+		// 	block_rt(watch_data).logger.Println("Could not reconnect. Giving up")
 		// 	return
 		// }
 
-		if goroutine_start_time_local.Before(watch_data["goroutine_start_time"].(time.Time)) == true {
-			// A new goroutine has been issued. so stop this one.
-			watch_data["logger"].(*log.Logger).Println("mirrorsubdir : goroutine_start_time_local =", 
-				goroutine_start_time_local, "goroutine_start_time_current =", watch_data["goroutine_start_time"].(time.Time),
-				"Exiting this goroutine")
+		if ctx.Err() != nil {
+			// The watcher has been cancelled or the block is stopping, so stop this one.
+			block_rt(watch_data).logger.Println("mirrorsubdir : watcher cancelled, not downloading any more files")
 			return
 		}
 
-
 		if list_out.Name == "" {
-			watch_data["logger"].(*log.Logger).Printf("Could not parse list output. Output:\n%s\n", list_out.RawLine )
+			block_rt(watch_data).logger.Printf("Could not parse list output. Output:\n%s\n", list_out.RawLine )
 			continue
 		}
 		if fw._skip_pattern(list_out.Name, watch_data) == true {
+			if plan != nil {
+				plan.skip(path.Join(curdir, list_out.Name), "matches skip pattern " + fw._matching_skip_pattern(list_out.Name, watch_data))
+			}
 			continue
 		}
 		remotefile_datetime := list_out.Mtime
 		remotefile_datetime = fw._adjust_filedate_tz(remotefile_datetime,
-			watch_data["tz"].(string),
-			watch_data["server_tz"].(string))
-		watch_data["logger"].(*log.Logger).Println("Time stamp of remote file", list_out.Name, "is", remotefile_datetime)
+			block_config(watch_data).Tz,
+			block_config(watch_data).ServerTz)
+		block_rt(watch_data).logger.Println("Time stamp of remote file", list_out.Name, "is", remotefile_datetime)
 		/*	opt := watch_data["_skip_dirRfile_time_staler_than_days"]
 	if opt != nil {
 	    ok_to_process_time := opt.(time.Time)
 	    if remotefile_datetime.Before(ok_to_process_time) {
-		watch_data["logger"].(*log.Logger).Printf("Remote filename %s is older than %s - not downloading 1\n",
+		block_rt(watch_data).logger.Printf("Remote filename %s is older than %s - not downloading 1\n",
 		    list_out.Name,ok_to_process_time)
 		continue
 	    }
 	}
 */
-		opt := watch_data["_skip_file_time_staler_than_days"]
-		if (opt != nil) && (list_out.TryRetr==true) {
-			ok_to_process_time := opt.(time.Time)
+		ok_to_process_time := block_rt(watch_data).stale_limits().file
+		if bw := block_rt(watch_data).backfill; bw != nil {
+			if list_out.TryRetr == true && bw.skips_file(remotefile_datetime, curdir) {
+				block_rt(watch_data).logger.Printf("Remote filename %s is outside the backfill window - not downloading\n",
+					list_out.Name)
+				if plan != nil {
+					plan.skip(path.Join(curdir, list_out.Name), "outside the backfill window")
+				}
+				continue
+			}
+		} else if (ok_to_process_time.IsZero() == false) && (list_out.TryRetr==true) {
 			if remotefile_datetime.Before(ok_to_process_time) {
-				watch_data["logger"].(*log.Logger).Printf("Remote filename %s is older than %s - not downloading 2\n",
+				block_rt(watch_data).logger.Printf("Remote filename %s is older than %s - not downloading 2\n",
 					list_out.Name,ok_to_process_time)
+				if plan != nil {
+					plan.skip(path.Join(curdir, list_out.Name), fmt.Sprintf("mtime %s is before skip_file_time_staler_than_days= limit %s",
+						remotefile_datetime.Format("20060102 15:04:05"), ok_to_process_time.Format("20060102 15:04:05")))
+				}
 				continue
 			}
 		}
 		/*
 	dir_name, err := parse_dated_dir(list_out.Name)
 	dir_name = fw._adjust_filedate_tz(dir_name,
-	    watch_data["tz"].(string),
-	    watch_data["server_tz"].(string))
+	    block_config(watch_data).Tz,
+	    block_config(watch_data).ServerTz)
 	if err == nil {
 	    opt = watch_data["_skip_dir_name_staler_than_days"]
 	    if (opt != nil) && (list_out.TryCwd == true) {
 		ok_to_process_time := opt.(time.Time)
 		if dir_name.Before(ok_to_process_time) {
-		    watch_data["logger"].(*log.Logger).Printf("Remote filename %s is older than %s - not downloading 4\n",
+		    block_rt(watch_data).logger.Printf("Remote filename %s is older than %s - not downloading 4\n",
 			list_out.Name,ok_to_process_time)
 		    continue
 		}
@@ -1906,7 +1855,14 @@ func (fw *FTPWatcher) mirrorsubdir(localdir string, watch_data map[string]interf
 
 		if list_out.TryCwd == true && list_out.TryRetr == false {
 			// Indicates a directory
-			watch_data["logger"].(*log.Logger).Printf("Remembering subdirectory %s\n", list_out.Name)
+			if bw := block_rt(watch_data).backfill; bw != nil && bw.skips_dir(list_out.Name) {
+				block_rt(watch_data).logger.Printf("Subdirectory %s is outside the backfill window - skipping\n", list_out.Name)
+				if plan != nil {
+					plan.skip(path.Join(curdir, list_out.Name) + "/", "outside the backfill window")
+				}
+				continue
+			}
+			block_rt(watch_data).logger.Printf("Remembering subdirectory %s\n", list_out.Name)
 			subdirs = append(subdirs, list_out.Name)
 			continue
 		}
@@ -1923,70 +1879,85 @@ func (fw *FTPWatcher) mirrorsubdir(localdir string, watch_data map[string]interf
 				return
 			}
 			dated_dirs = append(dated_dirs, move_to_dir)
-			watch_data["logger"].(*log.Logger).Printf("Made dated directory %s for file %s\n",
+			block_rt(watch_data).logger.Printf("Made dated directory %s for file %s\n",
 				move_to_dir, list_out.Name)
 			fullname = move_to_dir + string(os.PathSeparator) + list_out.Name
-			tempname = move_to_dir + string(os.PathSeparator)+ "@" + list_out.Name
+			tempname = move_to_dir + string(os.PathSeparator)+ fw.__temp_prefix + list_out.Name
 			
 		} else {
 
 			fullname = localdir + string(os.PathSeparator) + list_out.Name
-			tempname = localdir + string(os.PathSeparator) + "@" + list_out.Name
+			tempname = localdir + string(os.PathSeparator) + fw.__temp_prefix + list_out.Name
 		}
 		if list_out.TryRetr==true && list_out.TryCwd==true {
+			if plan != nil {
+				plan.note("link %s -> %s", tempname, list_out.LinkDest)
+				continue
+			}
 			fw._make_symlink(list_out.Name, list_out.LinkDest,
 				tempname, watch_data)
 			continue
 		} else {
 			to = fw.get_timestamp_of_link_file(fullname, watch_data)
 			if fw.check_filename_timestamp(to, remotefile_datetime, watch_data, fullname) {
-				watch_data["logger"].(*log.Logger).Printf("Remote and local timestamps match, not downloading %s\n",
+				block_rt(watch_data).logger.Printf("Remote and local timestamps match, not downloading %s\n",
 					list_out.Name)
+				if plan != nil {
+					plan.skip(path.Join(curdir, list_out.Name), fmt.Sprintf("local copy from %s is up to date with mtime %s",
+						to.Format("20060102 15:04:05"), remotefile_datetime.Format("20060102 15:04:05")))
+				}
 				continue
 			}
-			watch_data["logger"].(*log.Logger).Println("fw.get_timestamp_of_link_file returned", to, "for", fullname)
-			if newer_than != nil {
-				if remotefile_datetime.Before(newer_than.(time.Time)) {
-					watch_data["logger"].(*log.Logger).Printf("Remote filename is older than %s - not downloading %s 3\n",
-						newer_than, fullname)
-					continue
-				}
+			block_rt(watch_data).logger.Println("fw.get_timestamp_of_link_file returned", to, "for", fullname)
+			if plan != nil {
+				fw.plan_download(watch_data, plan, path.Join(curdir, list_out.Name), localdir, fullname, list_out.Size, to, remotefile_datetime)
+				continue
 			}
-			watch_data["logger"].(*log.Logger).Printf("Retrieving %s from %s as %s...\n",
+			fw.wait_if_paused(ctx, watch_data)
+			fw._block_state(watch_data).set(_STATE_DOWNLOADING, path.Join(curdir, list_out.Name), time.Time{})
+			block_rt(watch_data).logger.Printf("Retrieving %s from %s as %s...\n",
 				list_out.Name, curdir, fullname)
 			fp, err := fw._open_file(tempname, watch_data)
 			if err!= nil {
 				continue
 			}
+			fw.track_temp_file(tempname, true)
 			t0 = time.Now()
-			bts, success := fw.ftp_get_file(list_out.Name, fp, list_out.Size, watch_data)
+			bts, success := fw.ftp_get_file(ctx, list_out.Name, fp, list_out.Size, watch_data)
 			last_downloaded_filename = fullname
 			bytes_ = float64(bts)
 			if  success == false {
 				fp.Close()
-				watch_data["logger"].(*log.Logger).Printf("Download for %s unsuccessful, deleting temporary file..\n",
+				block_rt(watch_data).logger.Printf("Download for %s unsuccessful, deleting temporary file..\n",
 					fullname)
 				fw.del_file(tempname, watch_data)
+				fw.track_temp_file(tempname, false)
+				fw._block_state(watch_data).add_failure("download of " + path.Join(curdir, list_out.Name))
 				continue
 			} else {
 				fp.Close()
-				if watch_data["download_check"] != nil {
-					if fw.download_checker(tempname, watch_data["download_check"].(string), watch_data) == false {
+				if block_config(watch_data).DownloadCheck != "" {
+					stop_beating := fw._block_state(watch_data).beat_while_running()
+					checked := fw.download_checker(tempname, block_config(watch_data).DownloadCheck, watch_data,
+						curdir + "/" + list_out.Name, remotefile_datetime)
+					stop_beating()
+					if checked == false {
 						fw.del_file(tempname, watch_data)
+						fw.track_temp_file(tempname, false)
 						// Check failed, file has been deleted
-						watch_data["logger"].(*log.Logger).Println("download check of", tempname, "failed, sending alert...")
-						hostn, _ := os.Hostname()
-						hostn = strings.SplitN(hostn, ".", 2)[0]
-						kvpl := fmt.Sprintf("subtab=ftpwatcher;level=critical;subject=%s download check failed for %s/%s;escalate=ops;escalate-minutes1=5;escalate-minutes2=15", hostn, curdir, list_out.Name)
-						doAlert(kvpl)
+						block_rt(watch_data).logger.Println("download check of", tempname, "failed, sending alert...")
+						alert_download_check_failed(curdir + "/" + list_out.Name)
+						fw._block_state(watch_data).add_failure("download check of " + path.Join(curdir, list_out.Name))
 						continue
 					}
-					watch_data["logger"].(*log.Logger).Println("download check of", tempname, "sucessful")
+					block_rt(watch_data).logger.Println("download check of", tempname, "sucessful")
 				}
 			}
 			t1 = time.Now()
 		}
-		if fw._rename_file(tempname, fullname, watch_data) == false {
+		renamed := fw._rename_file(tempname, fullname, watch_data)
+		fw.track_temp_file(tempname, false)
+		if renamed == false {
 			continue
 		}
 		if fw._chmod(fullname, watch_data) == false {
@@ -1997,77 +1968,92 @@ func (fw *FTPWatcher) mirrorsubdir(localdir string, watch_data map[string]interf
 		kbytes := float64(bytes_ / 1024.0)
 		bytes_downloaded += int64(bytes_)
 		numfiles_downloaded += 1
-		watch_data["logger"].(*log.Logger).Printf("%s - %d KBytes in %d seconds - ~%d KB/s\n",
+		fw._block_state(watch_data).add_download()
+		block_rt(watch_data).logger.Printf("%s - %d KBytes in %d seconds - ~%d KB/s\n",
 			list_out.Name, int(kbytes+0.5), int(dt+0.5), int((kbytes/dt)+0.5))
-		fw.total_bytes[watch_data["blockname"].(string)] += int64(bytes_)
-		oldwatchinfo := fw.jsondata[0][watch_data["blockname"].(string)].(WatchInfo)
-		nfd := numfiles_downloaded + oldwatchinfo.Numfiles
-		old_bytes, _ := strconv.ParseInt(oldwatchinfo.Bytes, 10, 64)
-		total_bytes_downloaded := bytes_downloaded + old_bytes
-		fw.jsondata[0][watch_data["blockname"].(string)] = WatchInfo{time.Now().Format("20060102 15:04:05"), nfd, strconv.FormatInt(total_bytes_downloaded, 10), 
-			last_downloaded_filename, download_dir, oldwatchinfo.Logfile}
+		fw.total_bytes[block_config(watch_data).Name] += int64(bytes_)
+		fw.update_json(func(data map[string]interface{}) {
+			oldwatchinfo, ok := data[block_config(watch_data).Name].(WatchInfo)
+			if ok == false {
+				// Removed by a reload while this pass went on
+				return
+			}
+			nfd := numfiles_downloaded + oldwatchinfo.Numfiles
+			old_bytes, _ := strconv.ParseInt(oldwatchinfo.Bytes, 10, 64)
+			total_bytes_downloaded := bytes_downloaded + old_bytes
+			data[block_config(watch_data).Name] = WatchInfo{time.Now().Format("20060102 15:04:05"), nfd, strconv.FormatInt(total_bytes_downloaded, 10),
+				last_downloaded_filename, download_dir, oldwatchinfo.Logfile}
+		})
 		fw.write_json_file()
 		
-		if (watch_data["post_download"] != nil) || (watch_data["use_lmirror_plugins"]) != nil {
-			fw._add_work_to_chan(watch_data, watch_data["post_process_in_queue"].(chan work),
-				download_process, fullname, watch_data["post_download"].(string), to, tn)
+		if block_config(watch_data).PostDownload != "" || len(block_config(watch_data).Stages) > 0 {
+			post_download := block_config(watch_data).PostDownload
+			fw.post_process_pending.Add(1)
+			if fw._add_work_to_queue(watch_data, block_rt(watch_data).post_in,
+				download_process, fullname, post_download, to, tn, path.Join(curdir, list_out.Name)) == false {
+				fw.post_process_pending.Done()
+				fw.post_failed(watch_data, fullname, path.Join(curdir, list_out.Name), to, tn, errors.New("Block stopped before post processing"))
+			}
 		}
 		
     }
 	/*    if len(dated_dirs) > 0 {
 	//fw._check_remote_local_files(filesfound, subdirs, dated_dirs,
-	//	watch_data, watch_data["mode"].(string))
+	//	watch_data, block_config(watch_data).Mode)
     } else {
 	fw._check_remote_local_files(filesfound, subdirs, localdir,
-	    watch_data, watch_data["mode"].(string))
+	    watch_data, block_config(watch_data).Mode)
     }
   */  
+    if plan != nil && block_config(watch_data).Mode == "mirror" {
+		fw.plan_deletions(watch_data, plan, localdir, filesfound, subdirs)
+    }
     //Recursively mirror subdirectories
     for _, subdir := range subdirs {
-		watch_data["logger"].(*log.Logger).Printf("Processing subdirectory %s\n", subdir)
+		block_rt(watch_data).logger.Printf("Processing subdirectory %s\n", subdir)
 		localsubdir := localdir + string(os.PathSeparator) + subdir
-		if watch_data["ftp_server"] == nil {
+		fserver := block_rt(watch_data).server()
+		if fserver == nil {
 			return
 		}
-		fserver := watch_data["ftp_server"].(*ftp.ServerConn)
 		curdir, err := fserver.CurrentDir()
 		if err != nil {
-			watch_data["logger"].(*log.Logger).Println("PWD failed!")
+			block_rt(watch_data).logger.Println("PWD failed!")
 			return
 		}
-		watch_data["logger"].(*log.Logger).Printf("Remote directory now: %s\n" , curdir)
-		watch_data["logger"].(*log.Logger).Printf("Remote cwd %s\n", subdir)
+		block_rt(watch_data).logger.Printf("Remote directory now: %s\n" , curdir)
+		block_rt(watch_data).logger.Printf("Remote cwd %s\n", subdir)
 		
 		if fserver.ChangeDir(subdir) != nil {
-			watch_data["logger"].(*log.Logger).Println("CWD Failed!")
+			block_rt(watch_data).logger.Println("CWD Failed!")
 			continue
 		}
-		watch_data["logger"].(*log.Logger).Printf("Mirroring subdir %s as %s\n", subdir, localsubdir )
+		block_rt(watch_data).logger.Printf("Mirroring subdir %s as %s\n", subdir, localsubdir )
 		//watch_data["start_dir"] = ""
-		watch_data["curdir"] = curdir + "/" + subdir
-		fw.mirrorsubdir(localsubdir, watch_data, goroutine_start_time_local)
-		if watch_data["ftp_server"] == nil {
-			watch_data["logger"].(*log.Logger).Println("Bad connection. Quitting this iteration")
+		block_rt(watch_data).set_dir(curdir + "/" + subdir)
+		fw.mirrorsubdir(ctx, localsubdir, watch_data)
+		fserver = block_rt(watch_data).server()
+		if fserver == nil {
+			block_rt(watch_data).logger.Println("Bad connection. Quitting this iteration")
 			return
 		}
-		fserver = watch_data["ftp_server"].(*ftp.ServerConn)
-		watch_data["logger"].(*log.Logger).Println("Remote cwd ..")
+		block_rt(watch_data).logger.Println("Remote cwd ..")
 		if fserver.ChangeDirToParent() != nil {
-			watch_data["logger"].(*log.Logger).Println("CWD to parent Failed!")
+			block_rt(watch_data).logger.Println("CWD to parent Failed!")
 			return
 		}
-		watch_data["curdir"] = curdir
+		block_rt(watch_data).set_dir(curdir)
 		newcurdir, err := fserver.CurrentDir()
 		if err != nil {
-			watch_data["logger"].(*log.Logger).Println("PWD failed!")
+			block_rt(watch_data).logger.Println("PWD failed!")
 			return
 		}
 		if newcurdir != curdir {
-			watch_data["logger"].(*log.Logger).Println("Ended up in wrong directory after cd + cd ..")
-			watch_data["logger"].(*log.Logger).Println("Giving up now.")
+			block_rt(watch_data).logger.Println("Ended up in wrong directory after cd + cd ..")
+			block_rt(watch_data).logger.Println("Giving up now.")
 			break
 		} else {
-			watch_data["logger"].(*log.Logger).Printf("Finished with %s\n", subdir)
+			block_rt(watch_data).logger.Printf("Finished with %s\n", subdir)
 		}
 		
     }
@@ -2077,169 +2063,151 @@ func doAlert(kvplist string) {
 	if opt.Alertcmd == "" || opt.Alertcmd == "NOCMD" { return }
     command := []string{opt.Alertcmd, "--kvplist", kvplist}
     cmd := exec.Command(command[0], command[1:]...)
+    cmd.Env = child_environ()
     cmd.CombinedOutput()
 }
 
 func start(fw *FTPWatcher, watch_data map[string]interface{}, tid int, opts...interface{}) {
     /*
-     Starts up a single watcher
+     Starts up a single watcher, runs until ctx is cancelled
      */
-	goroutine_start_time_local := time.Now()
-    pt, exists := watch_data["poll_time"]
-    poll_time := 0
-    if exists==false {
-		poll_time = fw.__loop_wait_time
-    } else {
-		poll_time = pt.(int)
-    }
-    watch_data["tid"] = tid
-    watch_data["thread_object"] = fmt.Sprintf("Thread id %d", tid)
-    watch_data["logger"].(*log.Logger).Println("Thread id", tid, "perpetually running as a daemon")
+	ctx := opts[0].(context.Context)
+	defer close(opts[1].(chan bool))
+	opts[2].(chan int) <- tid
+    poll_time := block_config(watch_data).PollTime
+    block_rt(watch_data).logger.Println("Thread id", tid, "perpetually running as a daemon")
     for {
-		fw.check_schedule(watch_data)
-		fw.adjust_stale_time(watch_data)
-		if goroutine_start_time_local.Before(watch_data["goroutine_start_time"].(time.Time)) == true {
-			// A new goroutine has been issued. so stop this one.
-			watch_data["logger"].(*log.Logger).Println("start : goroutine_start_time_local =", goroutine_start_time_local, "goroutine_start_time_current =", watch_data["goroutine_start_time"].(time.Time),
-			"Exiting this goroutine")
+		fw.check_schedule(ctx, watch_data)
+		fw.wait_if_paused(ctx, watch_data)
+		if ctx.Err() != nil {
+			block_rt(watch_data).logger.Println("start : watcher cancelled, exiting this goroutine")
 			return
 		}
-		// TODO Error check the following. Re submit the job to watcher_in_q if needed
-		sd, exists2 := watch_data["start_dir"]
-		start_directories := sd.(string)
-		if exists2 && start_directories != "" {
-			for _, start_dir := range strings.Split(start_directories, ",") {
-				watch_data["logger"].(*log.Logger).Println("Attempting to mirror the start directory : ", start_dir)
-				watch_data["curdir"] = start_dir
-				if fw._reconnect_if_required(watch_data) == false {
-					watch_data["logger"].(*log.Logger).Println("Could not reconnect. Giving up")
-					continue
-				}
-				watch_data["logger"].(*log.Logger).Println("Changing current working dir to " + start_dir)
-				fserver := watch_data["ftp_server"].(*ftp.ServerConn)
-				if fserver.ChangeDir(start_dir) != nil {
-                    watch_data["logger"].(*log.Logger).Printf("CWD to %s Failed!\n", start_dir)
-                    continue
-                }
-				fw.mirrorsubdir(watch_data["dest"].(string) + "/"  + start_dir, watch_data, goroutine_start_time_local)
-			}
-			watch_data["logger"].(*log.Logger).Println("Finished downloading all start directories." )
-			
-		} else {
-			// In order to get the correct default start dir in every iteration, we must reconnect.
-			if fw._connect_login_ftp(watch_data) == false {
-				watch_data["logger"].(*log.Logger).Println("Login Failed!")
-			} else {
-				fserver := watch_data["ftp_server"].(*ftp.ServerConn)
-				var errdef error = nil
-				watch_data["curdir"], errdef = fserver.CurrentDir()
-				if errdef != nil {
-					watch_data["logger"].(*log.Logger).Println("Cannot get currdir, err =", errdef)
-				} else {
-					watch_data["defaultdir"] = watch_data["curdir"]
-					fw.mirrorsubdir(watch_data["dest"].(string), watch_data, goroutine_start_time_local)
-					if ftp_server, okftp := watch_data["ftp_server"].(*ftp.ServerConn); okftp {
-						ftp_server.Quit()
-						watch_data["ftp_server"] = nil
-					}
-				}
-			}
-		}
-
-		if goroutine_start_time_local.Before(watch_data["goroutine_start_time"].(time.Time)) == true {
-			// A new goroutine has been issued. so stop this one.
-			watch_data["logger"].(*log.Logger).Println("start : goroutine_start_time_local =", goroutine_start_time_local, "goroutine_start_time_current =", watch_data["goroutine_start_time"].(time.Time),
-			"Exiting this goroutine")
+		fw.adjust_stale_time(watch_data)
+		fw.active_passes.Add(1)
+		block_rt(watch_data).passes.Add(1)
+		fw.retry_post_jobs(watch_data, nil)
+		fw.run_pass(ctx, watch_data)
+		block_rt(watch_data).passes.Done()
+		fw.active_passes.Done()
+
+		if ctx.Err() != nil {
+			block_rt(watch_data).logger.Println("start : watcher cancelled, exiting this goroutine")
 			return
 		}
 
-		ftp_server, exists := watch_data["ftp_server"]
-		//fmt.Println(ftp_server==nil, exists)
-		if (poll_time >= fw.__loop_wait_time) && exists && (ftp_server!=nil) {
-			ftp_server.(*ftp.ServerConn).Quit()
-			watch_data["ftp_server"] = nil
+		if poll_time >= fw.__loop_wait_time {
+			block_rt(watch_data).quit_server()
 		}
 
-		watch_data["logger"].(*log.Logger).Println("About to sleep for", poll_time, "seconds")
-		time.Sleep(time.Duration(poll_time)*time.Second)
-		watch_data["logger"].(*log.Logger).Println("Woke up from sleep")
+		fw._block_state(watch_data).set(_STATE_IDLE, "", time.Time{})
+		block_rt(watch_data).logger.Println("About to sleep for", poll_time, "seconds")
+		fw.sleep_or_trigger(ctx, watch_data, time.Duration(poll_time)*time.Second)
+		block_rt(watch_data).logger.Println("Woke up from sleep")
+    }
+    
+}
 
-		if goroutine_start_time_local.Before(watch_data["goroutine_start_time"].(time.Time)) == true {
-			// A new goroutine has been issued. so stop this one.
-			watch_data["logger"].(*log.Logger).Println("start : goroutine_start_time_local =", goroutine_start_time_local, "goroutine_start_time_current =", watch_data["goroutine_start_time"].(time.Time),
-			"Exiting this goroutine")
-			return
+func (fw *FTPWatcher) run_pass(ctx context.Context, watch_data map[string]interface{}) {
+    /*
+    Mirrors the start directories of a block, or its login dir, once
+    */
+    // TODO Error check the following. Re submit the job to watcher_in_q if needed
+    start_directories := block_config(watch_data).StartDir
+    if start_directories != "" {
+		for _, start_dir := range strings.Split(start_directories, ",") {
+			if ctx.Err() != nil {
+				break
+			}
+			block_rt(watch_data).logger.Println("Attempting to mirror the start directory : ", start_dir)
+			block_rt(watch_data).set_dir(start_dir)
+			if fw._reconnect_if_required(watch_data) == false {
+				block_rt(watch_data).logger.Println("Could not reconnect. Giving up")
+				fw._block_state(watch_data).add_failure("login to " + block_config(watch_data).Hostname)
+				continue
+			}
+			block_rt(watch_data).logger.Println("Changing current working dir to " + start_dir)
+			fserver := block_rt(watch_data).server()
+			deadline := fw.net_deadline(watch_data, "CWD " + start_dir)
+			err := fserver.ChangeDir(start_dir)
+			deadline.Stop()
+			if err != nil {
+				block_rt(watch_data).logger.Printf("CWD to %s Failed!\n", start_dir)
+				fw._block_state(watch_data).add_failure("CWD " + start_dir)
+				continue
+			}
+			fw.mirrorsubdir(ctx, block_config(watch_data).Dest + "/"  + start_dir, watch_data)
 		}
+		block_rt(watch_data).logger.Println("Finished downloading all start directories." )
 
-		
+    } else {
+		// In order to get the correct default start dir in every iteration, we must reconnect.
+		if fw._connect_login_ftp(watch_data) == false {
+			block_rt(watch_data).logger.Println("Login Failed!")
+			fw._block_state(watch_data).add_failure("login to " + block_config(watch_data).Hostname)
+		} else {
+			fserver := block_rt(watch_data).server()
+			curdir, errdef := fserver.CurrentDir()
+			if errdef != nil {
+				block_rt(watch_data).logger.Println("Cannot get currdir, err =", errdef)
+			} else {
+				block_rt(watch_data).set_dir(curdir)
+				block_rt(watch_data).set_default_dir(curdir)
+				fw.mirrorsubdir(ctx, block_config(watch_data).Dest, watch_data)
+				block_rt(watch_data).quit_server()
+			}
+		}
     }
-    
 }
 
 func (fw *FTPWatcher) start_watcher(watcher_in_queue chan work, watch_data map[string]interface{}, tids []int) {
     /*
-     Starts up a single watcher thread
+     Starts up a single watcher thread. Its context is derived from the
+     block context, so stopping the block also stops the watcher. The
+     old watcher, if any, has exited, so the block's connection is ours.
      */
-    watch_data["tid"] = 0
-    watch_data["thread_object"] = ""
+    rt := block_rt(watch_data)
+    ctx, cancel := context.WithCancel(rt.ctx)
+    wh := &watcher_handle{cancel: cancel, done: make(chan bool)}
+    started := make(chan int, 1)
 
-    ftp_server, exists := watch_data["ftp_server"]
-    if exists && (ftp_server!=nil) {
-		ftp_server.(*ftp.ServerConn).Quit()
-    }
-    watch_data["ftp_server"] = nil
+    rt.quit_server()
     fw._start_threads(watcher_in_queue, 1)
-    fw._add_work_to_chan(watch_data, watcher_in_queue, start)
-    for watch_data["tid"] == 0 {
-		time.Sleep(time.Second)
-    }
-    tids = append(tids, watch_data["tid"].(int))
-    watch_data["logger"].(*log.Logger).Printf("Found thread id %d\n", watch_data["tid"].(int) )
+    fw._add_work_to_chan(watch_data, watcher_in_queue, start, ctx, wh.done, started)
+    // The thread exits once start returns
+    close(watcher_in_queue)
+    wh.tid = <-started
+    rt.set_watcher(wh)
+    tids = append(tids, wh.tid)
+    rt.logger.Printf("Found thread id %d\n", wh.tid)
 }
 
 func (fw *FTPWatcher) StartAllWatchers() {
     /*
      Starts up threads for all watchers
      */
-	logfiles    := make([]string, len(fw.watchers))
-
-	for idx, watch_data := range fw.watchers {
-		logfiles[idx] = fmt.Sprintf("%s/%s", watch_data["log_dir"].(string), fw.__log_filename)
-	}
-	
     for {
-		for idx, watch_data := range fw.watchers {
-			thread_object, exists := watch_data["thread_object"]
-			if ! ( exists && thread_object!="" ) {
+		if fw.is_shutting_down() {
+			// Watchers are winding down, don't restart them
+			time.Sleep(time.Minute)
+			continue
+		}
+		for _, watch_data := range fw.get_watchers() {
+			if block_rt(watch_data).get_watcher() == nil {
 				watcher_in_queue := make(chan work, 10)
-				watch_data["goroutine_start_time"] = time.Now() // Used by the goroutine to check if it is declared dead
 				fw.start_watcher(watcher_in_queue, watch_data, fw.tids)
 			} else {
-				// TODO
-				// Check if thread is alive
-				// if dead, restart the thread and log this info and send out a mail
-				start_time, end_time, now := fw.get_schedule(watch_data)
-
-				if start_time.IsZero() == true && end_time.IsZero() == true {
-					continue
-				}
-
-				if now.After(end_time) == true || now.Before(start_time) == true {
-					// Not in schedule. so don't check the logs
-					continue
-				}
-
-				fi, err := os.Stat(logfiles[idx])
-				if err != nil {
-					watch_data["logger"].(*log.Logger).Println("Cannot access", logfiles[idx])
-					continue
-				}
-				if time.Now().Sub(fi.ModTime()) > watch_data["log_file_stale_duration"].(time.Duration) {
-					watch_data["logger"].(*log.Logger).Println("StartAllWatchers : No updates in logfile for", watch_data["log_file_stale_duration"].(time.Duration).Minutes(),
-						"minutes. Last update was at", fi.ModTime(), ". Launching a new goroutine.")
+				// Check if thread is alive from its heartbeat
+				// if hung, restart the thread and log this info and send out an alert
+				if fw.check_heartbeat(watch_data) == true {
+					if fw.kill_watcher(watch_data, time.Minute) == false {
+						block_rt(watch_data).logger.Println("StartAllWatchers : Old watcher has not exited yet, not launching a new goroutine")
+						continue
+					}
+					block_rt(watch_data).logger.Println("StartAllWatchers : Old watcher exited, launching a new goroutine")
+					fw.report_restart(watch_data)
 					watcher_in_queue := make(chan work, 10)
-					watch_data["goroutine_start_time"] = time.Now() // Used by the goroutine to check if it is declared dead
-					fw.start_watcher(watcher_in_queue, watch_data, fw.tids)					
+					fw.start_watcher(watcher_in_queue, watch_data, fw.tids)
 				}
 			}
 		}
@@ -2247,135 +2215,73 @@ func (fw *FTPWatcher) StartAllWatchers() {
     }
 }
 
-func StartWithConfigFile( configFile string, start_daemon bool) {
-    var ccfg *qcfg.CfgBlock = qcfg.NewCfg("main", configFile, false)
-    blockNames := ccfg.GetBlocks()
-    watchlist := make([]map[string]interface{}, 0)
-    for _, block_name := range blockNames {
-		hostname := ccfg.Str(block_name, _CONFIG_PARAM_ROW, "hostname", "")
-		ftp_user := ccfg.Str(block_name, _CONFIG_PARAM_ROW, "user", "")
-		passwd := GenPasswd(ccfg.Str(block_name, _CONFIG_PARAM_ROW, "passwd", ""))
-		destination_path := ccfg.Str(block_name, _CONFIG_PARAM_ROW, "destination", "")
-		mode := ccfg.Str(block_name, _CONFIG_PARAM_ROW, "mode", "")
-		debug := ccfg.Str(block_name, _CONFIG_PARAM_ROW, "debug", "")
-		tz := ccfg.Str(block_name, _CONFIG_PARAM_ROW, "tz", "")
-		server_tz := ccfg.Str(block_name, _CONFIG_PARAM_ROW, "server_tz", "")
-		dest_file_check := (ccfg.Str(block_name, _CONFIG_PARAM_ROW, "dest_file_check", "false") == "true")
-	    skip_dirRfile_time_staler_than_days := int(ccfg.Int64(block_name, _CONFIG_PARAM_ROW,
-			"skip_dirRfile_time_staler_than_days", 30))
-	    skip_file_time_staler_than_days := int(ccfg.Int64(block_name, _CONFIG_PARAM_ROW,
-			"skip_file_time_staler_than_days", 30))
-	    skip_dir_name_staler_than_days := int(ccfg.Int64(block_name, _CONFIG_PARAM_ROW,
-			"skip_dir_name_staler_than_days", 30))
-	    thread_no := int(ccfg.Int64(block_name, _CONFIG_PARAM_ROW,
-			"thread_no", 0))
-	    poll_time := int(ccfg.Int64(block_name, _CONFIG_PARAM_ROW,
-			"poll_time", 300))
-		list_internal_read_timeout, _ := time.ParseDuration(ccfg.Str(block_name, _CONFIG_PARAM_ROW, "list_internal_read_timeout", "60s"))
-		log_file_stale_duration, _    := time.ParseDuration(ccfg.Str(block_name, _CONFIG_PARAM_ROW, "log_file_stale_duration", "25m"))
-	    start_directory := ccfg.Str(block_name, _CONFIG_PARAM_ROW,
-			"start_dir", "")
-	    distribution := ccfg.Str(block_name, _CONFIG_DISTRIBUTION_ROW,
-			"method", "")
-	    post_download_check := ccfg.Str(block_name, _CONFIG_DOWNLOAD_CHECK_ROW,
-			"app", "" )
-	    post_download_process := ccfg.Str(block_name, _CONFIG_POST_DOWNLOAD_ROW,
-			"app", "" )
-	    use_proxy := int(ccfg.Int64(block_name, _CONFIG_PROXY_ROW,
-			"useProxy", 0 ))
-	    proxy_host := ccfg.Str(block_name, _CONFIG_PROXY_ROW,
-			"hostname", "" )
-
-	    skip_patterns := ccfg.Str(block_name, _CONFIG_PARAM_ROW,
-			"skip_patterns", "" )
-		cooked_skip_patterns := strings.Split(skip_patterns, _SKIP_PATTERNS_SEP)
-		for i:=0 ; i<len(cooked_skip_patterns) ; i++  {
-			cooked_skip_patterns[i] = strings.Replace(cooked_skip_patterns[i],
-				_SKIP_PATTERNS_LITERAL_SEP, _SKIP_PATTERNS_SEP, -1)
-			
-		}
-	    start_time := ccfg.Str(block_name, _CONFIG_SCHEDULER_ROW,
-			"start_time", "")
-	    end_time := ccfg.Str(block_name, _CONFIG_SCHEDULER_ROW,
-			"end_time", "")
-	    warn_time := ccfg.Str(block_name, _CONFIG_SCHEDULER_ROW,
-			"warn_time", "")
-	    warn_cmd := ccfg.Str(block_name, _CONFIG_SCHEDULER_ROW,
-			"warn_cmd", "")
-	    alert_recp := ccfg.Str(block_name, _CONFIG_ALERT_ROW,
-			"recipient", "")
-	    alert_body := ccfg.Str(block_name, _CONFIG_ALERT_ROW,
-			"body", "")
-	    alert_subj := ccfg.Str(block_name, _CONFIG_ALERT_ROW,
-			"subject", "")
-
-	    lmirror_plugins := ccfg.Str(block_name, _CONFIG_LMIRROR_ROW,
-			"plugins", "")
-		lmirror_plugins_to_use := strings.Split(lmirror_plugins, ",")
-	    lmirror_path_fmt := ccfg.Str(block_name, _CONFIG_LMIRROR_ROW,
-			"lmirror_path_format", "")
-	    lmirror_zip_fmt := ccfg.Str(block_name, _CONFIG_LMIRROR_ROW,
-			"zipfmt", "xz")
-	    lmirror_split_cmd := ccfg.Str(block_name, _CONFIG_LMIRROR_ROW,
-			"split_cmd", "")
-		
-		
-		watchData := make(map[string]interface{})
-		watchData["blockname"] = block_name
-		watchData["use_lmirror_plugins"] = lmirror_plugins_to_use
-		watchData["lmirror_path_fmt"] = lmirror_path_fmt
-		watchData["lmirror_zip_fmt"] = lmirror_zip_fmt
-		watchData["lmirror_split_cmd"] = lmirror_split_cmd
-		watchData["hostname"] = hostname
-		watchData["user"] = ftp_user
-		watchData["passwd"] = passwd
-		watchData["dest"] = destination_path
-		watchData["start_dir"] = start_directory
-		watchData["mode"] = mode
-		watchData["debug"] = debug
-		watchData["tz"] = tz
-		watchData["server_tz"] = server_tz
-		watchData["dest_file_check"] = dest_file_check
-		watchData["tstamp_cache"] = map[string]time.Time{}
-		watchData["skip_dirRfile_time_staler_than_days"] = skip_dirRfile_time_staler_than_days
-		watchData["skip_file_time_staler_than_days"] = skip_file_time_staler_than_days
-		watchData["skip_dir_name_staler_than_days"] = skip_dir_name_staler_than_days
-		watchData["poll_time"] = poll_time
-		watchData["list_internal_read_timeout"] = list_internal_read_timeout
-		watchData["log_file_stale_duration"] = log_file_stale_duration
-		watchData["distribution"] = distribution
-		watchData["download_check"] = post_download_check
-		watchData["post_download"] = post_download_process
-		watchData["use_proxy"] = use_proxy
-		watchData["proxy_host"] = proxy_host
-		watchData["block_name"] = block_name
-		watchData["skip_patterns"] = cooked_skip_patterns
-		watchData["start_time"] = start_time
-		watchData["end_time"] = end_time
-		watchData["warn_time"] = warn_time
-		watchData["warn_cmd"] = warn_cmd
-		watchData["warn_alert_recp"] = alert_recp
-		watchData["warn_alert_body"] = alert_body
-		watchData["warn_alert_subj"] = alert_subj
-		watchData["thread_no"] = thread_no
-		//fmt.Println("skip_file_time_staler_than_days = ", watchData["skip_file_time_staler_than_days"])
-		watchlist = append(watchlist, watchData)
+func load_watchlist(configFile string) ([]map[string]interface{}, error) {
+    /*
+     Reads the cfg file, with its includes, defaults and templates, and
+     returns the watch data of each block. Fails if the cfg file, an
+     included file or a template cannot be read.
+     */
+    cf := read_cfg(configFile)
+    if err := cf.error(); err != nil {
+		return nil, err
     }
+    return cf.watchlist(), nil
+}
 
+func StartWithConfigFile( configFile string, start_daemon bool) int {
+    /*
+     Runs the blocks of configFile as a daemon, never returning, or once
+     when start_daemon is false, returning the exit status of run_once
+     */
+    watchlist, err := load_watchlist(configFile)
+    if err != nil {
+		fmt.Println(err)
+		return 1
+    }
+    if start_daemon == false {
+		return run_once(configFile, watchlist)
+    }
     watcher := newFTPWatcher(watchlist, start_daemon)
+    watcher.config_file = configFile
     watcher.StartAllWatchers()
-    
+    return 0
 }
 
 func main() {
     parseArgs()
+    if opt.Creds != "" {
+		os.Exit(Credentials(opt.Creds))
+    }
+    if opt.Checkconfig {
+		os.Exit(CheckConfig(opt.Config))
+    }
+    if opt.Dumpconfig {
+		os.Exit(DumpConfig(opt.Config))
+    }
+    if opt.Reprocess != "" {
+		os.Exit(Reprocess(opt.Config, opt.Reprocess))
+    }
+    if opt.Backfill != "" {
+		os.Exit(Backfill(opt.Config, opt.Backfill))
+    }
+    if opt.Dryrun {
+		os.Exit(DryRun(opt.Config))
+    }
     hostname,_ := os.Hostname()	
 	conn, err := cim.NewCimConnection(hostname, "ftpwatcher" + opt.Inst, "ftpwatcher-connection-test-" + opt.Inst)
 	if err == nil {
 		conn.Close()
+		if opt.Once {
+			// Reported like any failed --Once run, cron or the job scheduler sees the exit status
+			fmt.Fprintln(os.Stderr, "ftpwatcher --Once : instance " + opt.Inst + " is running already, not starting the pass")
+			os.Exit(1)
+		}
 		panic("Error starting ftpwatcher instance " + opt.Inst + ". Found the instance running already.")
 	}
-    StartWithConfigFile(opt.Config, true)
+    if opt.Once {
+		os.Exit(StartWithConfigFile(opt.Config, false))
+    }
+    os.Exit(StartWithConfigFile(opt.Config, true))
 }
 
 var passwdMap = map[string]string{
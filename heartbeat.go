@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func (bs *block_state) add_bytes(n int64) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.transfer_bytes += n
+	bs.total_bytes += n
+	bs.heartbeat = time.Now()
+}
+
+func (bs *block_state) listing_done(dir string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.last_listing = time.Now()
+	bs.last_listing_at = dir
+	bs.heartbeat = bs.last_listing
+}
+
+func (bs *block_state) beat_while_running() func() {
+	/*
+	 Keeps the heartbeat going while the watcher runs a command inline,
+	 such as a download check, which cmd_timeout= bounds rather than
+	 stall_duration=. Returns the function to call once it is done.
+	 */
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				bs.mu.Lock()
+				bs.heartbeat = time.Now()
+				bs.mu.Unlock()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (bs *block_state) add_download() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.downloaded++
+}
+
+func (bs *block_state) add_failure(what string) {
+	/*
+	 Counts a failed login, listing, download or post-processing, keeping
+	 the last 20 for the summary
+	 */
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.failures++
+	bs.last_failures = append(bs.last_failures, what)
+	if len(bs.last_failures) > 20 {
+		bs.last_failures = bs.last_failures[len(bs.last_failures)-20:]
+	}
+}
+
+func short_hostname() string {
+	hostn, _ := os.Hostname()
+	return strings.SplitN(hostn, ".", 2)[0]
+}
+
+func (fw *FTPWatcher) check_heartbeat(watch_data map[string]interface{}) bool {
+	/*
+	 Called every minute by the watchdog. Returns true if the watcher is hung,
+	 that is it is busy but has shown no progress for stall_duration. A transfer
+	 that is progressing below slow_transfer_kbps is only reported as slow.
+	 */
+	bs := fw._block_state(watch_data)
+	stall_duration := block_config(watch_data).StallDuration
+	now := time.Now()
+
+	bs.mu.Lock()
+	state, file, heartbeat := bs.state, bs.file, bs.heartbeat
+	bytes_since := bs.transfer_bytes - bs.wd_bytes
+	secs := now.Sub(bs.wd_time).Seconds()
+	if state != _STATE_DOWNLOADING || bs.wd_time.IsZero() || bytes_since < 0 {
+		bytes_since, secs = 0, 0
+	}
+	bs.wd_bytes, bs.wd_time = bs.transfer_bytes, now
+	bs.mu.Unlock()
+
+	if state == _STATE_SLEEPING || state == _STATE_PAUSED {
+		// Nothing is expected to happen
+		return false
+	}
+	if now.Sub(heartbeat) > stall_duration {
+		block_rt(watch_data).logger.Println("watchdog : No progress while", state, file, "for", now.Sub(heartbeat),
+			"last heartbeat at", heartbeat, ". Watcher is hung, tearing it down.")
+		return true
+	}
+	slow_kbps := block_config(watch_data).SlowTransferKbps
+	if slow_kbps > 0 && secs > 0 {
+		kbps := float64(bytes_since) / 1024.0 / secs
+		if kbps < float64(slow_kbps) {
+			block_rt(watch_data).logger.Printf("watchdog : Slow transfer of %s at %.1f KB/s, below %d KB/s\n", file, kbps, slow_kbps)
+			bs.mu.Lock()
+			reported := bs.slow_reported == file
+			bs.slow_reported = file
+			bs.mu.Unlock()
+			if reported == false {
+				doAlert(fmt.Sprintf("subtab=ftpwatcher;level=warning;subject=%s slow transfer of %s for %s at %.1f KB/s",
+					short_hostname(), file, block_config(watch_data).Name, kbps))
+			}
+		}
+	}
+	return false
+}
+
+func (fw *FTPWatcher) report_restart(watch_data map[string]interface{}) {
+	/*
+	 Sends an alert that a hung watcher was restarted
+	 */
+	bs := fw._block_state(watch_data)
+	bs.mu.Lock()
+	bs.restarts++
+	state, file, heartbeat, restarts := bs.state, bs.file, bs.heartbeat, bs.restarts
+	bs.heartbeat = time.Now() // Give the new watcher a fresh start
+	bs.mu.Unlock()
+	kvpl := fmt.Sprintf("subtab=ftpwatcher;level=critical;subject=%s restarted hung watcher for %s (%s %s, last heartbeat %s, restart %d);escalate=ops;escalate-minutes1=5;escalate-minutes2=15",
+		short_hostname(), block_config(watch_data).Name, state, file, heartbeat.Format("20060102 15:04:05"), restarts)
+	doAlert(kvpl)
+}
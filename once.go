@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+func select_blocks(watchlist []map[string]interface{}, blocks string) ([]map[string]interface{}, error) {
+	/*
+	 Returns the blocks of watchlist named in the comma separated blocks,
+	 or all of them if blocks is empty
+	 */
+	if blocks == "" {
+		return watchlist, nil
+	}
+	selected := make([]map[string]interface{}, 0)
+	for _, name := range strings.Split(blocks, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, watch_data := range watchlist {
+			if block_config(watch_data).Name == name {
+				selected = append(selected, watch_data)
+				found = true
+				break
+			}
+		}
+		if found == false {
+			return nil, fmt.Errorf("No block called %s", name)
+		}
+	}
+	return selected, nil
+}
+
+func (fw *FTPWatcher) _setup_once_signal_handling() {
+	// ctrl+c or SIGTERM stops the pass and lets post processing finish, a second signal exits at once
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		fmt.Printf("Captured %v, stopping the pass..\n", sig)
+		fw.cancel()
+		sig = <-c
+		fmt.Printf("Captured %v again, exiting now\n", sig)
+		os.Exit(1)
+	}()
+}
+
+func run_once(configFile string, watchlist []map[string]interface{}) int {
+	/*
+	 Entry point of --Once, a single pass over every block or those given
+	 by --Blocks, run side by side, then waits for their post processing.
+	 Schedules and poll times are ignored. Returns the exit status : 0 if
+	 every block went through, 1 if anything failed or the run was
+	 interrupted, 2 on bad arguments
+	 */
+	selected, err := select_blocks(watchlist, opt.Blocks)
+	if err != nil {
+		fmt.Println(err, "in", configFile)
+		return 2
+	}
+	fw := newFTPWatcher(selected, false)
+	fw.config_file = configFile
+	fw._setup_once_signal_handling()
+	var passes sync.WaitGroup
+	for _, watch_data := range fw.get_watchers() {
+		passes.Add(1)
+		go func(watch_data map[string]interface{}) {
+			defer passes.Done()
+			block_rt(watch_data).logger.Println("Running a single pass")
+			fw.adjust_stale_time(watch_data)
+			fw.active_passes.Add(1)
+			fw.retry_post_jobs(watch_data, nil)
+			fw.run_pass(fw.ctx, watch_data)
+			fw.active_passes.Done()
+			block_rt(watch_data).quit_server()
+		}(watch_data)
+	}
+	passes.Wait()
+	fw.post_process_pending.Wait()
+
+	failed := 0
+	for _, watch_data := range fw.get_watchers() {
+		blockname := block_config(watch_data).Name
+		bs := fw._block_state(watch_data).status(blockname)
+		fmt.Printf("%s : %d files, %d bytes downloaded, %d failures\n", blockname, bs.Downloaded, bs.TotalBytes, bs.Failures)
+		for _, what := range bs.LastFailures {
+			fmt.Println("    failed :", what)
+		}
+		if bs.Failures > 0 {
+			failed++
+		}
+	}
+	if fw.is_shutting_down() {
+		fmt.Println("Interrupted")
+		return 1
+	}
+	fmt.Printf("%d of %d blocks had failures\n", failed, len(fw.get_watchers()))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
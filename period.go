@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/LDCS/qcfg"
+)
+
+// Upper bounds, in days, of the typical interval between arrivals for each period
+const _DEFAULT_ADAPTIVE_PERIODS = "daily:2,weekly:8,monthly:62,quarterly:185,yearly:400"
+
+// Subdirectory of the lmirror path a file that arrived at t goes to, for each period
+var _ADAPTIVE_PERIOD_DIRS = map[string]func(t time.Time) string{
+	"daily": func(t time.Time) string {
+		return t.Format("20060102")
+	},
+	"weekly": func(t time.Time) string {
+		// The Sunday before, a file arriving on Sunday belongs to the week before
+		if t.Weekday() == time.Sunday {
+			return t.AddDate(0, 0, -7).Format("20060102")
+		}
+		return t.AddDate(0, 0, -int(t.Weekday())).Format("20060102")
+	},
+	"monthly": func(t time.Time) string {
+		return t.Format("200601")
+	},
+	"quarterly": func(t time.Time) string {
+		return fmt.Sprintf("%sQ%d", t.Format("2006"), (int(t.Month())-1)/3+1)
+	},
+	"yearly": func(t time.Time) string {
+		return t.Format("2006")
+	},
+}
+
+type adaptive_period struct {
+	name string
+	max  time.Duration
+}
+
+// PeriodChange is a change of the period adaptive-transpath detected for a file, shown by the CIM "status" command
+type PeriodChange struct {
+	File string
+	From string
+	To   string
+	At   string
+}
+
+func parse_adaptive_periods(spec string) ([]adaptive_period, error) {
+	/*
+	 Parses adaptive_periods= as name:maxdays,... sorted by maxdays
+	 */
+	periods := make([]adaptive_period, 0)
+	for _, part := range strings.Split(spec, _SKIP_PATTERNS_SEP) {
+		kv := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Bad adaptive period " + part)
+		}
+		if _, ok := _ADAPTIVE_PERIOD_DIRS[kv[0]]; ok == false {
+			return nil, errors.New("Unknown adaptive period " + kv[0])
+		}
+		days, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || days <= 0 {
+			return nil, errors.New("Bad number of days in adaptive period " + part)
+		}
+		periods = append(periods, adaptive_period{kv[0], time.Duration(days * 24 * float64(time.Hour))})
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].max < periods[j].max })
+	return periods, nil
+}
+
+func classify_arrivals(arrivals []time.Time, periods []adaptive_period) string {
+	/*
+	 Returns the period whose bound the median interval between arrivals
+	 is under, blank if there are too few arrivals or none fits
+	 */
+	if len(arrivals) < 2 {
+		return ""
+	}
+	intervals := make([]time.Duration, 0)
+	for idx := 1; idx < len(arrivals); idx++ {
+		intervals = append(intervals, arrivals[idx].Sub(arrivals[idx-1]))
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	median := intervals[len(intervals)/2]
+	for _, p := range periods {
+		if median < p.max {
+			return p.name
+		}
+	}
+	return ""
+}
+
+// period_meta is what adaptive-transpath keeps about a file in its .meta file
+type period_meta struct {
+	meta     string
+	ccfg     *qcfg.CfgBlock
+	period   string
+	arrivals []time.Time
+	pinned   bool
+}
+
+func read_period_meta(meta string) *period_meta {
+	pm := &period_meta{meta: meta}
+	if _, err := os.Stat(meta); err != nil {
+		pm.ccfg = qcfg.NewCfgMem(meta)
+		return pm
+	}
+	pm.ccfg = qcfg.NewCfg(meta, meta, false)
+	pm.period = pm.ccfg.Str("ftpwatcher", "file", "periodicity", "")
+	pm.pinned = pm.ccfg.Str("ftpwatcher", "file", "period_pinned", "0") == "1"
+	for _, secs := range strings.Split(pm.ccfg.Str("ftpwatcher", "file", "arrivals", ""), _SKIP_PATTERNS_SEP) {
+		if n, err := strconv.ParseInt(secs, 10, 64); err == nil {
+			pm.arrivals = append(pm.arrivals, time.Unix(n, 0))
+		}
+	}
+	return pm
+}
+
+func (pm *period_meta) add_arrival(t time.Time, history int) {
+	if t.IsZero() {
+		return
+	}
+	if len(pm.arrivals) > 0 && pm.arrivals[len(pm.arrivals)-1].Unix() >= t.Unix() {
+		return
+	}
+	pm.arrivals = append(pm.arrivals, t)
+	if history > 1 && len(pm.arrivals) > history {
+		pm.arrivals = pm.arrivals[len(pm.arrivals)-history:]
+	}
+}
+
+func (pm *period_meta) write() {
+	arrivals := make([]string, 0)
+	for _, t := range pm.arrivals {
+		arrivals = append(arrivals, strconv.FormatInt(t.Unix(), 10))
+	}
+	pinned := "0"
+	if pm.pinned {
+		pinned = "1"
+	}
+	pm.ccfg.EditEntry("ftpwatcher", "file", "periodicity", pm.period)
+	pm.ccfg.EditEntry("ftpwatcher", "file", "arrivals", strings.Join(arrivals, _SKIP_PATTERNS_SEP))
+	pm.ccfg.EditEntry("ftpwatcher", "file", "period_pinned", pinned)
+	pm.ccfg.CfgWrite(pm.meta)
+}
+
+func (bs *block_state) add_period_change(change PeriodChange) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.period_changes = append(bs.period_changes, change)
+	if len(bs.period_changes) > 50 {
+		bs.period_changes = bs.period_changes[len(bs.period_changes)-50:]
+	}
+}
+
+func (fw *FTPWatcher) record_period_change(logger *log.Logger, bs *block_state, file, from, to string) {
+	logger.Println("adaptive-transpath : period of", file, "changed from", from, "to", to)
+	bs.add_period_change(PeriodChange{
+		File: file, From: from, To: to, At: time.Now().Format("20060102 15:04:05"),
+	})
+}
+
+func (fw *FTPWatcher) reclassify(watch_data map[string]interface{}, file, period string) (string, error) {
+	/*
+	 Pins the period of file, a path under the block's destination, or
+	 with period "auto" unpins it and classifies it again from its history
+	 */
+	dest := block_config(watch_data).Dest
+	if path.IsAbs(file) == false {
+		file = path.Join(dest, file)
+	}
+	meta := file + ".meta"
+	if _, err := os.Stat(meta); err != nil {
+		return "", errors.New("No meta file " + meta)
+	}
+	pm := read_period_meta(meta)
+	from := pm.period
+	if period == "auto" {
+		pm.pinned = false
+		spec := _DEFAULT_ADAPTIVE_PERIODS
+		for _, stage := range block_config(watch_data).Stages {
+			if stage.Plugin == "adaptive-transpath" {
+				spec = stage.Params["adaptive_periods"]
+			}
+		}
+		periods, err := parse_adaptive_periods(spec)
+		if err != nil {
+			return "", err
+		}
+		if p := classify_arrivals(pm.arrivals, periods); p != "" {
+			pm.period = p
+		}
+	} else {
+		if _, ok := _ADAPTIVE_PERIOD_DIRS[period]; ok == false {
+			return "", errors.New("Unknown period " + period)
+		}
+		pm.pinned = true
+		pm.period = period
+	}
+	pm.write()
+	if from != pm.period {
+		fw.record_period_change(block_rt(watch_data).logger, fw._block_state(watch_data), file, from, pm.period)
+	}
+	return pm.period, nil
+}
+
+func reclassify_file(data interface{}, cmd string, args ...string) string {
+	/*
+	 CIM callback for reclassify block file [period|auto]
+	 */
+	fw := data.(*FTPWatcher)
+	if cmd != "reclassify" {
+		return ""
+	}
+	if len(args) < 2 {
+		return "Usage : reclassify block file [daily|weekly|monthly|quarterly|yearly|auto]"
+	}
+	watch_data := fw.find_watcher(args[0])
+	if watch_data == nil {
+		return "No block called " + args[0]
+	}
+	period := "auto"
+	if len(args) > 2 {
+		period = args[2]
+	}
+	got, err := fw.reclassify(watch_data, args[1], period)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Period of %s is %s\n", args[1], got)
+}
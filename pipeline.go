@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+	"github.com/LDCS/qcfg"
+)
+
+// Parameters an lmirror stage reads from the lmirror row. A stage labelled L
+// looks up L_<param> first and falls back to <param>, so the same plugin can
+// be used twice with different parameters.
+var _LMIRROR_STAGE_PARAMS = map[string]string{
+	"lmirror_path_format":       "",
+	"zipfmt":                    "xz",
+	"zip_level":                 "",
+	"zip_threads":               "",
+	"zip_keep_original":         "0",
+	"zip_verify":                "1",
+	"zip_ext_map":               "",
+	"split_cmd":                 "",
+	"plugin_cmd":                "",
+	"plugin_timeout":            _DEFAULT_PLUGIN_TIMEOUT,
+	"extract_dir":               "",
+	"extract_include":           "",
+	"extract_path_format":       "__MEMBER__",
+	"decrypt_keyring":           "",
+	"decrypt_passphrase_file":   "",
+	"decrypt_passphrase_env":    "",
+	"decrypt_require_signature": "0",
+	"filename_regex":            "",
+	"collision_policy":          "old",
+	"fsync":                     "0",
+	"adaptive_periods":          _DEFAULT_ADAPTIVE_PERIODS,
+	"adaptive_history":          "6",
+	"match":                     "",
+	"template_tz":               "local",
+	"nominal_date_from":         "path",
+}
+
+// lmirror_stage is one entry of "lmirror :: plugins=", written as plugin or plugin/label
+type lmirror_stage struct {
+	Plugin string
+	Label  string
+	Params map[string]string
+	// Filename patterns the stage applies to, other inputs pass through unchanged
+	Match []string
+}
+
+func parse_lmirror_stages(ccfg *qcfg.CfgBlock, block_name, plugins string) []*lmirror_stage {
+	stages := make([]*lmirror_stage, 0)
+	for _, spec := range strings.Split(plugins, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		stage := new(lmirror_stage)
+		stage.Plugin = spec
+		stage.Label = spec
+		if idx := strings.Index(spec, "/"); idx != -1 {
+			stage.Plugin = spec[:idx]
+			stage.Label = spec[idx+1:]
+		}
+		stage.Params = make(map[string]string)
+		for param, def := range _LMIRROR_STAGE_PARAMS {
+			stage.Params[param] = ccfg.Str(block_name, _CONFIG_LMIRROR_ROW, stage.Label+"_"+param,
+				ccfg.Str(block_name, _CONFIG_LMIRROR_ROW, param, def))
+		}
+		if stage.Params["match"] != "" {
+			stage.Match = strings.Split(stage.Params["match"], _SKIP_PATTERNS_SEP)
+		}
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+func (stage *lmirror_stage) matches(filename string) bool {
+	if len(stage.Match) == 0 {
+		return true
+	}
+	for _, pat := range stage.Match {
+		if matched, _ := path.Match(pat, path.Base(filename)); matched == true {
+			return true
+		}
+	}
+	return false
+}
+
+func (fw *FTPWatcher) run_lmirror_pipeline_from(watch_data map[string]interface{}, destfile, infile, remote_path string, t1, t2 time.Time) ([]LmirrorOutput, error) {
+	/*
+	 Runs the lmirror stages in cfg order. Each stage gets every output
+	 of the previous stage, the first stage gets infile, the downloaded
+	 file or what its link points at. Stops at the first stage that fails.
+	 */
+	stages := block_config(watch_data).Stages
+	items := []LmirrorOutput{LmirrorOutput{Path: infile}}
+	for _, stage := range stages {
+		next := make([]LmirrorOutput, 0)
+		for _, item := range items {
+			if stage.matches(item.Path) == false {
+				next = append(next, item)
+				continue
+			}
+			lctx := fw.new_lmirror_context(watch_data, stage, destfile, item.Path, remote_path, t1, t2)
+			result, err := fw.lmirror_plugins[stage.Plugin].Run(fw, lctx)
+			if err != nil {
+				lctx.Logger.Println("lmirror stage", stage.Label, "failed on", item.Path, ":", err, "- stopping the pipeline for", destfile)
+				return nil, err
+			}
+			for _, out := range result.Outputs {
+				lctx.Logger.Println("lmirror stage", stage.Label, ":", item.Path, "->", out.Path)
+			}
+			next = append(next, result.Outputs...)
+		}
+		items = next
+	}
+	if len(stages) > 0 {
+		// Outputs of the last stage that were passed through still need their checksum
+		for idx := range items {
+			if items[idx].Sha256 == "" {
+				items[idx], _ = lmirror_output(items[idx].Path)
+			}
+		}
+	}
+	return items, nil
+}
+
+func (fw *FTPWatcher) is_lmirror_main(destfile, infile string) bool {
+	/*
+	 True if infile is the downloaded file itself, or what its link in the destination dir points at
+	 */
+	if infile == destfile {
+		return true
+	}
+	target, err := os.Readlink(destfile)
+	return err == nil && target == infile
+}
+
+func relink_lmirror_main(logger *log.Logger, destfile, target string, modtime time.Time) error {
+	/*
+	 Points the link in the destination dir at target and gives it modtime
+	 */
+	if err := os.Remove(destfile); err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	if err := os.Symlink(target, destfile); err != nil {
+		return err
+	}
+	touch_link(logger, destfile, modtime)
+	return nil
+}
+
+func touch_link(logger *log.Logger, link string, modtime time.Time) {
+	/*
+	 Gives link modtime, Chtimes would change what it points at
+	 */
+	out, err := exec.Command("touch", "-h", "-t", modtime.Format("200601021504.05"), link).CombinedOutput()
+	if err != nil {
+		logger.Println("Cannot set the time of", link, ":", err, string(out))
+	}
+}
+
+func (fw *FTPWatcher) place_lmirror_file(lctx *LmirrorContext, plugin, infile, lm_path string, modtime time.Time) (string, error) {
+	/*
+	 Moves infile into the lmirror dir lm_path, handling an existing file
+	 as collision_policy= says, records it in the versions index and
+	 relinks the destination dir if infile was the downloaded file
+	 */
+	destfile := lctx.Destfile
+	logger := lctx.Logger
+	if lctx.make_dir(lm_path, fw._default_permission) == false {
+		logger.Println(plugin, "plugin error : Cannot make lmirror_dir = ", lm_path)
+		return "", errors.New("Cannot make lmirror_dir = " + lm_path)
+	}
+	is_main := fw.is_lmirror_main(destfile, infile)
+	dst := path.Join(lm_path, path.Base(infile))
+	if dst == infile {
+		return dst, nil
+	}
+	policy, err := parse_collision_policy(lctx.Params["collision_policy"])
+	if err != nil {
+		return "", err
+	}
+	current, err := lmirror_output(infile)
+	if err != nil {
+		logger.Printf("%s plugin error : Cannot read %s\n", plugin, infile)
+		return "", err
+	}
+	moved := make(map[string]string)
+	if _, err := os.Stat(dst); err == nil {
+		if policy.skip_identical {
+			if existing, err := lmirror_output(dst); err == nil && existing.Sha256 == current.Sha256 {
+				logger.Println(plugin+":", dst, "exists with the same checksum, not placing", infile)
+				os.Remove(infile)
+				if is_main == true {
+					if err := relink_lmirror_main(lctx.Logger, destfile, dst, modtime); err != nil {
+						logger.Printf("%s plugin error : Cannot create symlink %s->%s\n", plugin, destfile, dst)
+						return dst, err
+					}
+				}
+				return dst, nil
+			}
+		}
+		moved, err = fw.make_room_for_version(logger, plugin, dst, policy)
+		if err != nil {
+			logger.Printf("%s plugin error : Cannot move %s out of the way : %v\n", plugin, dst, err)
+			return "", err
+		}
+	}
+	method, err := place_file(infile, dst, modtime, false, lctx.Params["fsync"] == "1")
+	if err != nil {
+		logger.Printf("%s plugin error : Cannot move %s to %s : %v\n", plugin, infile, dst, err)
+		return "", err
+	}
+	logger.Printf("%s : placed %s as %s by %s\n", plugin, infile, dst, method)
+	if is_main == true {
+		if err := relink_lmirror_main(lctx.Logger, destfile, dst, modtime); err != nil {
+			logger.Printf("%s plugin error : Cannot create symlink %s->%s\n", plugin, destfile, dst)
+			return dst, err
+		}
+	}
+	current.Path = dst
+	if err := update_versions(dst, current, modtime, moved); err != nil {
+		logger.Printf("%s plugin error : Cannot update the versions index of %s : %v\n", plugin, dst, err)
+	}
+	return dst, nil
+}
+
+func meta_outputs_block(cfg *qcfg.CfgBlock) string {
+	/*
+	 The block of a meta file recording the outputs of split or extract,
+	 the first block if none does. adaptive-transpath keeps its own block
+	 in the same file.
+	 */
+	blocks := cfg.GetBlocks()
+	if len(blocks) == 0 {
+		return ""
+	}
+	for _, block := range blocks {
+		if cfg.Str(block, "file", "outfiles", "") != "" {
+			return block
+		}
+	}
+	return blocks[0]
+}
+
+func meta_outfiles(cfg *qcfg.CfgBlock, block string) []string {
+	/*
+	 The outfiles= of a meta file block. Split programs write the names
+	 comma separated, extract writes them query escaped, as member names
+	 may hold commas, and says so with outfiles_encoding=query.
+	 */
+	files := strings.Split(cfg.Str(block, "file", "outfiles", ""), ",")
+	if cfg.Str(block, "file", "outfiles_encoding", "") == "query" {
+		for idx, f := range files {
+			if name, err := url.QueryUnescape(f); err == nil {
+				files[idx] = name
+			}
+		}
+	}
+	return files
+}
+
+func set_meta_outfiles(cfg *qcfg.CfgBlock, block string, files []string) {
+	escaped := make([]string, 0)
+	for _, f := range files {
+		escaped = append(escaped, url.QueryEscape(f))
+	}
+	cfg.EditEntry(block, "file", "outfiles", strings.Join(escaped, ","))
+	cfg.EditEntry(block, "file", "outfiles_encoding", "query")
+}
+
+func read_split_meta(meta string) (string, []string) {
+	/*
+	 Returns the output dir and files a split program recorded in its meta file
+	 */
+	cfg := qcfg.NewCfg(meta+"."+time.Now().Format("20060102T150405.000"), meta, false)
+	block := meta_outputs_block(cfg)
+	if block == "" {
+		return "", nil
+	}
+	outdir := cfg.Str(block, "file", "outdir", "")
+	files := make([]string, 0)
+	for _, f := range meta_outfiles(cfg, block) {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return outdir, files
+}
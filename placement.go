@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+func place_file(src, dst string, modtime time.Time, keep_src, fsync bool) (string, error) {
+	/*
+	 Moves src to dst, or copies it if keep_src, so that readers never see
+	 a partial dst. Uses a rename or hardlink when src and dst share a
+	 filesystem, else a reflink or copy to dst@ renamed into place.
+	 The permissions of src and modtime are set on dst here.
+	 Returns how the file was placed.
+	 */
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	tmp := dst + "@"
+	os.Remove(tmp)
+	method := ""
+	if keep_src == false && os.Rename(src, dst) == nil {
+		method = "rename"
+	} else if keep_src == true && os.Link(src, tmp) == nil {
+		method = "hardlink"
+	} else {
+		if method, err = copy_file(src, tmp, fi.Mode().Perm(), fsync); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+	if method != "rename" {
+		os.Chtimes(tmp, modtime, modtime)
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+		if keep_src == false {
+			os.Remove(src)
+		}
+	}
+	os.Chmod(dst, fi.Mode().Perm())
+	os.Chtimes(dst, modtime, modtime)
+	if fsync {
+		sync_dir(path.Dir(dst))
+	}
+	return method, nil
+}
+
+func copy_file(src, dst string, perm os.FileMode, fsync bool) (string, error) {
+	/*
+	 Copies src to a new dst, as a reflink where the filesystem supports it
+	 */
+	sf, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return "", err
+	}
+	method := "reflink"
+	if reflink(df, sf) != nil {
+		method = "copy"
+		if _, err := io.Copy(df, sf); err != nil {
+			df.Close()
+			return "", err
+		}
+	}
+	if fsync {
+		if err := df.Sync(); err != nil {
+			df.Close()
+			return "", err
+		}
+	}
+	return method, df.Close()
+}
+
+func sync_dir(dir string) {
+	if fp, err := os.Open(dir); err == nil {
+		fp.Sync()
+		fp.Close()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+	"github.com/LDCS/qcfg"
+)
+
+// LmirrorContext is what an lmirror plugin gets for each input of its stage
+type LmirrorContext struct {
+	Block       string
+	BlockConfig *BlockConfig           // The block's settings
+	Label       string                 // Stage label, the plugin name unless given as plugin/label
+	Params      map[string]string      // Stage parameters from the lmirror row
+	Logger      *log.Logger
+	// Link to the downloaded file in the destination dir
+	Destfile string
+	// Input of this stage, the downloaded file for the first stage
+	Infile string
+	// Remote path and directory of the downloaded file
+	RemotePath string
+	RemoteDir  string
+	RemoteMtime time.Time
+	// Timestamp of the version replaced by this download, zero on first download
+	PreviousMtime time.Time
+	// Period recorded by adaptive-transpath for this file, blank if none
+	PreviousPeriod string
+	// Runtime state of the block, for the built-in plugins
+	state *block_state
+}
+
+// LmirrorOutput is one file produced by a stage
+type LmirrorOutput struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// LmirrorResult lists every output of a stage for one input
+type LmirrorResult struct {
+	Outputs []LmirrorOutput
+}
+
+// LmirrorPlugin is implemented by lmirror plugins registered with register_lmirror_func
+type LmirrorPlugin interface {
+	Run(fw *FTPWatcher, lctx *LmirrorContext) (*LmirrorResult, error)
+}
+
+// Run makes plain plugin functions LmirrorPlugins, adding size and checksum to their outputs
+func (f lmirror_plugin_function) Run(fw *FTPWatcher, lctx *LmirrorContext) (*LmirrorResult, error) {
+	paths, err := f(fw, lctx)
+	if err != nil {
+		return nil, err
+	}
+	result := new(LmirrorResult)
+	for _, p := range paths {
+		out, err := lmirror_output(p)
+		if err != nil {
+			return nil, err
+		}
+		result.Outputs = append(result.Outputs, out)
+	}
+	return result, nil
+}
+
+func lmirror_output(filename string) (LmirrorOutput, error) {
+	/*
+	 Stats and checksums an output file
+	 */
+	out := LmirrorOutput{Path: filename}
+	fp, err := os.Open(filename)
+	if err != nil {
+		return out, err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, fp)
+	if err != nil {
+		return out, err
+	}
+	out.Size = n
+	out.Sha256 = fmt.Sprintf("%x", h.Sum(nil))
+	return out, nil
+}
+
+// make_dir makes dir and its parents if needed, logging why it could not
+func (lctx *LmirrorContext) make_dir(dir string, mode os.FileMode) bool {
+	if err := os.MkdirAll(dir, mode); err != nil {
+		lctx.Logger.Printf("Could not create the dir %s. Error : %s", dir, err)
+		return false
+	}
+	return true
+}
+
+func (fw *FTPWatcher) new_lmirror_context(watch_data map[string]interface{}, stage *lmirror_stage, destfile, infile, remote_path string, t1, t2 time.Time) *LmirrorContext {
+	lctx := new(LmirrorContext)
+	lctx.BlockConfig = block_config(watch_data)
+	lctx.Block = lctx.BlockConfig.Name
+	lctx.Label = stage.Label
+	lctx.Params = stage.Params
+	lctx.Logger = block_rt(watch_data).logger
+	lctx.state = block_rt(watch_data).state
+	lctx.Destfile = destfile
+	lctx.Infile = infile
+	lctx.RemotePath = remote_path
+	lctx.RemoteDir = path.Dir(remote_path)
+	lctx.RemoteMtime = t2
+	lctx.PreviousMtime = t1
+	if _, err := os.Stat(destfile + ".meta"); err == nil {
+		ccfg := qcfg.NewCfg(destfile+".meta", destfile+".meta", false)
+		lctx.PreviousPeriod = ccfg.Str("ftpwatcher", "file", "periodicity", "")
+	}
+	return lctx
+}
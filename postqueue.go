@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Where a block keeps the downloads whose post-processing failed, in its log dir
+const _POST_QUEUE_FILE = "postqueue.json"
+
+// Longest wait between two retries of the same file
+const _POST_RETRY_MAX_BACKOFF = 24 * time.Hour
+
+// PostJob is a download whose post-download commands or lmirror plugins failed.
+// It is retried with backoff until it succeeds or runs out of retries, when it
+// becomes a dead letter that is only retried by the CIM "retry" command.
+type PostJob struct {
+	File        string
+	RemotePath  string
+	LinkMtime   time.Time
+	RemoteMtime time.Time
+	Attempts    int
+	LastError   string
+	FirstFailed string
+	LastFailed  string
+	NextTry     time.Time
+	Dead        bool
+}
+
+// post_queue is the durable retry queue of a block, shared by its post process threads
+type post_queue struct {
+	mu      sync.Mutex
+	file    string
+	jobs    map[string]*PostJob
+	running map[string]bool
+}
+
+func load_post_queue(file string) *post_queue {
+	pq := &post_queue{file: file, jobs: make(map[string]*PostJob), running: make(map[string]bool)}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return pq
+	}
+	jobs := make([]*PostJob, 0)
+	json.Unmarshal(buf, &jobs)
+	for _, job := range jobs {
+		pq.jobs[job.File] = job
+	}
+	return pq
+}
+
+// list returns a copy of the jobs sorted by file, the caller holds pq.mu
+func (pq *post_queue) list() []PostJob {
+	jobs := make([]PostJob, 0)
+	for _, job := range pq.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].File < jobs[j].File })
+	return jobs
+}
+
+// save writes the queue out, the caller holds pq.mu
+func (pq *post_queue) save() error {
+	out, _ := json.MarshalIndent(pq.list(), "", "    ")
+	tmp := pq.file + "@"
+	if err := ioutil.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, pq.file)
+}
+
+func (fw *FTPWatcher) _post_queue(watch_data map[string]interface{}) *post_queue {
+	return block_rt(watch_data).posts
+}
+
+func post_retry_backoff(watch_data map[string]interface{}, attempts int) time.Duration {
+	backoff := block_config(watch_data).PostRetryBackoff
+	if backoff <= 0 {
+		backoff = 5 * time.Minute
+	}
+	for idx := 1; idx < attempts && backoff < _POST_RETRY_MAX_BACKOFF; idx++ {
+		backoff *= 2
+	}
+	if backoff > _POST_RETRY_MAX_BACKOFF {
+		backoff = _POST_RETRY_MAX_BACKOFF
+	}
+	return backoff
+}
+
+func alert_post_processing_dead(blockname, file string, attempts int) {
+	kvpl := fmt.Sprintf("subtab=ftpwatcher;level=critical;subject=%s post-processing of %s in %s failed %d times, giving up;escalate=ops;escalate-minutes1=5;escalate-minutes2=15", short_hostname(), file, blockname, attempts)
+	doAlert(kvpl)
+}
+
+func (fw *FTPWatcher) post_failed(watch_data map[string]interface{}, fullname, remote_path string, t1, t2 time.Time, err error) {
+	/*
+	 Records a failed post-processing of fullname and schedules its retry,
+	 or makes it a dead letter once post_retries= retries have failed or
+	 an exec plugin reported the error as not retryable
+	 */
+	logger := block_rt(watch_data).logger
+	pq := fw._post_queue(watch_data)
+	pq.mu.Lock()
+	job, ok := pq.jobs[fullname]
+	if !ok {
+		job = &PostJob{File: fullname, FirstFailed: time.Now().Format("20060102 15:04:05")}
+		pq.jobs[fullname] = job
+	}
+	delete(pq.running, fullname)
+	job.RemotePath, job.LinkMtime, job.RemoteMtime = remote_path, t1, t2
+	job.Attempts++
+	job.LastError = err.Error()
+	job.LastFailed = time.Now().Format("20060102 15:04:05")
+	retries := block_config(watch_data).PostRetries
+	var perr *ExtPluginError
+	if errors.As(err, &perr) && perr.Retryable == false {
+		job.Dead = true
+		logger.Printf("Post processing of %s failed with an error that is not retryable, moved to the dead letters : %v\n", fullname, err)
+	} else if job.Attempts > retries {
+		job.Dead = true
+		logger.Printf("Post processing of %s failed %d times, moved to the dead letters : %v\n", fullname, job.Attempts, err)
+	} else {
+		job.NextTry = time.Now().Add(post_retry_backoff(watch_data, job.Attempts))
+		logger.Printf("Post processing of %s failed, attempt %d of %d, retrying after %s : %v\n",
+			fullname, job.Attempts, retries+1, job.NextTry.Format("20060102 15:04:05"), err)
+	}
+	dead, attempts := job.Dead, job.Attempts
+	if err := pq.save(); err != nil {
+		logger.Println("Cannot write the post processing queue", pq.file, ":", err)
+	}
+	pq.mu.Unlock()
+	fw._block_state(watch_data).add_failure("post-processing of " + fullname)
+	if dead {
+		alert_post_processing_dead(block_config(watch_data).Name, fullname, attempts)
+	}
+	fw.publish_post_queues()
+}
+
+func (fw *FTPWatcher) post_succeeded(watch_data map[string]interface{}, fullname string) {
+	/*
+	 Drops fullname from the queue once its post-processing went through
+	 */
+	pq := fw._post_queue(watch_data)
+	pq.mu.Lock()
+	job, ok := pq.jobs[fullname]
+	delete(pq.running, fullname)
+	if ok {
+		block_rt(watch_data).logger.Printf("Post processing of %s succeeded after %d failed attempts\n", fullname, job.Attempts)
+		delete(pq.jobs, fullname)
+		pq.save()
+	}
+	pq.mu.Unlock()
+	if ok {
+		fw.publish_post_queues()
+	}
+}
+
+func (fw *FTPWatcher) enqueue_post_job(watch_data map[string]interface{}, job PostJob) bool {
+	post_download := block_config(watch_data).PostDownload
+	fw.post_process_pending.Add(1)
+	if fw._add_work_to_queue(watch_data, block_rt(watch_data).post_in,
+		download_process, job.File, post_download, job.LinkMtime, job.RemoteMtime, job.RemotePath) == false {
+		// The block was stopped, the job stays queued for its next start
+		fw.post_process_pending.Done()
+		pq := fw._post_queue(watch_data)
+		pq.mu.Lock()
+		delete(pq.running, job.File)
+		pq.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+func (fw *FTPWatcher) retry_post_jobs(watch_data map[string]interface{}, files []string) int {
+	/*
+	 Sends the queued jobs that are due to the post process threads. With
+	 files, those files are retried now, dead letters included, "all"
+	 retrying every queued file. Returns the number of jobs sent.
+	 */
+	rt := block_rt(watch_data)
+	if rt.post_in == nil || rt.ctx.Err() != nil {
+		return 0
+	}
+	logger := rt.logger
+	pq := fw._post_queue(watch_data)
+	wanted := make(map[string]bool)
+	for _, file := range files {
+		wanted[file] = true
+	}
+	due := make([]PostJob, 0)
+	pq.mu.Lock()
+	for name, job := range pq.jobs {
+		if pq.running[name] {
+			continue
+		}
+		if len(files) > 0 {
+			if wanted["all"] == false && wanted[name] == false && wanted[path.Base(name)] == false {
+				continue
+			}
+			job.Dead = false
+		} else if job.Dead || time.Now().Before(job.NextTry) {
+			continue
+		}
+		if _, err := os.Lstat(name); err != nil {
+			logger.Println("Dropping", name, "from the post processing queue, it no longer exists")
+			delete(pq.jobs, name)
+			continue
+		}
+		pq.running[name] = true
+		due = append(due, *job)
+	}
+	pq.save()
+	pq.mu.Unlock()
+	sent := 0
+	for _, job := range due {
+		logger.Printf("Retrying post processing of %s, %d failed attempts so far\n", job.File, job.Attempts)
+		if fw.enqueue_post_job(watch_data, job) {
+			sent++
+		}
+	}
+	if len(due) > 0 {
+		fw.publish_post_queues()
+	}
+	return sent
+}
+
+func (fw *FTPWatcher) publish_post_queues() {
+	/*
+	 Puts the queued jobs of every block under "postqueue" in the JSON file
+	 */
+	queues := make(map[string][]PostJob)
+	for _, watch_data := range fw.get_watchers() {
+		pq := fw._post_queue(watch_data)
+		pq.mu.Lock()
+		if len(pq.jobs) > 0 {
+			queues[block_config(watch_data).Name] = pq.list()
+		}
+		pq.mu.Unlock()
+	}
+	fw.update_json(func(data map[string]interface{}) {
+		data["postqueue"] = queues
+	})
+	fw.write_json_file()
+}
+
+func post_queue_command(data interface{}, cmd string, args ...string) string {
+	/*
+	 CIM callback for "postqueue [block ...]", listing the queued and dead
+	 jobs, and "retry block [file ...|all]", retrying them now
+	 */
+	fw := data.(*FTPWatcher)
+	switch cmd {
+	case "postqueue":
+		blocks := args
+		if len(blocks) == 0 {
+			for _, watch_data := range fw.get_watchers() {
+				blocks = append(blocks, block_config(watch_data).Name)
+			}
+		}
+		queues := make(map[string][]PostJob)
+		for _, blockname := range blocks {
+			watch_data := fw.find_watcher(blockname)
+			if watch_data == nil {
+				return fmt.Sprintf("No block called %s", blockname)
+			}
+			pq := fw._post_queue(watch_data)
+			pq.mu.Lock()
+			queues[blockname] = pq.list()
+			pq.mu.Unlock()
+		}
+		out, _ := json.MarshalIndent(queues, "", "    ")
+		return string(out)
+	case "retry":
+		if len(args) < 1 {
+			return "Usage : retry block [file ...|all]"
+		}
+		watch_data := fw.find_watcher(args[0])
+		if watch_data == nil {
+			return "No block called " + args[0]
+		}
+		files := args[1:]
+		if len(files) == 0 {
+			files = []string{"all"}
+		}
+		block_rt(watch_data).logger.Printf("CIM command %s %v\n", cmd, args)
+		return fmt.Sprintf("Retrying post processing of %d files in %s\n", fw.retry_post_jobs(watch_data, files), args[0])
+	}
+	return ""
+}
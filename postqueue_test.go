@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPostRetryBackoff(t *testing.T) {
+	tests := []struct {
+		backoff  time.Duration
+		attempts int
+		want     time.Duration
+	}{
+		{5 * time.Minute, 1, 5 * time.Minute},
+		{5 * time.Minute, 2, 10 * time.Minute},
+		{5 * time.Minute, 4, 40 * time.Minute},
+		{0, 1, 5 * time.Minute},
+		{-time.Minute, 3, 20 * time.Minute},
+		{time.Hour, 5, 16 * time.Hour},
+		{time.Hour, 6, _POST_RETRY_MAX_BACKOFF},
+		{time.Hour, 100, _POST_RETRY_MAX_BACKOFF},
+		{48 * time.Hour, 1, _POST_RETRY_MAX_BACKOFF},
+	}
+	for _, tt := range tests {
+		watch_data := map[string]interface{}{"config": &BlockConfig{PostRetryBackoff: tt.backoff}}
+		if got := post_retry_backoff(watch_data, tt.attempts); got != tt.want {
+			t.Errorf("post_retry_backoff(%s, %d) = %s, want %s", tt.backoff, tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestPostRetryAfterRelink(t *testing.T) {
+	// transpath places the file and relinks it, the stage after it fails once
+	dir := t.TempDir()
+	fw := &FTPWatcher{lmirror_plugins: make(map[string]LmirrorPlugin), _default_permission: 0755,
+		__log_filename: "test.log", __post_queue_file: _POST_QUEUE_FILE, jsondata: []map[string]interface{}{{}}}
+	fw.ctx, fw.cancel = context.WithCancel(context.Background())
+	defer fw.cancel()
+	fw.register_builtin_plugins()
+	fails := 1
+	fw.register_lmirror_func("flaky", lmirror_plugin_function(func(fw *FTPWatcher, lctx *LmirrorContext) ([]string, error) {
+		if fails > 0 {
+			fails--
+			return nil, errors.New("flaky")
+		}
+		return []string{lctx.Infile}, nil
+	}))
+	lm := filepath.Join(dir, "lm")
+	cfg := &BlockConfig{Name: "a", LogDir: dir, Dest: filepath.Join(dir, "dest"), PostRetries: 3, Stages: []*lmirror_stage{
+		{Plugin: "transpath", Label: "transpath", Params: map[string]string{"lmirror_path_format": lm}},
+		{Plugin: "flaky", Label: "flaky", Params: map[string]string{}},
+	}}
+	watch_data := map[string]interface{}{"config": cfg, "runtime": fw.new_block_runtime(cfg, nil)}
+	os.MkdirAll(cfg.Dest, 0755)
+	destfile := filepath.Join(cfg.Dest, "f.txt")
+	if err := ioutil.WriteFile(destfile, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now()
+	for attempt := 1; attempt <= 2; attempt++ {
+		fw.post_process_pending.Add(1)
+		download_process(fw, watch_data, 0, destfile, "", mtime, mtime, "/f.txt")
+	}
+	placed := filepath.Join(lm, "f.txt")
+	if target, err := filepath.EvalSymlinks(destfile); err != nil || target != placed {
+		t.Errorf("%s links to %q (%v), want %s", destfile, target, err, placed)
+	}
+	if data, err := ioutil.ReadFile(placed); err != nil || string(data) != "data" {
+		t.Errorf("%s holds %q (%v), want the download", placed, data, err)
+	}
+	if _, err := os.Lstat(placed + ".old"); err == nil {
+		t.Errorf("the retry moved %s out of its own way", placed)
+	}
+	if jobs := fw._post_queue(watch_data).list(); len(jobs) != 0 {
+		t.Errorf("queued after the retry : %v", jobs)
+	}
+}
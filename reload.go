@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+func (fw *FTPWatcher) get_watchers() []map[string]interface{} {
+	fw.watchers_mu.RLock()
+	defer fw.watchers_mu.RUnlock()
+	return append([]map[string]interface{}{}, fw.watchers...)
+}
+
+func (fw *FTPWatcher) add_watcher(watch_data map[string]interface{}) {
+	fw.watchers_mu.Lock()
+	defer fw.watchers_mu.Unlock()
+	fw.watchers = append(fw.watchers, watch_data)
+}
+
+// work_queue is a channel of work that may be closed while others still try to send on it
+type work_queue struct {
+	mu     sync.RWMutex
+	ch     chan work
+	closed bool
+}
+
+func new_work_queue(size int) *work_queue {
+	return &work_queue{ch: make(chan work, size)}
+}
+
+func (q *work_queue) send(w work) bool {
+	/*
+	 Sends w, or returns false if the queue is already closed
+	 */
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+	q.ch <- w
+	return true
+}
+
+func (q *work_queue) close() {
+	/*
+	 Closes the channel once the sends in progress are through, the
+	 threads reading it still get what was queued
+	 */
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed == false {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+func config_fingerprint(cfg *BlockConfig) string {
+	/*
+	 Fingerprint of the settings of a block, used to find changed blocks on reload
+	 */
+	out, _ := json.Marshal(cfg)
+	return fmt.Sprintf("%x", sha1.Sum(append(out, cfg.Passwd...)))
+}
+
+func (fw *FTPWatcher) stop_watcher(watch_data map[string]interface{}) bool {
+	/*
+	 Stops the watcher and warn scheduler of a block. The pass in progress
+	 finishes its current file, and the post process threads exit once
+	 the queue is drained. Returns false if the pass is still running after
+	 the drain timeout, the queue is then closed when it ends.
+	 */
+	rt := block_rt(watch_data)
+	rt.logger.Println("Stopping block")
+	rt.cancel()
+	close(rt.warn_in)
+	if wait_with_timeout(rt.passes.Wait, fw.drain_timeout) == false {
+		rt.logger.Printf("Pass still in progress after %s, block not stopped yet\n", fw.drain_timeout)
+		go func() {
+			rt.passes.Wait()
+			rt.close_post_process_queue()
+			rt.logger.Println("Block stopped")
+		}()
+		return false
+	}
+	rt.close_post_process_queue()
+	rt.logger.Println("Block stopped")
+	return true
+}
+
+func (rt *block_runtime) close_post_process_queue() {
+	if rt.post_in != nil {
+		rt.post_in.close()
+	}
+}
+
+func (fw *FTPWatcher) reload() string {
+	/*
+	 Re-reads the cfg file, starts added blocks, stops removed blocks
+	 and restarts changed blocks. Unchanged blocks are left running.
+	 */
+	fw.reload_mu.Lock()
+	defer fw.reload_mu.Unlock()
+	if fw.is_shutting_down() {
+		return "Shutting down, not reloading\n"
+	}
+	newlist, err := load_watchlist(fw.config_file)
+	if err != nil {
+		return fmt.Sprintf("%v, not reloading\n", err)
+	}
+	if len(newlist) == 0 {
+		return fmt.Sprintf("No blocks found in %s, not reloading\n", fw.config_file)
+	}
+	current := make(map[string]map[string]interface{})
+	for _, watch_data := range fw.get_watchers() {
+		current[block_config(watch_data).Name] = watch_data
+	}
+	seen := make(map[string]bool)
+	kept := make([]map[string]interface{}, 0)
+	added := make([]map[string]interface{}, 0)
+	changed := make([]map[string]interface{}, 0)
+	for _, watch_data := range newlist {
+		blockname := block_config(watch_data).Name
+		seen[blockname] = true
+		old, exists := current[blockname]
+		if exists == false {
+			added = append(added, watch_data)
+		} else if block_config(old).Fingerprint != block_config(watch_data).Fingerprint {
+			changed = append(changed, watch_data)
+		} else {
+			kept = append(kept, old)
+		}
+	}
+	removed := make([]map[string]interface{}, 0)
+	for blockname, old := range current {
+		if seen[blockname] == false {
+			removed = append(removed, old)
+		}
+	}
+
+	to_start := append(append([]map[string]interface{}{}, added...), changed...)
+	if len(to_start) > 0 {
+		if fw._check_watch_data(to_start, current) == false {
+			return "Configuration error in one or more added or changed blocks, not reloading\n"
+		}
+		if fw.check_lmirror_cfg_parms(to_start) == false {
+			fw.discard_runtimes(to_start)
+			return "Bad lmirror stage in one or more added or changed blocks, not reloading\n"
+		}
+		// Changed blocks start theirs once the old one has stopped
+		fw._start_warn_scheduler(added)
+	}
+
+	fw.watchers_mu.Lock()
+	fw.watchers = append(kept, added...)
+	fw.watchers_mu.Unlock()
+
+	out := ""
+	for _, watch_data := range added {
+		out += fmt.Sprintf("Added block %s\n", block_config(watch_data).Name)
+	}
+	for _, old := range removed {
+		blockname := block_config(old).Name
+		fw.update_json(func(data map[string]interface{}) {
+			delete(data, blockname)
+		})
+		go fw.stop_watcher(old)
+		out += fmt.Sprintf("Removed block %s\n", blockname)
+	}
+	for _, watch_data := range changed {
+		old := current[block_config(watch_data).Name]
+		// The new watcher is started once the old one has let go of the block,
+		// two watchers would share its destination and temp files
+		go func(old, watch_data map[string]interface{}) {
+			if fw.stop_watcher(old) == false {
+				block_rt(watch_data).logger.Println("Restart deferred until the pass of the old block ends")
+				block_rt(old).passes.Wait()
+			}
+			block_rt(old).warns.Wait()
+			if fw.is_shutting_down() {
+				fw.discard_runtimes([]map[string]interface{}{watch_data})
+				return
+			}
+			fw._start_warn_scheduler([]map[string]interface{}{watch_data})
+			fw.add_watcher(watch_data)
+			block_rt(watch_data).logger.Println("Restarted block after cfg change")
+		}(old, watch_data)
+		out += fmt.Sprintf("Restarting changed block %s\n", block_config(watch_data).Name)
+	}
+	out += fmt.Sprintf("Reloaded %s : %d unchanged, %d added, %d removed, %d changed\n",
+		fw.config_file, len(kept), len(added), len(removed), len(changed))
+	for _, watch_data := range fw.get_watchers() {
+		block_rt(watch_data).logger.Print(out)
+	}
+	fw.write_json_file()
+	return out
+}
+
+func reload_config(data interface{}, cmd string, args ...string) string {
+	/*
+	 CIM callback for reload
+	 */
+	fw := data.(*FTPWatcher)
+	if cmd != "reload" {
+		return ""
+	}
+	out := fw.reload()
+	os.Stdout.WriteString(out)
+	return out
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reprocess_filter selects the already downloaded files of a block to reprocess
+type reprocess_filter struct {
+	glob string
+	from time.Time
+	to   time.Time // The day after --To, excluded
+}
+
+func parse_reprocess_filter(glob, from, to string, loc *time.Location) (*reprocess_filter, error) {
+	rf := &reprocess_filter{glob: glob}
+	if glob == "" {
+		rf.glob = "*"
+	}
+	if _, err := path.Match(rf.glob, ""); err != nil {
+		return nil, errors.New("Bad --Files glob " + glob)
+	}
+	if from != "" {
+		t, err := time.ParseInLocation("20060102", from, loc)
+		if err != nil {
+			return nil, errors.New("Bad --From date " + from + ", expected YYYYMMDD")
+		}
+		rf.from = t
+	}
+	if to != "" {
+		t, err := time.ParseInLocation("20060102", to, loc)
+		if err != nil {
+			return nil, errors.New("Bad --To date " + to + ", expected YYYYMMDD")
+		}
+		rf.to = t.AddDate(0, 0, 1)
+	}
+	return rf, nil
+}
+
+func (rf *reprocess_filter) matches(rel string, mtime time.Time) bool {
+	matched, _ := path.Match(rf.glob, rel)
+	if matched == false {
+		matched, _ = path.Match(rf.glob, path.Base(rel))
+	}
+	if matched == false {
+		return false
+	}
+	if rf.from.IsZero() == false && mtime.Before(rf.from) {
+		return false
+	}
+	if rf.to.IsZero() == false && mtime.Before(rf.to) == false {
+		return false
+	}
+	return true
+}
+
+func (fw *FTPWatcher) reprocess_candidates(watch_data map[string]interface{}, rf *reprocess_filter) ([]string, error) {
+	/*
+	 Lists the downloaded files under the block's destination that rf
+	 selects, leaving out temp files, .meta files, hidden dirs and the
+	 lmirror outputs that downloaded files link to
+	 */
+	dest := block_config(watch_data).Dest
+	if real, err := filepath.EvalSymlinks(dest); err == nil {
+		dest = real
+	}
+	files := make([]string, 0)
+	targets := make(map[string]bool)
+	err := filepath.Walk(dest, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		base := path.Base(name)
+		if fi.IsDir() {
+			if name != dest && strings.HasPrefix(base, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(base, ".") || strings.HasSuffix(base, "@") || strings.HasSuffix(base, ".meta") ||
+			strings.HasSuffix(base, fw._DELETED_SUFFIX) {
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if target, err := filepath.EvalSymlinks(name); err == nil {
+				targets[target] = true
+			}
+		}
+		files = append(files, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	selected := make([]string, 0)
+	for _, name := range files {
+		if targets[name] {
+			continue
+		}
+		fi, err := os.Lstat(name)
+		if err != nil {
+			continue
+		}
+		rel, _ := filepath.Rel(dest, name)
+		if rf.matches(rel, fi.ModTime()) {
+			selected = append(selected, name)
+		}
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
+
+func (fw *FTPWatcher) reprocess_file(watch_data map[string]interface{}, destfile string, dry_run bool) error {
+	/*
+	 Runs the post-download commands and lmirror plugins of the block on a
+	 downloaded file again. The plugins start from what the file links to,
+	 so that with an unchanged cfg nothing moves, and a changed cfg moves
+	 the outputs to where it would have put them.
+	 */
+	logger := block_rt(watch_data).logger
+	dest := block_config(watch_data).Dest
+	if real, err := filepath.EvalSymlinks(dest); err == nil {
+		dest = real
+	}
+	fi, err := os.Lstat(destfile)
+	if err != nil {
+		return err
+	}
+	infile := destfile
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if infile, err = filepath.EvalSymlinks(destfile); err != nil {
+			return errors.New("Dangling link " + destfile)
+		}
+		if strings.HasSuffix(infile, ".meta") {
+			return errors.New("Split into pieces listed in " + infile + ", not reprocessing")
+		}
+	}
+	// The remote path is rebuilt from the local one, the mtime of the file or link is the remote mtime
+	rel, _ := filepath.Rel(dest, destfile)
+	remote_path := path.Join("/", rel)
+	t2 := fi.ModTime()
+	t1 := t2
+	post_download := block_config(watch_data).PostDownload
+	stages := block_config(watch_data).Stages
+	if dry_run {
+		fmt.Printf("Would reprocess %s", destfile)
+		if infile != destfile {
+			fmt.Printf(" (-> %s)", infile)
+		}
+		fmt.Println()
+		if post_download != "" {
+			fmt.Printf("    post-download : %s\n", post_download)
+		}
+		for _, line := range fw.lmirror_plan(watch_data, destfile, infile, remote_path, t1, t2) {
+			fmt.Printf("    %s\n", line)
+		}
+		return nil
+	}
+	logger.Println("Reprocessing", destfile, "from", infile)
+	if post_download != "" {
+		cv := command_vars{File: destfile, RemotePath: remote_path, RemoteMtime: t2}
+		if err := fw.run_commands(watch_data, post_download, "Post download processing", cv); err != nil {
+			return err
+		}
+	}
+	if len(stages) == 0 {
+		return nil
+	}
+	outputs, err := fw.run_lmirror_pipeline_from(watch_data, destfile, infile, remote_path, t1, t2)
+	if err != nil {
+		return err
+	}
+	for _, out := range outputs {
+		fmt.Printf("    -> %s\n", out.Path)
+	}
+	return nil
+}
+
+func Reprocess(configFile, blockname string) int {
+	/*
+	 Entry point of --Reprocess. Returns the exit status : 0 if every
+	 selected file was reprocessed, 1 if any failed, 2 on bad arguments
+	 */
+	all, err := load_watchlist(configFile)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	watchlist := make([]map[string]interface{}, 0)
+	for _, watch_data := range all {
+		if block_config(watch_data).Name == blockname {
+			watchlist = append(watchlist, watch_data)
+		}
+	}
+	if len(watchlist) == 0 {
+		fmt.Println("No block called", blockname, "in", configFile)
+		return 2
+	}
+	fw := newFTPWatcher(watchlist, false)
+	fw.config_file = configFile
+	watch_data := fw.watchers[0]
+	if block_config(watch_data).PostDownload == "" && len(block_config(watch_data).Stages) == 0 {
+		fmt.Println("Block", blockname, "has no post-download commands or lmirror plugins")
+		return 2
+	}
+	rf, err := parse_reprocess_filter(opt.Files, opt.From, opt.To, block_config(watch_data).location())
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	files, err := fw.reprocess_candidates(watch_data, rf)
+	if err != nil {
+		fmt.Println("Cannot list", block_config(watch_data).Dest, ":", err)
+		return 2
+	}
+	failed := 0
+	for _, file := range files {
+		if err := fw.reprocess_file(watch_data, file, opt.Dryrun); err != nil {
+			fmt.Printf("FAILED %s : %v\n", file, err)
+			block_rt(watch_data).logger.Println("Reprocessing of", file, "failed :", err)
+			failed++
+		} else if opt.Dryrun == false {
+			fmt.Println("Reprocessed", file)
+		}
+	}
+	fmt.Printf("%d files selected, %d failed\n", len(files), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
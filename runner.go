@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Leading NAME=value words of a command are added to its environment
+var _COMMAND_ENV_RE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// Names download-check, post-download and warn_cmd commands know besides those of every template
+var _COMMAND_TEMPLATE_NAMES = map[string]bool{
+	"FILE":         false,
+	"REMOTE_DIR":   false,
+	"REMOTE_PATH":  false,
+	"REMOTE_MTIME": true,
+}
+
+// command_vars are the values of the placeholders of a command run on a file
+type command_vars struct {
+	File        string
+	RemotePath  string
+	RemoteMtime time.Time
+}
+
+// command_result is what a command run on a file left behind
+type command_result struct {
+	Stdout string
+	Stderr string
+	Err    error
+}
+
+func tokenize_command(command string) ([]string, error) {
+	/*
+	 Splits command into words the way sh does, honouring single quotes,
+	 double quotes and backslashes, but without any expansion
+	 */
+	_, words, err := tokenize_commands(command, 0)
+	if err != nil {
+		return nil, err
+	}
+	return words[0], nil
+}
+
+func tokenize_commands(command string, sep rune) ([]string, [][]string, error) {
+	/*
+	 Splits a list of commands at every sep that is neither quoted nor
+	 escaped, and each command into words as tokenize_command does.
+	 Returns the text and the words of each command.
+	 */
+	commands := make([]string, 0)
+	lists := make([][]string, 0)
+	start := 0
+	words := make([]string, 0)
+	var word strings.Builder
+	in_word := false
+	var quote rune
+	escaped := false
+	for idx, r := range command {
+		switch {
+		case escaped:
+			if quote == '"' && r != '"' && r != '\\' && r != '$' && r != '`' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, in_word = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == sep:
+			if in_word {
+				words = append(words, word.String())
+				word.Reset()
+				in_word = false
+			}
+			commands = append(commands, command[start:idx])
+			lists = append(lists, words)
+			start, words = idx+len(string(sep)), make([]string, 0)
+		case r == '\'' || r == '"':
+			quote, in_word = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if in_word {
+				words = append(words, word.String())
+				word.Reset()
+				in_word = false
+			}
+		default:
+			word.WriteRune(r)
+			in_word = true
+		}
+	}
+	if quote != 0 {
+		return nil, nil, errors.New("Unterminated quote in command " + command)
+	}
+	if escaped {
+		return nil, nil, errors.New("Trailing backslash in command " + command)
+	}
+	if in_word {
+		words = append(words, word.String())
+	}
+	return append(commands, command[start:]), append(lists, words), nil
+}
+
+func split_command_env(words []string) ([]string, []string) {
+	env := make([]string, 0)
+	for len(words) > 0 && _COMMAND_ENV_RE.MatchString(words[0]) {
+		env = append(env, words[0])
+		words = words[1:]
+	}
+	return env, words
+}
+
+func (fw *FTPWatcher) check_command(command string) error {
+	/*
+	 Checks that every command of a ^ separated list parses and only uses
+	 known placeholders
+	 */
+	for _, c := range fw._split_run_cmd(command) {
+		words, err := tokenize_command(c)
+		if err != nil {
+			return err
+		}
+		if _, args := split_command_env(words); len(args) == 0 && strings.TrimSpace(c) != "" {
+			return errors.New("Nothing to run in command " + c)
+		}
+		if err := check_template(c, _COMMAND_TEMPLATE_NAMES, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fw *FTPWatcher) command_timeout(watch_data map[string]interface{}) time.Duration {
+	if d := block_config(watch_data).CmdTimeout; d > 0 {
+		return d
+	}
+	return 30 * time.Minute
+}
+
+func command_template_vars(watch_data map[string]interface{}, cv command_vars) *template_vars {
+	vars := new(template_vars)
+	vars.loc = block_config(watch_data).location()
+	vars.server_loc = block_config(watch_data).server_location()
+	vars.zone = vars.loc
+	filename := path.Base(cv.File)
+	vars.strs = map[string]string{
+		"FILE":        cv.File,
+		"FILENAME":    filename,
+		"BASENAME":    strings.TrimSuffix(filename, path.Ext(filename)),
+		"REMOTE_PATH": cv.RemotePath,
+	}
+	vars.strs["BLOCK"] = block_config(watch_data).Name
+	vars.strs["HOST"] = block_config(watch_data).Hostname
+	if cv.RemotePath != "" {
+		vars.strs["REMOTE_DIR"] = path.Dir(cv.RemotePath)
+		vars.strs["CURDIR"] = path.Dir(cv.RemotePath)
+	} else {
+		vars.strs["REMOTE_DIR"] = ""
+		vars.strs["CURDIR"] = ""
+	}
+	vars.dates = map[string]time.Time{
+		"NOW": time.Now(),
+	}
+	if cv.RemoteMtime.IsZero() == false {
+		vars.dates["REMOTE_MTIME"] = cv.RemoteMtime
+		vars.dates["MTIME"] = cv.RemoteMtime
+	} else if fi, err := os.Stat(cv.File); err == nil {
+		vars.dates["MTIME"] = fi.ModTime()
+	}
+	vars.nominal = _NOMINAL_DATE_RE.FindString(filename)
+	if t, err := time.ParseInLocation("20060102", vars.nominal, vars.loc); err == nil {
+		vars.dates["NOMINAL"] = t
+	}
+	return vars
+}
+
+func command_env(watch_data map[string]interface{}, cv command_vars, env []string) []string {
+	/*
+	 The daemon's environment, the FTPWATCHER_ variables describing the
+	 file and then the command's own NAME=value words, later ones winning
+	 */
+	block := block_config(watch_data).Name
+	host := block_config(watch_data).Hostname
+	out := append(child_environ(),
+		"FTPWATCHER_BLOCK="+block,
+		"FTPWATCHER_HOST="+host,
+		"FTPWATCHER_FILE="+cv.File,
+		"FTPWATCHER_REMOTE_PATH="+cv.RemotePath,
+	)
+	if cv.RemoteMtime.IsZero() == false {
+		out = append(out, "FTPWATCHER_REMOTE_MTIME="+cv.RemoteMtime.Format("20060102 15:04:05"))
+	}
+	return append(out, env...)
+}
+
+func wait_or_kill(c *exec.Cmd, timeout time.Duration) (bool, error) {
+	/*
+	 Waits for c, started in its own process group, killing the whole
+	 group if it runs longer than timeout. Returns whether it was killed.
+	 */
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+	select {
+	case err := <-done:
+		return false, err
+	case <-time.After(timeout):
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		return true, <-done
+	}
+}
+
+func expand_command(watch_data map[string]interface{}, command string, cv command_vars) ([]string, []string, error) {
+	/*
+	 Returns the arguments of command with its placeholders expanded for
+	 cv, the file appended unless __FILE__ is used, and its NAME=value words
+	 */
+	words, err := tokenize_command(command)
+	if err != nil {
+		return nil, nil, err
+	}
+	env, words := split_command_env(words)
+	if len(words) == 0 {
+		return nil, nil, errors.New("Nothing to run in command " + command)
+	}
+	vars := command_template_vars(watch_data, cv)
+	args := make([]string, 0)
+	has_file := false
+	for _, word := range words {
+		if strings.Contains(word, "__FILE__") {
+			has_file = true
+		}
+		expanded, err := expand_template(word, vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s : %v", command, err)
+		}
+		args = append(args, expanded)
+	}
+	if has_file == false {
+		args = append(args, cv.File)
+	}
+	return args, env, nil
+}
+
+func (fw *FTPWatcher) run_command(watch_data map[string]interface{}, command string, cv command_vars) *command_result {
+	/*
+	 Runs command on cv.File, with its placeholders expanded and without a
+	 shell. The file is appended as the last argument unless __FILE__ is used.
+	 */
+	logger := block_rt(watch_data).logger
+	result := new(command_result)
+	args, env, err := expand_command(watch_data, command, cv)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	timeout := fw.command_timeout(watch_data)
+	// Only the names of the variables, their values may be secrets
+	env_names := make([]string, 0)
+	for _, kv := range env {
+		env_names = append(env_names, strings.SplitN(kv, "=", 2)[0])
+	}
+	logger.Printf("Running cmd %q with ENV %v, timeout %s\n", args, env_names, timeout)
+	c := exec.Command(args[0], args[1:]...)
+	c.Env = command_env(watch_data, cv, env)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Start(); err != nil {
+		result.Err = err
+		return result
+	}
+	killed, err := wait_or_kill(c, timeout)
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	if killed {
+		result.Err = fmt.Errorf("%s : killed after %s", args[0], timeout)
+	} else if err != nil {
+		result.Err = fmt.Errorf("%s : %v", args[0], err)
+	}
+	return result
+}
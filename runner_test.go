@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenizeCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		ok      bool
+	}{
+		{"", []string{}, true},
+		{"gzip -t __FILE__", []string{"gzip", "-t", "__FILE__"}, true},
+		{"  a\tb \n c  ", []string{"a", "b", "c"}, true},
+		{`echo 'a b' "c d"`, []string{"echo", "a b", "c d"}, true},
+		{`echo a'b c'd`, []string{"echo", "ab cd"}, true},
+		{`echo '' ""`, []string{"echo", "", ""}, true},
+		{`echo a\ b`, []string{"echo", "a b"}, true},
+		{`echo 'a\b'`, []string{"echo", `a\b`}, true},
+		{`echo "a\b" "a\"b" "a\\b"`, []string{"echo", `a\b`, `a"b`, `a\b`}, true},
+		{`echo "it's"`, []string{"echo", "it's"}, true},
+		{"echo a^b", []string{"echo", "a^b"}, true},
+		{`echo 'a b`, nil, false},
+		{`echo "a b`, nil, false},
+		{`echo a\`, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := tokenize_command(tt.command)
+		if (err == nil) != tt.ok || (tt.ok && reflect.DeepEqual(got, tt.want) == false) {
+			t.Errorf("tokenize_command(%q) = %q, %v, want %q, ok %v", tt.command, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTokenizeCommands(t *testing.T) {
+	tests := []struct {
+		command  string
+		commands []string
+		words    [][]string
+	}{
+		{"gzip -t __FILE__", []string{"gzip -t __FILE__"}, [][]string{{"gzip", "-t", "__FILE__"}}},
+		{"a 1^b 2", []string{"a 1", "b 2"}, [][]string{{"a", "1"}, {"b", "2"}}},
+		{"a ^ b", []string{"a ", " b"}, [][]string{{"a"}, {"b"}}},
+		{"a^", []string{"a", ""}, [][]string{{"a"}, {}}},
+		{`grep '^x' f^wc -l`, []string{`grep '^x' f`, "wc -l"}, [][]string{{"grep", "^x", "f"}, {"wc", "-l"}}},
+		{`grep "^x" f`, []string{`grep "^x" f`}, [][]string{{"grep", "^x", "f"}}},
+		{`echo a\^b^true`, []string{`echo a\^b`, "true"}, [][]string{{"echo", "a^b"}, {"true"}}},
+	}
+	for _, tt := range tests {
+		commands, words, err := tokenize_commands(tt.command, '^')
+		if err != nil || reflect.DeepEqual(commands, tt.commands) == false || reflect.DeepEqual(words, tt.words) == false {
+			t.Errorf("tokenize_commands(%q) = %q, %q, %v, want %q, %q", tt.command, commands, words, err, tt.commands, tt.words)
+		}
+	}
+}
+
+func TestSplitRunCmd(t *testing.T) {
+	fw := &FTPWatcher{_command_separator: "^"}
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"a^b^c", []string{"a", "b", "c"}},
+		{`sed -n '/^#/p' f^true`, []string{`sed -n '/^#/p' f`, "true"}},
+		{`echo 'unterminated^true`, []string{`echo 'unterminated^true`}},
+	}
+	for _, tt := range tests {
+		if got := fw._split_run_cmd(tt.command); reflect.DeepEqual(got, tt.want) == false {
+			t.Errorf("_split_run_cmd(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestSplitCommandEnv(t *testing.T) {
+	tests := []struct {
+		words []string
+		env   []string
+		args  []string
+	}{
+		{[]string{"gzip", "-t"}, []string{}, []string{"gzip", "-t"}},
+		{[]string{"TZ=UTC", "LANG=C", "date"}, []string{"TZ=UTC", "LANG=C"}, []string{"date"}},
+		{[]string{"date", "X=1"}, []string{}, []string{"date", "X=1"}},
+		{[]string{"1X=1", "date"}, []string{}, []string{"1X=1", "date"}},
+		{[]string{"X=1"}, []string{"X=1"}, []string{}},
+	}
+	for _, tt := range tests {
+		env, args := split_command_env(tt.words)
+		if reflect.DeepEqual(env, tt.env) == false || reflect.DeepEqual(args, tt.args) == false {
+			t.Errorf("split_command_env(%q) = %q, %q, want %q, %q", tt.words, env, args, tt.env, tt.args)
+		}
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	dir := t.TempDir()
+	tests := []string{"plain.csv", "with space.csv", "it's.csv", "x;touch pwned.csv", "$(touch pwned).csv", "`touch pwned`.csv"}
+	for _, file := range tests {
+		infile := filepath.Join(dir, "in dir", file)
+		cmd := split_command("printf '%s\\n'", infile, infile+".meta", dir)
+		stdout, _, err := run_with_timeout(cmd, dir, nil, time.Minute)
+		if err != nil {
+			t.Errorf("%s : %v", file, err)
+			continue
+		}
+		want := []string{"--Inbase", filepath.Join(dir, "in dir") + "/", "--Infile", file, "--Metafile", infile + ".meta",
+			"--Outbase", filepath.Join(dir, "in dir") + "/", "--Tempbase", dir}
+		if got := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n"); reflect.DeepEqual(got, want) == false {
+			t.Errorf("%s : args %q, want %q", file, got, want)
+		}
+	}
+	for _, name := range []string{"pwned", "pwned.csv"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("a file name was run as a command, it made %s", name)
+		}
+	}
+}
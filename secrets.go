@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Keys giving the ftp password of a block, only one of them may be set
+var _PASSWD_KEYS = []string{"passwd", "passwd_file", "passwd_env", "passwd_cmd", "passwd_store"}
+
+// Environment variables named by passwd_env=, kept out of the environment of commands
+var secret_env = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+func child_environ() []string {
+	/*
+	 The daemon's environment less the variables holding passwords
+	 */
+	secret_env.Lock()
+	defer secret_env.Unlock()
+	out := make([]string, 0)
+	for _, kv := range os.Environ() {
+		if secret_env.names[strings.SplitN(kv, "=", 2)[0]] == false {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+func (r *block_reader) passwd() (string, string) {
+	/*
+	 Returns the passwd= password of the block and where the password
+	 comes from, such as passwd_file=/path, which unlike the password may
+	 be shown. The other sources are read by login_passwd at each login,
+	 not every time the cfg is loaded.
+	 */
+	given := make([]string, 0)
+	for _, key := range _PASSWD_KEYS {
+		if r.str(_CONFIG_PARAM_ROW, key, "") != "" {
+			given = append(given, key)
+		}
+	}
+	if len(given) == 0 {
+		// Anonymous and password-less servers log in with an empty password
+		r.fail(_CONFIG_PARAM_ROW, "passwd", false, "not given, nor one of %s=, logging in with an empty password",
+			strings.Join(_PASSWD_KEYS[1:], "=, "))
+		return "", "passwd"
+	}
+	if len(given) > 1 {
+		r.fail(_CONFIG_PARAM_ROW, given[1], true, "only one of %s= may be given", strings.Join(given, "=, "))
+		return "", ""
+	}
+	key := given[0]
+	value := r.str(_CONFIG_PARAM_ROW, key, "")
+	switch key {
+	case "passwd":
+		return GenPasswd(value), key
+	case "passwd_file":
+		if fi, err := os.Stat(value); err == nil && fi.Mode().Perm()&077 != 0 {
+			r.fail(_CONFIG_PARAM_ROW, "passwd_file", false, "%s is accessible by group or others", value)
+		}
+	case "passwd_env":
+		secret_env.Lock()
+		secret_env.names[value] = true
+		secret_env.Unlock()
+	}
+	return "", key + "=" + value
+}
+
+func (cfg *BlockConfig) login_passwd() (string, error) {
+	/*
+	 Returns the ftp password of the block, reading it from where
+	 PasswdSource says, right before logging in
+	 */
+	kv := strings.SplitN(cfg.PasswdSource, "=", 2)
+	if len(kv) < 2 {
+		return cfg.Passwd, nil
+	}
+	var secret string
+	var err error
+	switch kv[0] {
+	case "passwd_file":
+		secret, err = read_passwd_file(kv[1])
+	case "passwd_env":
+		if secret = os.Getenv(kv[1]); secret == "" {
+			err = errors.New(kv[1] + " is not set in the environment")
+		}
+	case "passwd_cmd":
+		secret, err = passwd_cmd(kv[1], cfg.CmdTimeout)
+	case "passwd_store":
+		var cs *credential_store
+		if cs, err = open_credential_store(credstore_file(), opt.Credkey); err == nil {
+			secret, err = cs.get(kv[1])
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s : %v", cfg.PasswdSource, err)
+	}
+	return secret, nil
+}
+
+func read_passwd_file(file string) (string, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(buf), "\r\n")
+	if secret == "" {
+		return "", errors.New(file + " is empty")
+	}
+	return secret, nil
+}
+
+func passwd_cmd(command string, timeout time.Duration) (string, error) {
+	/*
+	 Runs the helper command, without a shell, and returns the first line
+	 of its output. Its stderr is dropped as it may hold the password.
+	 */
+	words, err := tokenize_command(command)
+	if err != nil {
+		return "", err
+	}
+	env, args := split_command_env(words)
+	if len(args) == 0 {
+		return "", errors.New("Nothing to run in command " + command)
+	}
+	c := exec.Command(args[0], args[1:]...)
+	c.Env = append(child_environ(), env...)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	if err := c.Start(); err != nil {
+		return "", err
+	}
+	killed, err := wait_or_kill(c, timeout)
+	if killed {
+		return "", fmt.Errorf("%s : killed after %s", args[0], timeout)
+	} else if err != nil {
+		return "", fmt.Errorf("%s : %v", args[0], err)
+	}
+	secret := strings.TrimRight(strings.SplitN(stdout.String(), "\n", 2)[0], "\r")
+	if secret == "" {
+		return "", errors.New(args[0] + " printed no password")
+	}
+	return secret, nil
+}
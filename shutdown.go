@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+func (fw *FTPWatcher) is_shutting_down() bool {
+	return fw.ctx.Err() != nil
+}
+
+func (fw *FTPWatcher) track_temp_file(tempname string, in_use bool) {
+	/*
+	 Remembers the "@" temp files of downloads in progress,
+	 so that they can be removed on shutdown
+	 */
+	fw.temp_files_mu.Lock()
+	defer fw.temp_files_mu.Unlock()
+	if in_use {
+		fw.temp_files[tempname] = true
+	} else {
+		delete(fw.temp_files, tempname)
+	}
+}
+
+func wait_with_timeout(wait func(), timeout time.Duration) bool {
+	/*
+	 Runs wait and returns true if it finished within timeout
+	 */
+	done := make(chan bool)
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+	return false
+}
+
+func (fw *FTPWatcher) shutdown(sig os.Signal) {
+	/*
+	 Stops scheduling new work, drains transfers and post processing
+	 up to the drain timeout, then cleans up temp files and flushes
+	 the json and stats files
+	 */
+	for _, watch_data := range fw.get_watchers() {
+		block_rt(watch_data).logger.Printf("Got signal %v, draining before exit\n", sig)
+	}
+	fw.cancel()
+
+	deadline := time.Now().Add(fw.drain_timeout)
+	if wait_with_timeout(fw.active_passes.Wait, deadline.Sub(time.Now())) == false {
+		os.Stdout.WriteString(fmt.Sprintf("Transfers still in progress after %s, abandoning them\n", fw.drain_timeout))
+	} else if wait_with_timeout(fw.post_process_pending.Wait, deadline.Sub(time.Now())) == false {
+		os.Stdout.WriteString(fmt.Sprintf("Post processing still in progress after %s, abandoning it\n", fw.drain_timeout))
+	}
+
+	fw.temp_files_mu.Lock()
+	for tempname := range fw.temp_files {
+		os.Stdout.WriteString(fmt.Sprintf("Removing temp file %s\n", tempname))
+		os.Remove(tempname)
+	}
+	fw.temp_files_mu.Unlock()
+	// Only this process's own temp dir, one-off runs of the instance may be using theirs
+	os.RemoveAll(fw.__tmp_dir)
+	fw.quit_signal_handler(sig)
+}
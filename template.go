@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A template token is __NAME__ or __NAME|op|op...__, see the README for the names and ops
+var _TEMPLATE_TOKEN = regexp.MustCompile(`__([A-Z](?:[A-Z_]*[A-Z])?)((?:\|[^|]*?)*)__`)
+
+// Nominal dates in filenames, YYYYMMDD between 1900 and 2099
+var _NOMINAL_DATE_RE = regexp.MustCompile(`(19|20)[0-9][0-9](0[1-9]|1[012])(0[1-9]|[12][0-9]|3[01])`)
+
+// Nominal dates as transpath has always found them, anywhere in the path of the download
+var _PATH_NOMINAL_DATE_RE = regexp.MustCompile(`[12][90][0-9][0-9][01][0-9][0123][0-9]`)
+
+var _TEMPLATE_DATE_OFFSET = regexp.MustCompile(`^([+-][0-9]+)(d|bd|w|m|y)$`)
+
+// Names every template knows, true for dates that take date ops
+var _TEMPLATE_NAMES = map[string]bool{
+	"BLOCK":    false,
+	"HOST":     false,
+	"CURDIR":   false,
+	"FILENAME": false,
+	"BASENAME": false,
+	"RE":       false,
+	"MTIME":    true,
+	"NOW":      true,
+	"NOMINAL":  true,
+	// Kept from before the template language
+	"CURDATE":      false,
+	"SUNDAY":       false,
+	"NOMINAL_DATE": false,
+}
+
+// Plugin parameters that are templates, with the extra names each one knows
+var _TEMPLATE_PARAMS = map[string]map[string]bool{
+	"lmirror_path_format": {},
+	"extract_dir":         {"ARCHIVE": false},
+	"extract_path_format": {"ARCHIVE": false, "MEMBER": false, "MEMBER_DIR": false, "MEMBER_BASE": false, "MEMBER_DATE": true},
+}
+
+// template_vars holds the values a template is expanded with
+type template_vars struct {
+	strs       map[string]string
+	dates      map[string]time.Time
+	captures   map[string]string
+	nominal    string         // The nominal date as found, for __NOMINAL_DATE__
+	zone       *time.Location // Where dates are written unless an op says otherwise
+	loc        *time.Location
+	server_loc *time.Location
+}
+
+func check_template(tmpl string, extra map[string]bool, filename_re *regexp.Regexp) error {
+	/*
+	 Checks that every token of tmpl has a known name and valid ops
+	 */
+	captures := make(map[string]bool)
+	if filename_re != nil {
+		for _, name := range filename_re.SubexpNames() {
+			captures[name] = true
+		}
+	}
+	for _, m := range _TEMPLATE_TOKEN.FindAllStringSubmatch(tmpl, -1) {
+		name := m[1]
+		ops := template_ops(m[2])
+		is_date, known := _TEMPLATE_NAMES[name]
+		if known == false {
+			is_date, known = extra[name]
+		}
+		if known == false {
+			return errors.New("Unknown template name " + m[0])
+		}
+		if name == "RE" {
+			if len(ops) != 1 || captures[ops[0]] == false || ops[0] == "" {
+				return errors.New(m[0] + " does not name a capture of filename_regex")
+			}
+			continue
+		}
+		if is_date == false && len(ops) > 0 {
+			return errors.New(m[0] + " takes no ops")
+		}
+		if _, err := apply_date_ops(time.Now(), ops, time.Local, time.Local); err != nil {
+			return errors.New(m[0] + " : " + err.Error())
+		}
+	}
+	return nil
+}
+
+func template_ops(ops string) []string {
+	if ops == "" {
+		return nil
+	}
+	return strings.Split(ops[1:], "|")
+}
+
+func expand_template(tmpl string, vars *template_vars) (string, error) {
+	var err error
+	out := _TEMPLATE_TOKEN.ReplaceAllStringFunc(tmpl, func(token string) string {
+		m := _TEMPLATE_TOKEN.FindStringSubmatch(token)
+		name, ops := m[1], template_ops(m[2])
+		if name == "RE" {
+			val, ok := vars.captures[ops[0]]
+			if ok == false && err == nil {
+				err = errors.New("filename_regex did not match for " + token)
+			}
+			return val
+		}
+		if name == "NOMINAL_DATE" {
+			// A date found in the path or filename, or undated/<mtime>
+			if vars.nominal != "" {
+				return vars.nominal
+			}
+			return vars.dates["MTIME"].In(vars.zone).Format("undated/20060102")
+		}
+		if name == "CURDATE" {
+			name = "MTIME"
+		}
+		if name == "SUNDAY" {
+			name, ops = "MTIME", []string{"weekstart"}
+		}
+		if val, ok := vars.strs[name]; ok {
+			return val
+		}
+		t, ok := vars.dates[name]
+		if ok == false {
+			if err == nil {
+				err = errors.New("No value for " + token)
+			}
+			return token
+		}
+		val, derr := apply_date_ops(t.In(vars.zone), ops, vars.loc, vars.server_loc)
+		if derr != nil && err == nil {
+			err = derr
+		}
+		return val
+	})
+	return out, err
+}
+
+func add_business_days(t time.Time, n int) time.Time {
+	step := 1
+	if n < 0 {
+		step, n = -1, -n
+	}
+	for n > 0 {
+		t = t.AddDate(0, 0, step)
+		if t.Weekday() != time.Saturday && t.Weekday() != time.Sunday {
+			n--
+		}
+	}
+	return t
+}
+
+func apply_date_ops(t time.Time, ops []string, loc, server_loc *time.Location) (string, error) {
+	/*
+	 Applies the ops of a date token in order and formats the result,
+	 as YYYYMMDD in the zone of t unless told otherwise
+	 */
+	layout := "YYYYMMDD"
+	for _, op := range ops {
+		switch {
+		case op == "local":
+			t = t.In(loc)
+		case op == "server":
+			t = t.In(server_loc)
+		case op == "weekstart":
+			t = t.AddDate(0, 0, -int(t.Weekday()))
+		case op == "monthstart":
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		case op == "monthend":
+			t = time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location())
+		case op == "quarterstart":
+			t = time.Date(t.Year(), ((t.Month()-1)/3)*3+1, 1, 0, 0, 0, 0, t.Location())
+		case op == "quarterend":
+			t = time.Date(t.Year(), ((t.Month()-1)/3)*3+4, 0, 0, 0, 0, 0, t.Location())
+		case strings.HasPrefix(op, "fmt="):
+			layout = op[len("fmt="):]
+		case _TEMPLATE_DATE_OFFSET.MatchString(op):
+			m := _TEMPLATE_DATE_OFFSET.FindStringSubmatch(op)
+			n, _ := strconv.Atoi(m[1])
+			switch m[2] {
+			case "d":
+				t = t.AddDate(0, 0, n)
+			case "bd":
+				t = add_business_days(t, n)
+			case "w":
+				t = t.AddDate(0, 0, 7*n)
+			case "m":
+				t = t.AddDate(0, n, 0)
+			case "y":
+				t = t.AddDate(n, 0, 0)
+			}
+		default:
+			return "", errors.New("Unknown date op " + op)
+		}
+	}
+	r := strings.NewReplacer(
+		"YYYY", t.Format("2006"),
+		"YY", t.Format("06"),
+		"MM", t.Format("01"),
+		"DD", t.Format("02"),
+		"HH", t.Format("15"),
+		"MI", t.Format("04"),
+		"SS", t.Format("05"),
+		"Q", strconv.Itoa(int(t.Month()-1)/3+1),
+	)
+	return r.Replace(layout), nil
+}
+
+func (lctx *LmirrorContext) template_vars(infile string, modtime time.Time) *template_vars {
+	/*
+	 Values of the names every template knows, for infile with modtime
+	 */
+	vars := new(template_vars)
+	vars.loc = lctx.BlockConfig.location()
+	vars.server_loc = lctx.BlockConfig.server_location()
+	// Dates are in the daemon's local time, as transpath always wrote them, unless template_tz=block
+	vars.zone = time.Local
+	if lctx.Params["template_tz"] == "block" {
+		vars.zone = vars.loc
+	}
+	filename := path.Base(infile)
+	vars.strs = map[string]string{
+		"BLOCK":    lctx.Block,
+		"CURDIR":   lctx.RemoteDir,
+		"FILENAME": filename,
+		"BASENAME": strings.TrimSuffix(filename, path.Ext(filename)),
+	}
+	vars.strs["HOST"] = lctx.BlockConfig.Hostname
+	vars.dates = map[string]time.Time{
+		"MTIME": modtime,
+		"NOW":   time.Now(),
+	}
+	vars.captures = make(map[string]string)
+	nominal := ""
+	if lctx.Params["filename_regex"] != "" {
+		// Checked when the cfg was loaded
+		re := regexp.MustCompile(lctx.Params["filename_regex"])
+		if m := re.FindStringSubmatch(filename); m != nil {
+			for idx, name := range re.SubexpNames() {
+				if name != "" {
+					vars.captures[name] = m[idx]
+				}
+			}
+			nominal = vars.captures["date"]
+		}
+	}
+	if nominal == "" && lctx.Params["nominal_date_from"] == "filename" {
+		nominal = _NOMINAL_DATE_RE.FindString(filename)
+	} else if nominal == "" {
+		nominal = _PATH_NOMINAL_DATE_RE.FindString(lctx.Destfile)
+	}
+	vars.nominal = nominal
+	if t, err := time.ParseInLocation("20060102", nominal, vars.zone); err == nil {
+		vars.dates["NOMINAL"] = t
+	}
+	return vars
+}
+
+func (lctx *LmirrorContext) expand_param(param, infile string, modtime time.Time, extra map[string]string, extra_dates map[string]time.Time) (string, error) {
+	/*
+	 Expands the template in stage parameter param for infile
+	 */
+	vars := lctx.template_vars(infile, modtime)
+	for name, val := range extra {
+		vars.strs[name] = val
+	}
+	for name, t := range extra_dates {
+		vars.dates[name] = t
+	}
+	out, err := expand_template(lctx.Params[param], vars)
+	if err != nil {
+		return out, fmt.Errorf("%s=%s : %v", param, lctx.Params[param], err)
+	}
+	return out, nil
+}
+
+func check_stage_templates(stage *lmirror_stage) error {
+	/*
+	 Checks filename_regex and the template parameters of a stage
+	 */
+	var filename_re *regexp.Regexp
+	if stage.Params["filename_regex"] != "" {
+		re, err := regexp.Compile(stage.Params["filename_regex"])
+		if err != nil {
+			return errors.New("Bad filename_regex : " + err.Error())
+		}
+		filename_re = re
+	}
+	if tz := stage.Params["template_tz"]; tz != "local" && tz != "block" {
+		return errors.New("template_tz=" + tz + " is not local or block")
+	}
+	if from := stage.Params["nominal_date_from"]; from != "path" && from != "filename" {
+		return errors.New("nominal_date_from=" + from + " is not path or filename")
+	}
+	for param, extra := range _TEMPLATE_PARAMS {
+		if err := check_template(stage.Params[param], extra, filename_re); err != nil {
+			return errors.New(param + " : " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCheckTemplate(t *testing.T) {
+	filename_re := regexp.MustCompile(`^(?P<date>[0-9]{8})_(?P<kind>[a-z]+)\.csv$`)
+	tests := []struct {
+		tmpl  string
+		extra map[string]bool
+		ok    bool
+	}{
+		{"/data/__BLOCK__/__FILENAME__", nil, true},
+		{"/data/__MTIME|-1bd|fmt=YYYY/MM/DD__/__BASENAME__", nil, true},
+		{"/data/__NOW|local|monthend__", nil, true},
+		{"/data/__CURDATE__/__SUNDAY__/__NOMINAL_DATE__", nil, true},
+		{"/data/__RE|date__/__RE|kind__", nil, true},
+		{"/data/__ARCHIVE__/__MEMBER_DATE|weekstart__", _TEMPLATE_PARAMS["extract_path_format"], true},
+		{"/data/__NO_SUCH_NAME__", nil, false},
+		{"/data/__ARCHIVE__", nil, false},
+		{"/data/__BLOCK|local__", nil, false},
+		{"/data/__MTIME|+1x__", nil, false},
+		{"/data/__MTIME|bogus__", nil, false},
+		{"/data/__RE|missing__", nil, false},
+		{"/data/__RE__", nil, false},
+		{"/data/__RE|date|kind__", nil, false},
+	}
+	for _, tt := range tests {
+		err := check_template(tt.tmpl, tt.extra, filename_re)
+		if (err == nil) != tt.ok {
+			t.Errorf("check_template(%q) = %v, want ok %v", tt.tmpl, err, tt.ok)
+		}
+	}
+}
+
+func TestApplyDateOps(t *testing.T) {
+	wed := time.Date(2024, 1, 10, 15, 4, 5, 0, time.UTC)
+	mon := time.Date(2024, 1, 8, 12, 0, 0, 0, time.UTC)
+	plus10 := time.FixedZone("plus10", 10*3600)
+	minus16 := time.FixedZone("minus16", -16*3600)
+	tests := []struct {
+		t    time.Time
+		ops  []string
+		want string
+	}{
+		{wed, nil, "20240110"},
+		{wed, []string{"weekstart"}, "20240107"},
+		{wed, []string{"monthstart"}, "20240101"},
+		{wed, []string{"monthend"}, "20240131"},
+		{wed, []string{"quarterstart"}, "20240101"},
+		{wed, []string{"quarterend"}, "20240331"},
+		{time.Date(2024, 11, 15, 0, 0, 0, 0, time.UTC), []string{"quarterend"}, "20241231"},
+		{wed, []string{"-1d"}, "20240109"},
+		{wed, []string{"+2w"}, "20240124"},
+		{wed, []string{"+1m"}, "20240210"},
+		{wed, []string{"-1y"}, "20230110"},
+		{mon, []string{"-1bd"}, "20240105"},
+		{mon, []string{"+5bd"}, "20240115"},
+		{wed, []string{"fmt=YYYY-MM-DD HH:MI:SS"}, "2024-01-10 15:04:05"},
+		{wed, []string{"fmt=YY/Q"}, "24/1"},
+		{wed, []string{"local"}, "20240111"},
+		{wed, []string{"server"}, "20240109"},
+		{wed, []string{"local", "fmt=HH"}, "01"},
+		{wed, []string{"monthend", "+1d", "fmt=MMDD"}, "0201"},
+	}
+	for _, tt := range tests {
+		got, err := apply_date_ops(tt.t, tt.ops, plus10, minus16)
+		if err != nil || got != tt.want {
+			t.Errorf("apply_date_ops(%s, %v) = %q, %v, want %q", tt.t, tt.ops, got, err, tt.want)
+		}
+	}
+	if _, err := apply_date_ops(wed, []string{"fortnight"}, time.UTC, time.UTC); err == nil {
+		t.Errorf("apply_date_ops with an unknown op did not fail")
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	mtime := time.Date(2024, 1, 10, 23, 30, 0, 0, time.UTC)
+	vars := func(nominal string, zone *time.Location) *template_vars {
+		return &template_vars{
+			strs:       map[string]string{"BLOCK": "vendorA", "FILENAME": "20240102_px.csv", "BASENAME": "20240102_px"},
+			dates:      map[string]time.Time{"MTIME": mtime},
+			captures:   map[string]string{"date": "20240102"},
+			nominal:    nominal,
+			zone:       zone,
+			loc:        time.UTC,
+			server_loc: time.UTC,
+		}
+	}
+	tests := []struct {
+		tmpl string
+		vars *template_vars
+		want string
+		ok   bool
+	}{
+		{"/data/__BLOCK__/__FILENAME__", vars("", time.UTC), "/data/vendorA/20240102_px.csv", true},
+		{"/data/__MTIME__/__BASENAME__", vars("", time.UTC), "/data/20240110/20240102_px", true},
+		{"/data/__MTIME__", vars("", time.FixedZone("plus2", 2*3600)), "/data/20240111", true},
+		{"/data/__MTIME|fmt=YYYY/MM__", vars("", time.UTC), "/data/2024/01", true},
+		{"/data/__CURDATE__/__SUNDAY__", vars("", time.UTC), "/data/20240110/20240107", true},
+		{"/data/__NOMINAL_DATE__", vars("", time.UTC), "/data/undated/20240110", true},
+		{"/data/__NOMINAL_DATE__", vars("20231231", time.UTC), "/data/20231231", true},
+		{"/data/__RE|date__", vars("", time.UTC), "/data/20240102", true},
+		{"/data/__RE|kind__", vars("", time.UTC), "/data/", false},
+		{"/data/__NOW__", vars("", time.UTC), "/data/__NOW__", false},
+	}
+	for _, tt := range tests {
+		got, err := expand_template(tt.tmpl, tt.vars)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("expand_template(%q) = %q, %v, want %q, ok %v", tt.tmpl, got, err, tt.want, tt.ok)
+		}
+	}
+}
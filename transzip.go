@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/LDCS/compresstype"
+)
+
+// zip_format is a compression the transzip plugin converts with command line tools
+type zip_format struct {
+	ext        string
+	compress   string
+	decompress string
+	test       string
+	threads    bool // Whether the compressor takes -T<threads>
+}
+
+// Tests of the formats only compresstype converts to
+var _ZIP_TESTS = map[string]string{
+	"zip": "unzip -tq",
+}
+
+var _ZIP_FORMATS = map[string]zip_format{
+	"gzip":  {".gz", "gzip -c", "gzip -dc", "gzip -t", false},
+	"bzip2": {".bz2", "bzip2 -c", "bzip2 -dc", "bzip2 -t", false},
+	"xz":    {".xz", "xz -c", "xz -dc", "xz -t", true},
+	"zstd":  {".zst", "zstd -q -c", "zstd -q -dc", "zstd -q -t", true},
+}
+
+func shell_quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func zip_extensions(lctx *LmirrorContext) (map[string]string, map[string]string, error) {
+	/*
+	 Returns the format of each known extension and the extension written
+	 for each format, from the defaults and zip_ext_map= (fmt:.ext,...)
+	 */
+	ext_fmt := make(map[string]string)
+	fmt_ext := make(map[string]string)
+	for name, zf := range _ZIP_FORMATS {
+		ext_fmt[zf.ext] = name
+	}
+	ext_fmt[".tgz"] = "gzip"
+	ext_fmt[".Z"] = "gzip"
+	ext_fmt[".zip"] = "zip"
+	if lctx.Params["zip_ext_map"] == "" {
+		return ext_fmt, fmt_ext, nil
+	}
+	for _, pair := range strings.Split(lctx.Params["zip_ext_map"], _SKIP_PATTERNS_SEP) {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || strings.HasPrefix(parts[1], ".") == false {
+			return nil, nil, errors.New("Bad zip_ext_map entry " + pair)
+		}
+		if _, ok := _ZIP_FORMATS[parts[0]]; ok == false && parts[0] != "zip" {
+			return nil, nil, errors.New("Unknown format in zip_ext_map entry " + pair)
+		}
+		ext_fmt[parts[1]] = parts[0]
+		if _, ok := fmt_ext[parts[0]]; ok == false {
+			fmt_ext[parts[0]] = parts[1]
+		}
+	}
+	return ext_fmt, fmt_ext, nil
+}
+
+func check_transzip_params(params map[string]string) error {
+	lctx := &LmirrorContext{Params: params}
+	if _, _, err := zip_extensions(lctx); err != nil {
+		return err
+	}
+	for _, param := range []string{"zip_level", "zip_threads"} {
+		if params[param] == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(params[param]); err != nil || n < 0 {
+			return errors.New("Bad " + param + "=" + params[param])
+		}
+	}
+	return nil
+}
+
+func (fw *FTPWatcher) convert_zip(lctx *LmirrorContext, infile string, modtime time.Time) (string, error) {
+	/*
+	 Converts infile to zipfmt next to it, leaving infile untouched.
+	 Returns the converted file, or infile if it already is in zipfmt.
+	 */
+	target := lctx.Params["zipfmt"]
+	ext_fmt, fmt_ext, err := zip_extensions(lctx)
+	if err != nil {
+		return "", err
+	}
+	src_fmt, src_ext := "", path.Ext(infile)
+	if f, ok := ext_fmt[src_ext]; ok {
+		src_fmt = f
+	} else {
+		src_ext = ""
+	}
+	if src_fmt == target {
+		return infile, nil
+	}
+	produced, outfile := "", ""
+	out_zf, ok := _ZIP_FORMATS[target]
+	if ok == false || src_fmt == "zip" {
+		// Containers are left to compresstype, on a link so that infile survives a failure
+		tmp := path.Join(path.Dir(infile), ".transzip-"+path.Base(infile))
+		if _, err := place_file(infile, tmp, modtime, true, false); err != nil {
+			return "", err
+		}
+		produced, err = compresstype.Convert(tmp, target)
+		os.Remove(tmp)
+		if err != nil {
+			return "", err
+		}
+		outfile = path.Join(path.Dir(infile), strings.TrimPrefix(path.Base(produced), ".transzip-"))
+	} else {
+		out_ext := out_zf.ext
+		if e, ok := fmt_ext[target]; ok {
+			out_ext = e
+		}
+		outfile = strings.TrimSuffix(infile, src_ext) + out_ext
+		if src_ext == ".tgz" {
+			outfile = strings.TrimSuffix(infile, src_ext) + ".tar" + out_ext
+		}
+		produced = outfile + "@"
+		reader := "cat"
+		if src_fmt != "" {
+			reader = _ZIP_FORMATS[src_fmt].decompress
+		}
+		writer := out_zf.compress
+		if lctx.Params["zip_level"] != "" {
+			writer += " -" + lctx.Params["zip_level"]
+		}
+		if lctx.Params["zip_threads"] != "" && out_zf.threads {
+			writer += " -T" + lctx.Params["zip_threads"]
+		}
+		cmd := fmt.Sprintf("set -o pipefail; %s < %s | %s > %s", reader, shell_quote(infile), writer, shell_quote(produced))
+		lctx.Logger.Println("transzip :", cmd)
+		if _, stderr, err := run_with_timeout(cmd, fw.__tmp_dir, nil, plugin_timeout(lctx)); err != nil {
+			os.Remove(produced)
+			return "", fmt.Errorf("%v %s", err, stderr)
+		}
+	}
+	if outfile == infile {
+		os.Remove(produced)
+		return "", errors.New("Converted file would overwrite " + infile)
+	}
+	if lctx.Params["zip_verify"] == "1" {
+		test, ok := _ZIP_TESTS[target]
+		if ok == false {
+			test = _ZIP_FORMATS[target].test
+		}
+		if test == "" {
+			lctx.Logger.Println("transzip : No way to verify", target, "files, not verifying", produced)
+		} else if _, stderr, err := run_with_timeout(test+" "+shell_quote(produced), fw.__tmp_dir, nil, plugin_timeout(lctx)); err != nil {
+			os.Remove(produced)
+			return "", fmt.Errorf("Verification of %s failed : %v %s", produced, err, stderr)
+		}
+	}
+	if err := os.Rename(produced, outfile); err != nil {
+		os.Remove(produced)
+		return "", err
+	}
+	os.Chtimes(outfile, modtime, modtime)
+	return outfile, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where placed files keep the index of their versions, next to the file
+const _VERSIONS_DIR = ".versions"
+
+// FileVersion is one entry of the versions index of a logical file, newest first
+type FileVersion struct {
+	Path   string
+	Size   int64
+	Sha256 string
+	Mtime  string
+	Placed string
+}
+
+// collision_policy says what happens to an existing file when a new version is placed
+type collision_policy struct {
+	mode           string // old, overwrite, keep or timestamp
+	keep           int
+	skip_identical bool
+}
+
+func parse_collision_policy(spec string) (*collision_policy, error) {
+	/*
+	 Parses collision_policy=, a comma separated list of one of old,
+	 overwrite, keep-N and timestamp, optionally with skip-identical
+	 */
+	policy := &collision_policy{mode: "old"}
+	for _, part := range strings.Split(spec, _SKIP_PATTERNS_SEP) {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+		case part == "skip-identical":
+			policy.skip_identical = true
+		case part == "old" || part == "overwrite" || part == "timestamp":
+			policy.mode = part
+		case strings.HasPrefix(part, "keep-"):
+			n, err := strconv.Atoi(part[len("keep-"):])
+			if err != nil || n < 1 {
+				return nil, errors.New("Bad collision policy " + part)
+			}
+			policy.mode = "keep"
+			policy.keep = n
+		default:
+			return nil, errors.New("Unknown collision policy " + part)
+		}
+	}
+	return policy, nil
+}
+
+func versions_file(dst string) string {
+	return path.Join(path.Dir(dst), _VERSIONS_DIR, path.Base(dst)+".json")
+}
+
+func read_versions(dst string) []FileVersion {
+	versions := make([]FileVersion, 0)
+	buf, err := ioutil.ReadFile(versions_file(dst))
+	if err == nil {
+		json.Unmarshal(buf, &versions)
+	}
+	return versions
+}
+
+func write_versions(dst string, versions []FileVersion) error {
+	if err := os.MkdirAll(path.Dir(versions_file(dst)), 0755); err != nil {
+		return err
+	}
+	out, _ := json.MarshalIndent(versions, "", "    ")
+	tmp := versions_file(dst) + "@"
+	if err := ioutil.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, versions_file(dst))
+}
+
+func (fw *FTPWatcher) make_room_for_version(logger *log.Logger, plugin, dst string, policy *collision_policy) (map[string]string, error) {
+	/*
+	 Moves the existing dst out of the way as the policy says. Returns
+	 where each moved version went, blank for removed versions
+	 */
+	moved := make(map[string]string)
+	switch policy.mode {
+	case "overwrite":
+		moved[dst] = ""
+	case "old":
+		old := dst + ".old"
+		moved[old] = ""
+		os.Remove(old)
+		logger.Println(plugin+": ALERT :", dst, "exists, taking a backup before overwriting.")
+		if err := os.Rename(dst, old); err != nil {
+			return moved, err
+		}
+		moved[dst] = old
+	case "timestamp":
+		fi, err := os.Stat(dst)
+		if err != nil {
+			return moved, err
+		}
+		versioned := dst + "." + fi.ModTime().Format("20060102T150405")
+		logger.Println(plugin+":", dst, "exists, keeping it as", versioned)
+		if err := os.Rename(dst, versioned); err != nil {
+			return moved, err
+		}
+		moved[dst] = versioned
+	case "keep":
+		// dst.1 is the newest older version, dst.<keep> the oldest kept
+		oldest := fmt.Sprintf("%s.%d", dst, policy.keep)
+		os.Remove(oldest)
+		moved[oldest] = ""
+		for idx := policy.keep - 1; idx >= 1; idx-- {
+			from := fmt.Sprintf("%s.%d", dst, idx)
+			if _, err := os.Stat(from); err == nil {
+				to := fmt.Sprintf("%s.%d", dst, idx+1)
+				if err := os.Rename(from, to); err != nil {
+					return moved, err
+				}
+				moved[from] = to
+			}
+		}
+		logger.Println(plugin+":", dst, "exists, keeping it as", dst+".1")
+		if err := os.Rename(dst, dst+".1"); err != nil {
+			return moved, err
+		}
+		moved[dst] = dst + ".1"
+	}
+	return moved, nil
+}
+
+func update_versions(dst string, current LmirrorOutput, modtime time.Time, moved map[string]string) error {
+	/*
+	 Records the newly placed dst at the head of its versions index and
+	 follows the older versions to wherever they were moved
+	 */
+	versions := []FileVersion{FileVersion{
+		Path:   current.Path,
+		Size:   current.Size,
+		Sha256: current.Sha256,
+		Mtime:  modtime.Format("20060102 15:04:05"),
+		Placed: time.Now().Format("20060102 15:04:05"),
+	}}
+	seen := make(map[string]bool)
+	for _, v := range read_versions(dst) {
+		if to, ok := moved[v.Path]; ok {
+			if to == "" {
+				continue
+			}
+			v.Path = to
+		}
+		if _, err := os.Stat(v.Path); err != nil || v.Path == dst {
+			continue
+		}
+		seen[v.Path] = true
+		versions = append(versions, v)
+	}
+	// Versions placed before there was an index
+	for _, to := range moved {
+		if to == "" || seen[to] {
+			continue
+		}
+		if out, err := lmirror_output(to); err == nil {
+			fi, _ := os.Stat(to)
+			versions = append(versions, FileVersion{Path: to, Size: out.Size, Sha256: out.Sha256,
+				Mtime: fi.ModTime().Format("20060102 15:04:05")})
+		}
+	}
+	return write_versions(dst, versions)
+}